@@ -3,3 +3,6 @@ package abstraction
 //ContextClaimsKey is the code used to register claims into context
 const ContextClaimsKey = "ContextClaimsKey"
 const HttpUserIdHeader = "user-id"
+
+//ContextCorrelationIdKey is the code used to register the correlation id into context
+const ContextCorrelationIdKey = "ContextCorrelationIdKey"
@@ -1,15 +1,24 @@
 package abstraction
 
+import "time"
+
 //Endpoint stores the gateway configuration for each routing and is passed around to all handlers and middleware
 type Endpoint struct {
+	ServiceName          string
 	UpstreamPath         string
 	Secured              bool
 	OidcAudience         string
 	UpstreamPathPrefix   string
 	UpstreamURL          string
+	UpstreamTargets      *UpstreamTargets
 	DownstreamPath       string
 	DownstreamPathPrefix string
 	Methods              []string
+	Hosts                []string
+	Headers              map[string]string
+	Queries              map[string]string
+	Timeout              time.Duration
+	Retry                map[string]interface{}
 	HandlerType          string
 	HandlerConfig        map[string]interface{}
 	Filters              map[string]interface{}
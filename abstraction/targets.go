@@ -0,0 +1,65 @@
+package abstraction
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+//UpstreamTargets is the set of addresses serving an endpoint.
+//It is shared by all the endpoints of a service and can be replaced at runtime when the service discovery reports changes
+type UpstreamTargets struct {
+	addresses atomic.Pointer[[]string]
+	unhealthy atomic.Pointer[map[string]bool]
+}
+
+//NewUpstreamTargets creates a set of upstream targets
+func NewUpstreamTargets(addresses []string) *UpstreamTargets {
+	targets := new(UpstreamTargets)
+	targets.Store(addresses)
+	return targets
+}
+
+//Load returns the current addresses, the result must not be modified
+func (t *UpstreamTargets) Load() []string {
+	return *t.addresses.Load()
+}
+
+//Store replaces the addresses
+func (t *UpstreamTargets) Store(addresses []string) {
+	a := append([]string(nil), addresses...)
+	t.addresses.Store(&a)
+}
+
+//Healthy returns the current addresses that are not marked as unhealthy, the result must not be modified
+func (t *UpstreamTargets) Healthy() []string {
+	addresses := t.Load()
+	unhealthy := t.unhealthy.Load()
+	if unhealthy == nil || len(*unhealthy) == 0 {
+		return addresses
+	}
+
+	var healthy []string
+	for _, a := range addresses {
+		if !(*unhealthy)[a] {
+			healthy = append(healthy, a)
+		}
+	}
+	return healthy
+}
+
+//SetUnhealthy replaces the addresses taken out of rotation
+func (t *UpstreamTargets) SetUnhealthy(addresses []string) {
+	unhealthy := make(map[string]bool, len(addresses))
+	for _, a := range addresses {
+		unhealthy[a] = true
+	}
+	t.unhealthy.Store(&unhealthy)
+}
+
+//MarshalJSON describes the addresses and the healthy addresses, ex: for the admin api
+func (t *UpstreamTargets) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Addresses []string `json:"addresses"`
+		Healthy   []string `json:"healthy"`
+	}{t.Load(), t.Healthy()})
+}
@@ -0,0 +1,193 @@
+package accesslog
+
+import (
+	"fmt"
+	"github.com/osstotalsoft/bifrost/httputils"
+	"github.com/osstotalsoft/bifrost/middleware/correlation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//JSONFormat writes the entries as structured fields with the zap logger
+	JSONFormat = "json"
+	//CommonFormat writes the entries in the Common Log Format
+	CommonFormat = "common"
+	//CombinedFormat writes the entries in the Combined Log Format, the Common one with the referer and user agent
+	CombinedFormat = "combined"
+)
+
+//clfTimeFormat is the time format of the Common Log Format
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+//Config is the access log configuration, loaded from config.json
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	//Format is one of json, common or combined, json by default
+	Format string `mapstructure:"format"`
+	//File is the file where the common and combined entries are appended, the standard output by default
+	File string `mapstructure:"file"`
+	//SampleRate is the ratio of the requests logged, all of them if 0 or 1.
+	//The server errors are always logged
+	SampleRate float64 `mapstructure:"sample_rate"`
+	//ExcludePaths are the path prefixes which are not logged, ex: /health
+	ExcludePaths []string `mapstructure:"exclude_paths"`
+}
+
+//AccessLogger writes an entry for each request received by the gateway
+type AccessLogger struct {
+	config Config
+	logger *zap.Logger
+	mu     sync.Mutex
+	writer io.Writer
+	file   *os.File
+	sample func() float64
+}
+
+//NewAccessLogger creates an AccessLogger which writes the json entries with the logger
+//and the common or combined ones to the configured file
+func NewAccessLogger(config Config, logger *zap.Logger) (*AccessLogger, error) {
+	l := &AccessLogger{config: config, logger: logger, writer: os.Stdout, sample: rand.Float64}
+	if config.Format == "" {
+		l.config.Format = JSONFormat
+	}
+	if !config.Enabled {
+		return l, nil
+	}
+
+	switch l.config.Format {
+	case JSONFormat:
+	case CommonFormat, CombinedFormat:
+		if config.File != "" {
+			file, err := os.OpenFile(config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, err
+			}
+			l.file = file
+			l.writer = file
+		}
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", config.Format)
+	}
+	return l, nil
+}
+
+//Close closes the access log file, if any
+func Close(l *AccessLogger) error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+//Handler logs the requests received by the gateway.
+//It should wrap the router inside the tracing span, so that the trace id is known
+func Handler(l *AccessLogger) func(inner http.Handler) http.Handler {
+	return func(inner http.Handler) http.Handler {
+		if !l.config.Enabled {
+			return inner
+		}
+
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if l.excluded(request.URL.Path) {
+				inner.ServeHTTP(writer, request)
+				return
+			}
+
+			start := time.Now()
+			e := new(entry)
+			rw := httputils.NewStatusRecorder(writer)
+			inner.ServeHTTP(rw, request.WithContext(withEntry(request.Context(), e)))
+
+			if rw.Status < 500 && l.config.SampleRate > 0 && l.config.SampleRate < 1 && l.sample() >= l.config.SampleRate {
+				return
+			}
+			l.log(request, e, rw, start)
+		})
+	}
+}
+
+func (l *AccessLogger) excluded(path string) bool {
+	for _, prefix := range l.config.ExcludePaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *AccessLogger) log(request *http.Request, e *entry, rw *httputils.StatusRecorder, start time.Time) {
+	latency := time.Since(start)
+	traceID := ""
+	if spanContext := trace.SpanContextFromContext(request.Context()); spanContext.IsValid() {
+		traceID = spanContext.TraceID().String()
+	}
+
+	if l.config.Format == JSONFormat {
+		correlationID, _ := correlation.FromContext(request.Context())
+		l.logger.Info("access",
+			zap.String("method", request.Method),
+			zap.String("path", request.URL.Path),
+			zap.String("route", e.route),
+			zap.String("service", e.service),
+			zap.String("upstream_url", e.upstream),
+			zap.Int("status", rw.Status),
+			zap.Int64("bytes", rw.Size),
+			zap.Duration("latency", latency),
+			zap.String("client_ip", clientIP(request)),
+			zap.String("user", e.user),
+			zap.String("trace_id", traceID),
+			zap.String("correlation_id", correlationID),
+		)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(clientIP(request))
+	b.WriteString(" - ")
+	b.WriteString(orDash(e.user))
+	b.WriteString(" [")
+	b.WriteString(start.Format(clfTimeFormat))
+	b.WriteString("] \"")
+	b.WriteString(request.Method + " " + request.URL.RequestURI() + " " + request.Proto)
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(rw.Status))
+	b.WriteString(" ")
+	if rw.Size == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString(strconv.FormatInt(rw.Size, 10))
+	}
+	if l.config.Format == CombinedFormat {
+		b.WriteString(" " + strconv.Quote(orDash(request.Referer())) + " " + strconv.Quote(orDash(request.UserAgent())))
+	}
+	b.WriteString("\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = io.WriteString(l.writer, b.String())
+}
+
+func clientIP(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return ip
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,151 @@
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+var endpoint = abstraction.Endpoint{
+	ServiceName:          "offers-api",
+	DownstreamPathPrefix: "/offers",
+	UpstreamURL:          "http://offers-api/api",
+}
+
+//pipeline mimics the gateway: the router wrapped by the access log, the endpoint filter and the handler wrapper
+func pipeline(l *AccessLogger, inner http.Handler) http.Handler {
+	loggerFactory := log.ZapLoggerFactory(zap.NewNop())
+	h := HandlerWrapper(func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		return inner
+	})(endpoint, loggerFactory)
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := jwt.MapClaims{"sub": "d7a3c1e0"}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), abstraction.ContextClaimsKey, claims)))
+		})
+	}
+	return Handler(l)(EndpointFilter()(endpoint, loggerFactory)(auth(h)))
+}
+
+func TestJSONFormat(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	l, err := NewAccessLogger(Config{Enabled: true}, zap.New(core))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("offer"))
+	}))
+	defer upstream.Close()
+
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), "GET", upstream.URL+"/api/1", nil)
+		resp, err := NewRoundTripper(http.DefaultTransport).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("offer"))
+	})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+	ctx = context.WithValue(ctx, abstraction.ContextCorrelationIdKey, "abc-123")
+	req := httptest.NewRequest("POST", "/offers/1", nil).WithContext(ctx)
+	req.RemoteAddr = "10.0.0.7:51234"
+	pipeline(l, proxy).ServeHTTP(httptest.NewRecorder(), req)
+
+	if logs.Len() != 1 {
+		t.Fatalf("expected one access log entry, but got %v", logs.Len())
+	}
+	fields := logs.All()[0].ContextMap()
+	expected := map[string]interface{}{
+		"method":         "POST",
+		"path":           "/offers/1",
+		"route":          "/offers",
+		"service":        "offers-api",
+		"upstream_url":   upstream.URL + "/api/1",
+		"status":         int64(http.StatusCreated),
+		"bytes":          int64(5),
+		"client_ip":      "10.0.0.7",
+		"user":           "d7a3c1e0",
+		"trace_id":       "4bf92f3577b34da6a3ce929d0e0e4736",
+		"correlation_id": "abc-123",
+	}
+	for k, v := range expected {
+		if fields[k] != v {
+			t.Errorf("expected %v to be %v, but got %v", k, v, fields[k])
+		}
+	}
+}
+
+func TestCombinedFormat(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLogger(Config{Enabled: true, Format: CombinedFormat, File: file}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := pipeline(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req := httptest.NewRequest("GET", "/offers/1?active=true", nil)
+	req.RemoteAddr = "10.0.0.7:51234"
+	req.Header.Set("User-Agent", "curl/8.5.0")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if err := Close(l); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(file)
+	line := regexp.MustCompile(`^10\.0\.0\.7 - d7a3c1e0 \[[^\]]+\] "GET /offers/1\?active=true HTTP/1\.1" 204 - "-" "curl/8\.5\.0"\n$`)
+	if !line.Match(content) {
+		t.Errorf("unexpected combined log line %q", content)
+	}
+}
+
+func TestSamplingAndExclusions(t *testing.T) {
+	var buffer bytes.Buffer
+	l, err := NewAccessLogger(Config{Enabled: true, Format: CommonFormat, SampleRate: 0.5, ExcludePaths: []string{"/health"}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.writer = &buffer
+	l.sample = func() float64 { return 0.7 }
+
+	status := http.StatusOK
+	h := pipeline(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/offers", nil))
+	if buffer.Len() != 0 {
+		t.Errorf("expected the excluded and unsampled requests not to be logged, but got %q", buffer.String())
+	}
+
+	status = http.StatusBadGateway
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/offers", nil))
+	if !bytes.Contains(buffer.Bytes(), []byte(`"GET /offers HTTP/1.1" 502`)) {
+		t.Errorf("expected the server errors to be always logged, but got %q", buffer.String())
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewAccessLogger(Config{Enabled: true, Format: "xml"}, zap.NewNop()); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
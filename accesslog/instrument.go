@@ -0,0 +1,100 @@
+package accesslog
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/handler"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"github.com/osstotalsoft/bifrost/strutils"
+	"net/http"
+)
+
+//AccessLogFilterCode is the code used to register the access log middleware
+const AccessLogFilterCode = "access_log"
+
+const entryKey = "AccessLogEntryKey"
+
+//entry holds what is learned about the request after routing, it is filled by the endpoint pipeline
+type entry struct {
+	route    string
+	service  string
+	upstream string
+	user     string
+}
+
+func withEntry(ctx context.Context, e *entry) context.Context {
+	return context.WithValue(ctx, entryKey, e)
+}
+
+func entryFromContext(ctx context.Context) (*entry, bool) {
+	e, ok := ctx.Value(entryKey).(*entry)
+	return e, ok
+}
+
+//EndpointFilter is a middleware that records the matched route and service of the request.
+//It should be the first middleware, so that the requests rejected by the filters are logged with their route
+func EndpointFilter() middleware.Func {
+	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		route := endpoint.DownstreamPathPrefix
+		if endpoint.DownstreamPath != "" {
+			route = strutils.SingleJoiningSlash(endpoint.DownstreamPathPrefix, endpoint.DownstreamPath)
+		}
+
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				if e, ok := entryFromContext(request.Context()); ok {
+					e.route = route
+					e.service = endpoint.ServiceName
+					e.upstream = endpoint.UpstreamURL
+				}
+				next.ServeHTTP(writer, request)
+			})
+		}
+	}
+}
+
+//HandlerWrapper records the sub claim of the authenticated user, known once the request passed the filters
+func HandlerWrapper(inner handler.Func) handler.Func {
+	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		h := inner(endpoint, loggerFactory)
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if e, ok := entryFromContext(request.Context()); ok {
+				e.user = subject(request.Context())
+			}
+			h.ServeHTTP(writer, request)
+		})
+	}
+}
+
+//subject is the sub claim of the authenticated user, if any
+func subject(ctx context.Context) string {
+	var claims map[string]interface{}
+	switch c := ctx.Value(abstraction.ContextClaimsKey).(type) {
+	case jwt.MapClaims:
+		claims = c
+	case map[string]interface{}:
+		claims = c
+	}
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+//RoundTripper records the upstream URL the request was forwarded to
+type RoundTripper struct {
+	http.RoundTripper
+}
+
+//NewRoundTripper creates a RoundTripper which records the upstream URL and delegates to the inner one
+func NewRoundTripper(inner http.RoundTripper) http.RoundTripper {
+	return &RoundTripper{RoundTripper: inner}
+}
+
+//RoundTrip records the URL of the request and delegates it to the inner RoundTripper
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if e, ok := entryFromContext(req.Context()); ok {
+		e.upstream = req.URL.String()
+	}
+	return rt.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,128 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/osstotalsoft/bifrost/log"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//Config is the configuration of the admin listener, loaded from config.json
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	Port    int  `mapstructure:"port"`
+	//Username and Password enable the basic authentication of the admin requests
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	//Token enables the authentication of the admin requests with an "Authorization: Bearer <token>" header
+	Token string `mapstructure:"token"`
+}
+
+//ValidateConfig rejects an enabled admin listener without credentials and a username without password
+func ValidateConfig(config Config) error {
+	if config.Username != "" && config.Password == "" {
+		return errors.New("the admin password is required with the admin username")
+	}
+	if config.Enabled && config.Username == "" && config.Token == "" {
+		return errors.New("the admin api requires a username and a password or a token")
+	}
+	return nil
+}
+
+//Server is the admin listener, separated from the gateway listener
+type Server struct {
+	config        Config
+	mux           *http.ServeMux
+	loggerFactory log.Factory
+	closer        func() error
+}
+
+//NewAdminServer is the admin Server constructor
+func NewAdminServer(config Config, loggerFactory log.Factory) *Server {
+	return &Server{
+		config:        config,
+		mux:           http.NewServeMux(),
+		loggerFactory: loggerFactory,
+		closer: func() error {
+			return nil
+		},
+	}
+}
+
+//Handle registers the handler of an admin endpoint
+func Handle(server *Server) func(pattern string, handler http.Handler) {
+	return func(pattern string, handler http.Handler) {
+		server.mux.Handle(pattern, handler)
+	}
+}
+
+//ListenAndServe starts the admin listener, if enabled
+func ListenAndServe(server *Server) error {
+	if !server.config.Enabled {
+		return nil
+	}
+
+	err := ValidateConfig(server.config)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(server.config.Port),
+		Handler: authenticate(server.config)(server.mux),
+	}
+
+	idleConnsClosed := make(chan struct{})
+	server.closer = func() error {
+		err := srv.Shutdown(context.Background())
+		close(idleConnsClosed)
+		return err
+	}
+
+	server.loggerFactory(nil).Info("Admin: listening", zap.Int("port", server.config.Port))
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-idleConnsClosed
+	return nil
+}
+
+//authenticate rejects the requests without the configured credentials, either of them is accepted when both are configured.
+//All the requests are rejected when no credential is configured
+func authenticate(config Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if config.Token != "" {
+				token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+				if ok && equal(token, config.Token) {
+					next.ServeHTTP(writer, request)
+					return
+				}
+			}
+			if config.Username != "" && config.Password != "" {
+				username, password, ok := request.BasicAuth()
+				if ok && equal(username, config.Username) && equal(password, config.Password) {
+					next.ServeHTTP(writer, request)
+					return
+				}
+				writer.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			}
+			http.Error(writer, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		})
+	}
+}
+
+//equal compares the credentials in constant time
+func equal(actual, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) == 1
+}
+
+//Shutdown stops the admin listener
+func Shutdown(server *Server) error {
+	return server.closer()
+}
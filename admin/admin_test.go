@@ -0,0 +1,165 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/gateway"
+	"github.com/osstotalsoft/bifrost/handler"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/router"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry/inmemory"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatchHandler(t *testing.T) {
+	factory := log.ZapLoggerFactory(zap.NewNop())
+	dynRouter := router.NewDynamicRouter(router.GorillaMuxRouteMatcher, factory)
+	registry := inmemory.NewInMemoryStore()
+	gate := gateway.NewGateway(&gateway.Config{
+		Endpoints: []gateway.EndpointConfig{{ServiceName: "offers", DownstreamPath: "/get/{id}", UpstreamPath: "/api/offers/{id}"}},
+	}, registry, factory)
+	gateway.RegisterHandler(gate)(handler.ReverseProxyHandlerType, func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		return http.NotFoundHandler()
+	})
+	gateway.UseMiddleware(gate)("rate_limit", func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler { return next }
+	})
+	gateway.AddService(gate)(router.AddRoute(dynRouter))(servicediscovery.Service{UID: "1", Resource: "offers", Address: "http://offers.lsng"})
+
+	matchHandler := MatchHandler(router.MatchRoute(dynRouter), registry)
+
+	var result MatchResult
+	get(t, matchHandler, "/match?method=GET&path=/offers/get/5", &result)
+	if !result.Matched || len(result.Upstreams) != 1 {
+		t.Fatalf("expected the route of the offers service to be matched, but got %+v", result)
+	}
+	if url := result.Upstreams[0].UpstreamURL; url != "http://offers.lsng/api/offers/5" {
+		t.Errorf("expected the upstream url http://offers.lsng/api/offers/5, but got %v", url)
+	}
+	routeId := router.Routes(dynRouter)()[0].UID
+	if result.Route.UID != routeId || result.Vars["id"] != "5" {
+		t.Errorf("expected the route and the vars of the request, but got %+v", result)
+	}
+
+	result = MatchResult{}
+	get(t, matchHandler, "/match?path=/partners", &result)
+	if result.Matched {
+		t.Errorf("expected no route to be matched, but got %+v", result)
+	}
+
+	recorder := httptest.NewRecorder()
+	matchHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/match?method=GET", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d without a path, but got %d", http.StatusBadRequest, recorder.Code)
+	}
+
+	var endpoints []ServiceEndpoints
+	get(t, EndpointsHandler(registry, func() []string { return gateway.Middlewares(gate) }), "/endpoints", &endpoints)
+	if len(endpoints) != 1 || endpoints[0].Endpoints[0].RouteID != routeId || endpoints[0].Endpoints[0].Middlewares[0].Key != "rate_limit" {
+		t.Errorf("expected the endpoint with its route and its middlewares, but got %+v", endpoints)
+	}
+}
+
+func TestTrafficWeightsHandler(t *testing.T) {
+	var changed map[string]int
+	weightsHandler := TrafficWeightsHandler(func(resource string, weights map[string]int) error {
+		if resource != "offers" {
+			return errors.New("no traffic split configured for " + resource)
+		}
+		changed = weights
+		return nil
+	})
+
+	cases := []struct {
+		method   string
+		target   string
+		body     string
+		expected int
+	}{
+		{http.MethodPut, "/traffic_weights?resource=offers", `{"v1": 90, "v2": 10}`, http.StatusNoContent},
+		{http.MethodPut, "/traffic_weights?resource=partners", `{"v1": 100}`, http.StatusBadRequest},
+		{http.MethodPut, "/traffic_weights?resource=offers", `{"v1": "all"}`, http.StatusBadRequest},
+		{http.MethodGet, "/traffic_weights?resource=offers", "", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		weightsHandler.ServeHTTP(recorder, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+		if recorder.Code != tc.expected {
+			t.Errorf("%s %s %s: expected status %d, but got %d", tc.method, tc.target, tc.body, tc.expected, recorder.Code)
+		}
+	}
+	if changed["v1"] != 90 || changed["v2"] != 10 {
+		t.Errorf("expected the weights v1: 90 and v2: 10, but got %v", changed)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		title    string
+		config   Config
+		setup    func(request *http.Request)
+		expected int
+	}{
+		{"no authentication", Config{}, func(request *http.Request) {}, http.StatusUnauthorized},
+		{"basic", Config{Username: "admin", Password: "pass"}, func(request *http.Request) { request.SetBasicAuth("admin", "pass") }, http.StatusOK},
+		{"wrong password", Config{Username: "admin", Password: "pass"}, func(request *http.Request) { request.SetBasicAuth("admin", "other") }, http.StatusUnauthorized},
+		{"token", Config{Token: "secret"}, func(request *http.Request) { request.Header.Set("Authorization", "Bearer secret") }, http.StatusOK},
+		{"missing token", Config{Token: "secret"}, func(request *http.Request) {}, http.StatusUnauthorized},
+		{"token without scheme", Config{Token: "secret"}, func(request *http.Request) { request.Header.Set("Authorization", "secret") }, http.StatusUnauthorized},
+		{"empty password", Config{Username: "admin"}, func(request *http.Request) { request.SetBasicAuth("admin", "") }, http.StatusUnauthorized},
+		{"basic or token", Config{Username: "admin", Password: "pass", Token: "secret"}, func(request *http.Request) { request.SetBasicAuth("admin", "pass") }, http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		request := httptest.NewRequest(http.MethodGet, "/services", nil)
+		tc.setup(request)
+		recorder := httptest.NewRecorder()
+		authenticate(tc.config)(next).ServeHTTP(recorder, request)
+		if recorder.Code != tc.expected {
+			t.Errorf("%s: expected status %d, but got %d", tc.title, tc.expected, recorder.Code)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	invalid := []Config{
+		{Enabled: true},
+		{Enabled: true, Port: 8091, Password: "pass"},
+		{Username: "admin"},
+	}
+	for _, config := range invalid {
+		if err := ValidateConfig(config); err == nil {
+			t.Errorf("expected the configuration %+v to be rejected", config)
+		}
+	}
+
+	valid := []Config{
+		{},
+		{Enabled: true, Token: "secret"},
+		{Enabled: true, Username: "admin", Password: "pass"},
+	}
+	for _, config := range valid {
+		if err := ValidateConfig(config); err != nil {
+			t.Errorf("expected the configuration %+v to be accepted, but got %v", config, err)
+		}
+	}
+
+	if err := ListenAndServe(NewAdminServer(Config{Enabled: true}, log.ZapLoggerFactory(zap.NewNop()))); err == nil {
+		t.Error("expected the admin listener to refuse to serve without credentials")
+	}
+}
+
+func get(t *testing.T, handler http.Handler, target string, result interface{}) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil {
+		t.Fatalf("cannot decode the response of %s: %v", target, err)
+	}
+}
@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/handler"
+	"github.com/osstotalsoft/bifrost/handler/reverseproxy"
+	"github.com/osstotalsoft/bifrost/router"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry"
+	"net/http"
+)
+
+//ServiceEndpoints are the endpoints generated for a discovered service
+type ServiceEndpoints struct {
+	ServiceUID string              `json:"service_uid"`
+	Resource   string              `json:"resource"`
+	Endpoints  []EndpointWithRoute `json:"endpoints"`
+}
+
+//EndpointWithRoute is an endpoint with the id of its route and the middlewares it goes through
+type EndpointWithRoute struct {
+	RouteID     string               `json:"route_id"`
+	Endpoint    abstraction.Endpoint `json:"endpoint"`
+	Middlewares []MiddlewareInfo     `json:"middlewares"`
+}
+
+//MiddlewareInfo is a middleware of an endpoint chain with the filter options set on the endpoint, if any
+type MiddlewareInfo struct {
+	Key     string      `json:"key"`
+	Options interface{} `json:"endpoint_options,omitempty"`
+}
+
+//MatchResult tells which route and upstreams a request would hit
+type MatchResult struct {
+	Matched   bool              `json:"matched"`
+	Route     *router.Route     `json:"route,omitempty"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	Upstreams []MatchUpstream   `json:"upstreams,omitempty"`
+}
+
+//MatchUpstream is an endpoint served by the matched route, a traffic split has one for each version of the service
+type MatchUpstream struct {
+	ServiceUID  string   `json:"service_uid"`
+	Version     string   `json:"version,omitempty"`
+	HandlerType string   `json:"handler_type"`
+	UpstreamURL string   `json:"upstream_url"`
+	Targets     []string `json:"targets,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+//ServicesHandler lists the discovered services
+func ServicesHandler(registry registry.Registry) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		services := []servicediscovery.Service{}
+		for _, entry := range registry.List() {
+			services = append(services, entry.Service)
+		}
+		writeJSON(writer, services)
+	})
+}
+
+//EndpointsHandler lists the endpoints generated for each service, with their route and their middleware chain.
+//middlewares returns the keys of the middlewares, the outermost first
+func EndpointsHandler(registry registry.Registry, middlewares func() []string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		keys := middlewares()
+		result := []ServiceEndpoints{}
+		for _, entry := range registry.List() {
+			service := ServiceEndpoints{ServiceUID: entry.Service.UID, Resource: entry.Service.Resource, Endpoints: []EndpointWithRoute{}}
+			for i, endpoint := range entry.Endpoints {
+				e := EndpointWithRoute{Endpoint: endpoint, Middlewares: []MiddlewareInfo{}}
+				if i < len(entry.Routes) {
+					e.RouteID = entry.Routes[i]
+				}
+				for _, key := range keys {
+					e.Middlewares = append(e.Middlewares, MiddlewareInfo{key, endpoint.Filters[key]})
+				}
+				service.Endpoints = append(service.Endpoints, e)
+			}
+			result = append(result, service)
+		}
+		writeJSON(writer, result)
+	})
+}
+
+//RoutesHandler lists the routes of the router, in the order of precedence
+func RoutesHandler(routes func() []router.Route) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		result := routes()
+		if result == nil {
+			result = []router.Route{}
+		}
+		writeJSON(writer, result)
+	})
+}
+
+//ConfigHandler returns the configuration in effect
+func ConfigHandler(settings func() map[string]interface{}) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writeJSON(writer, settings())
+	})
+}
+
+//MatchHandler is a dry run of the routing of a request described by the query: method (GET by default), path and host.
+//It tells which route would be matched and to which upstream url the request would be forwarded, without forwarding it
+func MatchHandler(matchRoute func(request *http.Request) (router.Route, router.RouteMatch), registry registry.Registry) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		query := request.URL.Query()
+		method, path, host := query.Get("method"), query.Get("path"), query.Get("host")
+		if method == "" {
+			method = http.MethodGet
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		if path == "" || path[0] != '/' {
+			http.Error(writer, "the path query parameter must start with /", http.StatusBadRequest)
+			return
+		}
+
+		dryRun, err := http.NewRequest(method, "http://"+host+path, nil)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		route, routeMatch := matchRoute(dryRun)
+		if !routeMatch.Matched {
+			writeJSON(writer, MatchResult{Matched: false})
+			return
+		}
+
+		routeContext := router.RouteContext{Path: route.Path, PathPrefix: route.PathPrefix, Timeout: route.Timeout, Vars: routeMatch.Vars}
+		result := MatchResult{Matched: true, Route: &route, Vars: routeMatch.Vars, Upstreams: []MatchUpstream{}}
+		for _, entry := range registry.List() {
+			for i, routeId := range entry.Routes {
+				if routeId == route.UID && i < len(entry.Endpoints) {
+					result.Upstreams = append(result.Upstreams, matchUpstream(entry.Service, entry.Endpoints[i], dryRun, routeContext))
+				}
+			}
+		}
+		writeJSON(writer, result)
+	})
+}
+
+//TrafficWeightsHandler changes at runtime the weights of the versions of the resource given in the query,
+//ex: PUT /traffic_weights?resource=offers with the body {"v1": 90, "v2": 10}
+func TrafficWeightsHandler(setWeights func(resource string, weights map[string]int) error) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPut {
+			writer.Header().Set("Allow", http.MethodPut)
+			http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		var weights map[string]int
+		if err := json.NewDecoder(request.Body).Decode(&weights); err != nil {
+			http.Error(writer, "the body must be the weights of the versions: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := setWeights(request.URL.Query().Get("resource"), weights); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func matchUpstream(service servicediscovery.Service, endpoint abstraction.Endpoint, request *http.Request, routeContext router.RouteContext) MatchUpstream {
+	upstream := MatchUpstream{
+		ServiceUID:  service.UID,
+		Version:     service.Version,
+		HandlerType: endpoint.HandlerType,
+		UpstreamURL: endpoint.UpstreamURL,
+	}
+	if endpoint.UpstreamTargets != nil {
+		upstream.Targets = endpoint.UpstreamTargets.Healthy()
+	}
+	if endpoint.HandlerType != handler.ReverseProxyHandlerType {
+		return upstream
+	}
+
+	upstreamURL, err := reverseproxy.UpstreamURL(endpoint, request, routeContext)
+	if err != nil {
+		upstream.Error = err.Error()
+		return upstream
+	}
+	upstream.UpstreamURL = upstreamURL
+	return upstream
+}
+
+func writeJSON(writer http.ResponseWriter, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
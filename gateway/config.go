@@ -1,5 +1,7 @@
 package gateway
 
+import "time"
+
 //Config is an object loaded from config.json
 type Config struct {
 	Endpoints                    []EndpointConfig `mapstructure:"endpoints"`
@@ -12,6 +14,14 @@ type Config struct {
 	InCluster                    bool             `mapstructure:"in_cluster"`
 	OverrideServiceAddress       string           `mapstructure:"override_service_address"`
 	ServiceNamespacePrefixFilter string           `mapstructure:"service_namespace_prefix_filter"`
+	EndpointSlices               bool             `mapstructure:"endpoint_slices"`
+	//ServiceDiscoveryProviders are where the services are discovered: kubernetes, by default, file and consul.
+	//When a resource is found by several providers, the first one in the list takes precedence
+	ServiceDiscoveryProviders []string `mapstructure:"service_discovery_providers"`
+	//ServicesFile is the YAML or JSON file of the file provider
+	ServicesFile  string               `mapstructure:"services_file"`
+	Timeout       time.Duration        `mapstructure:"timeout"`
+	TrafficSplits []TrafficSplitConfig `mapstructure:"traffic_splits"`
 }
 
 //EndpointConfig is a configuration detail from config.json
@@ -22,7 +32,20 @@ type EndpointConfig struct {
 	DownstreamPathPrefix string                 `mapstructure:"downstream_path_prefix"`
 	ServiceName          string                 `mapstructure:"service_name"`
 	Methods              []string               `mapstructure:"methods"`
+	Hosts                []string               `mapstructure:"hosts"`
+	Headers              map[string]string      `mapstructure:"headers"`
+	Queries              map[string]string      `mapstructure:"queries"`
+	Timeout              time.Duration          `mapstructure:"timeout"`
+	Retry                map[string]interface{} `mapstructure:"retry"`
 	HandlerType          string                 `mapstructure:"handler_type"`
 	HandlerConfig        map[string]interface{} `mapstructure:"handler_config"`
 	Filters              map[string]interface{} `mapstructure:"filters"`
 }
+
+//TrafficSplitConfig shares the routes of a service between its versions, ex: for canary releases
+type TrafficSplitConfig struct {
+	ServiceName  string         `mapstructure:"service_name"`
+	Weights      map[string]int `mapstructure:"weights"`
+	StickyCookie string         `mapstructure:"sticky_cookie"`
+	StickyHeader string         `mapstructure:"sticky_header"`
+}
@@ -9,9 +9,11 @@ import (
 	"github.com/osstotalsoft/bifrost/log"
 	"github.com/osstotalsoft/bifrost/middleware"
 	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry"
 	"github.com/osstotalsoft/bifrost/strutils"
 	"go.uber.org/zap"
 	"net/http"
+	"reflect"
 	"strconv"
 	"sync"
 )
@@ -21,12 +23,16 @@ const DefaultHandlerType = handler.ReverseProxyHandlerType
 
 //Gateway is a http.Handler able to route request to different handlers
 type Gateway struct {
-	config                *Config
-	endPointToRouteMapper sync.Map
-	middlewares           []middlewareTuple
-	handlers              map[string]handler.Func
-	loggerFactory         log.Factory
-	closer                func() error
+	config        *Config
+	registry      registry.Registry
+	middlewares   []middlewareTuple
+	handlers      map[string]handler.Func
+	loggerFactory log.Factory
+	closer        func() error
+	mutex         sync.Mutex
+	splits        map[string]*trafficSplit
+	//updateMutex serializes the service discovery events and the reloads of the configuration
+	updateMutex sync.Mutex
 }
 
 type middlewareTuple struct {
@@ -34,15 +40,18 @@ type middlewareTuple struct {
 	middleware middleware.Func
 }
 
-//NewGateway is the Gateway constructor
-func NewGateway(config *Config, loggerFactory log.Factory) *Gateway {
+//NewGateway is the Gateway constructor, the services found and their routes are tracked in the registry
+func NewGateway(config *Config, registry registry.Registry, loggerFactory log.Factory) *Gateway {
 	if config == nil {
 		loggerFactory(nil).Error("Gateway: Must provide a configuration file")
+		config = new(Config)
 	}
 	return &Gateway{
 		config:        config,
+		registry:      registry,
 		handlers:      map[string]handler.Func{},
 		loggerFactory: loggerFactory,
+		splits:        newTrafficSplits(config.TrafficSplits),
 	}
 }
 
@@ -50,15 +59,22 @@ func NewGateway(config *Config, loggerFactory log.Factory) *Gateway {
 type AddServiceFunc func(addRouteFunc AddRouteFunc) func(service servicediscovery.Service)
 
 //AddRouteFunc is a type for adding routes using the same signature
-type AddRouteFunc func(path string, pathPrefix string, methods []string, handler http.Handler) (string, error)
+type AddRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error)
 
 //UpdateEndpointFunc is a type for updating endpoints using the same signature
 type UpdateEndpointFunc func(addRouteFunc AddRouteFunc, removeRouteFunc func(routeId string)) func(oldService servicediscovery.Service, newService servicediscovery.Service)
 
+//RoutesTransactionFunc is a type for adding and removing routes at once using the same signature,
+//the changes are dropped when f returns an error
+type RoutesTransactionFunc func(f func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error) error
+
 //AddService adds a service to the gateway
 func AddService(gate *Gateway) AddServiceFunc {
 	return func(addRouteFunc AddRouteFunc) func(service servicediscovery.Service) {
 		return func(service servicediscovery.Service) {
+			gate.updateMutex.Lock()
+			defer gate.updateMutex.Unlock()
+
 			err := validateService(gate, service)
 			if err != nil {
 				gate.loggerFactory(nil).Error("Gateway: invalid service ", zap.Error(err), zap.Any("service", service))
@@ -73,6 +89,13 @@ func AddService(gate *Gateway) AddServiceFunc {
 func UpdateService(gate *Gateway) UpdateEndpointFunc {
 	return func(addRouteFunc AddRouteFunc, removeRouteFunc func(routeId string)) func(oldService servicediscovery.Service, newService servicediscovery.Service) {
 		return func(oldService servicediscovery.Service, newService servicediscovery.Service) {
+			gate.updateMutex.Lock()
+			defer gate.updateMutex.Unlock()
+
+			//only the instances changed, the routes are kept
+			if updateTargets(gate, oldService, newService) {
+				return
+			}
 			//removing routes
 			removeRoutes(gate, oldService, removeRouteFunc)
 			err := validateService(gate, newService)
@@ -90,6 +113,9 @@ func UpdateService(gate *Gateway) UpdateEndpointFunc {
 func RemoveService(gate *Gateway) func(removeRouteFunc func(routeId string)) func(service servicediscovery.Service) {
 	return func(removeRouteFunc func(routeId string)) func(service servicediscovery.Service) {
 		return func(service servicediscovery.Service) {
+			gate.updateMutex.Lock()
+			defer gate.updateMutex.Unlock()
+
 			removeRoutes(gate, service, removeRouteFunc)
 		}
 	}
@@ -118,28 +144,72 @@ func validateService(gate *Gateway, service servicediscovery.Service) error {
 }
 
 func internalAddService(gate *Gateway, service servicediscovery.Service, addRouteFunc AddRouteFunc) []abstraction.Endpoint {
-	var routes []string
-
 	endpoints := createEndpoints(gate.config, service)
+	targets := abstraction.NewUpstreamTargets(serviceAddresses(service))
+	for i := range endpoints {
+		endpoints[i].UpstreamTargets = targets
+	}
+
 	gate.loggerFactory(nil).Info("Gateway: created enpoints for service", zap.Any("service", service), zap.Any("endpoints", endpoints))
-	for _, endp := range endpoints {
-		routeId, _ := addRouteFunc(endp.DownstreamPath, endp.DownstreamPathPrefix, endp.Methods, getEndpointHandler(gate, endp))
-		routes = append(routes, routeId)
+	var routes []string
+	if split, ok := gate.splits[service.Resource]; ok {
+		routes = addSplitService(gate, split, service, endpoints, addRouteFunc)
+	} else {
+		for _, endp := range endpoints {
+			routeId, _ := addRouteFunc(endp, getEndpointHandler(gate, endp))
+			routes = append(routes, routeId)
+		}
 	}
-	gate.endPointToRouteMapper.Store(service.UID, routes)
+
+	gate.registry.Store(registry.Entry{Service: service, Endpoints: endpoints, Routes: routes, Targets: targets})
 	return endpoints
 }
 
 func removeRoutes(gate *Gateway, oldService servicediscovery.Service, removeRouteFunc func(routeId string)) {
-	gate.endPointToRouteMapper.Range(func(key, value interface{}) bool {
-		if key == oldService.UID {
-			for _, rId := range value.([]string) {
+	entry, ok := gate.registry.Load(oldService.UID)
+	gate.registry.Delete(oldService.UID)
+
+	if split, ok := gate.splits[oldService.Resource]; ok {
+		removeSplitService(gate, split, oldService, removeRouteFunc)
+		return
+	}
+
+	if ok {
+		for _, rId := range entry.Routes {
+			if rId != "" {
 				removeRouteFunc(rId)
 			}
-			return false
 		}
-		return true
-	})
+	}
+}
+
+//updateTargets replaces the upstream targets of a service when nothing but its addresses changed
+func updateTargets(gate *Gateway, oldService servicediscovery.Service, newService servicediscovery.Service) bool {
+	o, n := oldService, newService
+	o.Addresses, n.Addresses = nil, nil
+	if !reflect.DeepEqual(o, n) {
+		return false
+	}
+
+	entry, ok := gate.registry.Load(oldService.UID)
+	if !ok {
+		return false
+	}
+
+	entry.Targets.Store(serviceAddresses(newService))
+	entry.Service = newService
+	gate.registry.Store(entry)
+	gate.loggerFactory(nil).Info("Gateway: updated upstream targets", zap.String("uid", newService.UID), zap.Strings("addresses", entry.Targets.Load()))
+	return true
+}
+
+//serviceAddresses returns the addresses of the service instances or the service address if they are not known.
+//A service without ready instances has no targets, so that its requests are answered with 503
+func serviceAddresses(service servicediscovery.Service) []string {
+	if service.Addresses != nil {
+		return service.Addresses
+	}
+	return []string{service.Address}
 }
 
 func createEndpoints(config *Config, service servicediscovery.Service) []abstraction.Endpoint {
@@ -156,6 +226,7 @@ func createEndpoints(config *Config, service servicediscovery.Service) []abstrac
 			endPoint.HandlerType = DefaultHandlerType
 		}
 
+		endPoint.ServiceName = service.Name
 		endPoint.Secured = service.Secured
 		endPoint.OidcAudience = service.OidcAudience
 		if service.OidcAudience == "" {
@@ -174,6 +245,14 @@ func createEndpoints(config *Config, service servicediscovery.Service) []abstrac
 		endPoint.UpstreamPath = endp.UpstreamPath
 		endPoint.DownstreamPath = endp.DownstreamPath
 		endPoint.Methods = endp.Methods
+		endPoint.Hosts = endp.Hosts
+		endPoint.Headers = endp.Headers
+		endPoint.Queries = endp.Queries
+		endPoint.Timeout = endp.Timeout
+		if endPoint.Timeout == 0 {
+			endPoint.Timeout = config.Timeout
+		}
+		endPoint.Retry = endp.Retry
 		endPoints = append(endPoints, endPoint)
 	}
 
@@ -181,6 +260,7 @@ func createEndpoints(config *Config, service servicediscovery.Service) []abstrac
 	if len(endPoints) == 0 {
 		var endPoint abstraction.Endpoint
 
+		endPoint.ServiceName = service.Name
 		endPoint.Secured = service.Secured
 		endPoint.OidcAudience = service.OidcAudience
 		if service.OidcAudience == "" {
@@ -190,6 +270,7 @@ func createEndpoints(config *Config, service servicediscovery.Service) []abstrac
 		endPoint.DownstreamPathPrefix = strutils.SingleJoiningSlash(config.DownstreamPathPrefix, service.Resource)
 		endPoint.UpstreamURL = strutils.SingleJoiningSlash(service.Address, config.UpstreamPathPrefix)
 		endPoint.UpstreamPathPrefix = config.UpstreamPathPrefix
+		endPoint.Timeout = config.Timeout
 		endPoints = append(endPoints, endPoint)
 	}
 
@@ -232,6 +313,23 @@ func ListenAndServe(gate *Gateway, handler http.Handler) error {
 	return nil
 }
 
+//Middlewares returns the keys of the middlewares, in the order they are applied to the endpoints
+func Middlewares(gate *Gateway) []string {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	var keys []string
+	for _, m := range gate.middlewares {
+		keys = append(keys, m.key)
+	}
+	return keys
+}
+
+//Registry returns the registry of the services found by the gateway
+func Registry(gate *Gateway) registry.Registry {
+	return gate.registry
+}
+
 func Shutdown(gate *Gateway) error {
 	return gate.closer()
 }
@@ -4,9 +4,13 @@ import (
 	"github.com/osstotalsoft/bifrost/abstraction"
 	"github.com/osstotalsoft/bifrost/log"
 	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry/inmemory"
 	"go.uber.org/zap"
 	"net/http"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 )
 
 type gateTest struct {
@@ -137,7 +141,7 @@ var (
 func TestAddService(t *testing.T) {
 	logger, _ := zap.NewDevelopment()
 	factory := log.ZapLoggerFactory(logger)
-	gate := NewGateway(&testConfig1, factory)
+	gate := NewGateway(&testConfig1, inmemory.NewInMemoryStore(), factory)
 	RegisterHandler(gate)(DefaultHandlerType, func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		})
@@ -149,7 +153,7 @@ func TestAddService(t *testing.T) {
 			t.Run(tc.title, func(t *testing.T) {
 				t.Parallel()
 
-				endp := internalAddService(gate, tc.service, func(path string, pathPrefix string, methods []string, handler http.Handler) (id string, e error) {
+				endp := internalAddService(gate, tc.service, func(endpoint abstraction.Endpoint, handler http.Handler) (id string, e error) {
 					return "1", nil
 				})
 
@@ -166,3 +170,84 @@ func TestAddService(t *testing.T) {
 		}
 	})
 }
+
+func TestCreateEndpointsTimeout(t *testing.T) {
+	config := Config{
+		Timeout: 30 * time.Second,
+		Endpoints: []EndpointConfig{
+			{ServiceName: "users", DownstreamPath: "/slow", Timeout: time.Minute},
+			{ServiceName: "users", DownstreamPath: "/fast"},
+		},
+	}
+
+	endpoints := createEndpoints(&config, servicediscovery.Service{Resource: "users"})
+	if endpoints[0].Timeout != time.Minute {
+		t.Errorf("expected timeout %v, but got %v", time.Minute, endpoints[0].Timeout)
+	}
+	if endpoints[1].Timeout != config.Timeout {
+		t.Errorf("expected default timeout %v, but got %v", config.Timeout, endpoints[1].Timeout)
+	}
+
+	endpoints = createEndpoints(&config, servicediscovery.Service{Resource: "partners"})
+	if endpoints[0].Timeout != config.Timeout {
+		t.Errorf("expected default timeout %v, but got %v", config.Timeout, endpoints[0].Timeout)
+	}
+}
+
+func TestServiceRegistry(t *testing.T) {
+	registry := inmemory.NewInMemoryStore()
+	gate := NewGateway(&Config{}, registry, log.ZapLoggerFactory(zap.NewNop()))
+	RegisterHandler(gate)(DefaultHandlerType, func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		return http.NotFoundHandler()
+	})
+
+	routes := map[string]bool{}
+	nextRoute := 0
+	addRoute := func(endpoint abstraction.Endpoint, handler http.Handler) (string, error) {
+		nextRoute++
+		routeId := strconv.Itoa(nextRoute)
+		routes[routeId] = true
+		return routeId, nil
+	}
+	removeRoute := func(routeId string) {
+		delete(routes, routeId)
+	}
+
+	offers := servicediscovery.Service{UID: "1", Resource: "offers", Address: "http://offers"}
+	AddService(gate)(addRoute)(offers)
+	entry, ok := registry.Load("1")
+	if !ok || len(entry.Endpoints) != 1 || !reflect.DeepEqual(entry.Routes, []string{"1"}) {
+		t.Fatalf("expected the service, its endpoint and its route to be registered, but got %+v", entry)
+	}
+
+	//only the instances changed
+	scaled := offers
+	scaled.Addresses = []string{"http://10.0.0.1", "http://10.0.0.2"}
+	UpdateService(gate)(addRoute, removeRoute)(offers, scaled)
+	entry, _ = registry.Load("1")
+	if !reflect.DeepEqual(entry.Service, scaled) || !reflect.DeepEqual(entry.Routes, []string{"1"}) || len(entry.Targets.Load()) != 2 {
+		t.Errorf("expected the service and its targets to be updated and the route kept, but got %+v", entry)
+	}
+
+	moved := scaled
+	moved.Resource = "partners"
+	UpdateService(gate)(addRoute, removeRoute)(scaled, moved)
+	entry, _ = registry.Load("1")
+	if entry.Service.Resource != "partners" || !reflect.DeepEqual(entry.Routes, []string{"2"}) || !reflect.DeepEqual(routes, map[string]bool{"2": true}) {
+		t.Errorf("expected the route to be replaced, but got %+v and the routes %v", entry, routes)
+	}
+
+	RemoveService(gate)(removeRoute)(moved)
+	if _, ok := registry.Load("1"); ok || len(routes) != 0 || len(registry.List()) != 0 {
+		t.Errorf("expected the service and its routes to be removed, but got the routes %v", routes)
+	}
+}
+
+func TestServiceWithoutReadyInstances(t *testing.T) {
+	if targets := serviceAddresses(servicediscovery.Service{Address: "http://offers", Addresses: []string{}}); len(targets) != 0 {
+		t.Errorf("expected no target for a service without ready instances, but got %v", targets)
+	}
+	if targets := serviceAddresses(servicediscovery.Service{Address: "http://offers"}); !reflect.DeepEqual(targets, []string{"http://offers"}) {
+		t.Errorf("expected the service address when the instances are not known, but got %v", targets)
+	}
+}
@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+//ReloadFunc is a type for reloading the configuration using the same signature.
+//useMiddlewares registers the middlewares built with the new filter settings, the current ones are kept if it is nil
+type ReloadFunc func(config *Config, useMiddlewares func(useMiddleware func(key string, mwf middleware.Func))) error
+
+//Reload replaces the configuration and the middlewares of the gateway and recreates the endpoints of all the known services.
+//The routes are swapped in a single transaction. An invalid configuration is rejected and the current one is kept.
+//The port and the name of the gateway cannot be reloaded
+func Reload(gate *Gateway) func(routesTransaction RoutesTransactionFunc) ReloadFunc {
+	return func(routesTransaction RoutesTransactionFunc) ReloadFunc {
+		return func(config *Config, useMiddlewares func(useMiddleware func(key string, mwf middleware.Func))) error {
+			if config == nil {
+				return errors.New("missing configuration")
+			}
+			err := validateConfig(gate, config)
+			if err != nil {
+				return err
+			}
+
+			gate.updateMutex.Lock()
+			defer gate.updateMutex.Unlock()
+
+			middlewares := gate.middlewares
+			if useMiddlewares != nil {
+				middlewares = nil
+				useMiddlewares(func(key string, mwf middleware.Func) {
+					middlewares = append(middlewares, middlewareTuple{key, mwf})
+				})
+			}
+
+			entries := gate.registry.List()
+			services := make([]servicediscovery.Service, 0, len(entries))
+			for _, entry := range entries {
+				services = append(services, entry.Service)
+			}
+
+			//the routes of the new configuration are tried first in a transaction that is never applied,
+			//so that a configuration whose routes conflict is rejected before anything is changed
+			err = routesTransaction(func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error {
+				err := validateRoutes(config, entries, addRouteFunc, removeRouteFunc)
+				if err != nil {
+					return err
+				}
+				return errDryRun
+			})
+			if err != errDryRun {
+				return err
+			}
+
+			err = routesTransaction(func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error {
+				for _, service := range services {
+					removeRoutes(gate, service, removeRouteFunc)
+				}
+
+				gate.mutex.Lock()
+				gate.config = config
+				gate.splits = newTrafficSplits(config.TrafficSplits)
+				gate.middlewares = middlewares
+				gate.mutex.Unlock()
+
+				for _, service := range services {
+					internalAddService(gate, service, addRouteFunc)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			gate.loggerFactory(nil).Info("Gateway: reloaded configuration", zap.Int("services", len(services)))
+			return nil
+		}
+	}
+}
+
+//errDryRun aborts the transaction that validates the routes
+var errDryRun = errors.New("dry run")
+
+//validateRoutes replaces the current routes with the routes of the new configuration and returns the first route rejected.
+//The routes shared by the versions of a traffic split are added once
+func validateRoutes(config *Config, entries []registry.Entry, addRouteFunc AddRouteFunc, removeRouteFunc func(routeId string)) error {
+	removed := map[string]bool{}
+	for _, entry := range entries {
+		for _, rId := range entry.Routes {
+			if rId != "" && !removed[rId] {
+				removeRouteFunc(rId)
+				removed[rId] = true
+			}
+		}
+	}
+
+	splits := newTrafficSplits(config.TrafficSplits)
+	added := map[string]bool{}
+	for _, entry := range entries {
+		for _, endp := range createEndpoints(config, entry.Service) {
+			if _, ok := splits[entry.Service.Resource]; ok {
+				key := entry.Service.Resource + "|" + endpointKey(endp)
+				if added[key] {
+					continue
+				}
+				added[key] = true
+			}
+			if _, err := addRouteFunc(endp, nil); err != nil {
+				return fmt.Errorf("service %s: %w", entry.Service.UID, err)
+			}
+		}
+	}
+	return nil
+}
+
+//validateConfig rejects the configurations whose endpoints cannot be routed
+func validateConfig(gate *Gateway, config *Config) error {
+	if config.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %v", config.Timeout)
+	}
+
+	keys := map[string]bool{}
+	for i, endp := range config.Endpoints {
+		if endp.ServiceName == "" {
+			return fmt.Errorf("endpoint %d: missing service name", i)
+		}
+		if _, ok := gate.handlers[endp.HandlerType]; endp.HandlerType != "" && !ok {
+			return fmt.Errorf("endpoint %d: handler %s is not registered", i, endp.HandlerType)
+		}
+		if endp.Timeout < 0 {
+			return fmt.Errorf("endpoint %d: invalid timeout %v", i, endp.Timeout)
+		}
+		for _, path := range []string{endp.DownstreamPathPrefix, endp.DownstreamPath} {
+			if path != "" && !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("endpoint %d: the downstream path %s must start with /", i, path)
+			}
+		}
+
+		key := endp.ServiceName + "|" + endpointKey(abstraction.Endpoint{
+			DownstreamPathPrefix: endp.DownstreamPathPrefix,
+			DownstreamPath:       endp.DownstreamPath,
+			Methods:              endp.Methods,
+			Hosts:                endp.Hosts,
+			Headers:              endp.Headers,
+			Queries:              endp.Queries,
+		})
+		if keys[key] {
+			return fmt.Errorf("endpoint %d: duplicate route for service %s", i, endp.ServiceName)
+		}
+		keys[key] = true
+	}
+
+	for _, split := range config.TrafficSplits {
+		if split.ServiceName == "" {
+			return errors.New("traffic split: missing service name")
+		}
+		for version, weight := range split.Weights {
+			if weight < 0 {
+				return fmt.Errorf("traffic split %s: invalid weight %d for version %s", split.ServiceName, weight, version)
+			}
+		}
+	}
+
+	return nil
+}
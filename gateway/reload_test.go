@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"github.com/osstotalsoft/bifrost/router"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry/inmemory"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func filterWithHeader(value string) middleware.Func {
+	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Filter", value)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	gate := NewGateway(&Config{Endpoints: []EndpointConfig{{ServiceName: "users", DownstreamPathPrefix: "/users"}}}, inmemory.NewInMemoryStore(), log.ZapLoggerFactory(zap.NewNop()))
+	RegisterHandler(gate)(DefaultHandlerType, func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	})
+	UseMiddleware(gate)("test", filterWithHeader("old"))
+
+	type route struct {
+		endpoint abstraction.Endpoint
+		handler  http.Handler
+	}
+	routes := map[string]route{}
+	lastId := 0
+	addRoute := func(endpoint abstraction.Endpoint, handler http.Handler) (string, error) {
+		lastId++
+		id := strconv.Itoa(lastId)
+		routes[id] = route{endpoint, handler}
+		return id, nil
+	}
+	transactions := 0
+	reload := Reload(gate)(func(f func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error) error {
+		staged := map[string]route{}
+		for id, r := range routes {
+			staged[id] = r
+		}
+		err := f(func(endpoint abstraction.Endpoint, handler http.Handler) (string, error) {
+			lastId++
+			id := strconv.Itoa(lastId)
+			staged[id] = route{endpoint, handler}
+			return id, nil
+		}, func(routeId string) {
+			delete(staged, routeId)
+		})
+		if err != nil {
+			return err
+		}
+		transactions++
+		routes = staged
+		return nil
+	})
+
+	AddService(gate)(addRoute)(servicediscovery.Service{UID: "1", Resource: "users", Address: "http://users"})
+	AddService(gate)(addRoute)(servicediscovery.Service{UID: "2", Resource: "partners", Address: "http://partners"})
+
+	err := reload(&Config{Endpoints: []EndpointConfig{{ServiceName: "users", DownstreamPathPrefix: "/people"}}},
+		func(useMiddleware func(key string, mwf middleware.Func)) {
+			useMiddleware("test", filterWithHeader("new"))
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transactions != 1 || len(routes) != 2 {
+		t.Fatalf("expected the routes of the 2 services to be swapped in 1 transaction, but got %v routes in %v transactions", len(routes), transactions)
+	}
+	for _, r := range routes {
+		if r.endpoint.ServiceName == "users" && r.endpoint.DownstreamPathPrefix != "/people" {
+			t.Errorf("expected the reloaded path prefix, but got %v", r.endpoint.DownstreamPathPrefix)
+		}
+		w := httptest.NewRecorder()
+		r.handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Header().Get("X-Filter") != "new" {
+			t.Errorf("expected the middlewares to be rebuilt, but got %v", w.Header().Get("X-Filter"))
+		}
+	}
+
+	invalid := []Config{
+		{Endpoints: []EndpointConfig{{ServiceName: "users", HandlerType: "soap"}}},
+		{Endpoints: []EndpointConfig{{DownstreamPathPrefix: "/users"}}},
+		{Endpoints: []EndpointConfig{{ServiceName: "users", DownstreamPathPrefix: "users"}}},
+		{Endpoints: []EndpointConfig{{ServiceName: "users", DownstreamPath: "/a"}, {ServiceName: "users", DownstreamPath: "/a"}}},
+		{TrafficSplits: []TrafficSplitConfig{{ServiceName: "users", Weights: map[string]int{"v1": -1}}}},
+	}
+	for i := range invalid {
+		if err := reload(&invalid[i], nil); err == nil {
+			t.Errorf("expected the configuration %v to be rejected", i)
+		}
+	}
+	if transactions != 1 || gate.config.Endpoints[0].DownstreamPathPrefix != "/people" {
+		t.Error("expected the current configuration to be kept")
+	}
+}
+
+func TestReloadRejectsRouteConflicts(t *testing.T) {
+	gate := NewGateway(&Config{}, inmemory.NewInMemoryStore(), log.ZapLoggerFactory(zap.NewNop()))
+	RegisterHandler(gate)(DefaultHandlerType, func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	})
+	dynRouter := router.NewDynamicRouter(router.GorillaMuxRouteMatcher, log.ZapLoggerFactory(zap.NewNop()))
+	reload := Reload(gate)(router.Transaction(dynRouter))
+
+	AddService(gate)(router.AddRoute(dynRouter))(servicediscovery.Service{UID: "1", Resource: "users", Address: "http://users"})
+	AddService(gate)(router.AddRoute(dynRouter))(servicediscovery.Service{UID: "2", Resource: "partners", Address: "http://partners"})
+
+	//both services claim the same route
+	err := reload(&Config{Endpoints: []EndpointConfig{
+		{ServiceName: "users", DownstreamPathPrefix: "/x"},
+		{ServiceName: "partners", DownstreamPathPrefix: "/x"},
+	}}, nil)
+	if err == nil {
+		t.Fatal("expected the configuration to be rejected")
+	}
+
+	if routes := router.Routes(dynRouter)(); len(routes) != 2 {
+		t.Errorf("expected the 2 routes to be kept, but got %v", len(routes))
+	}
+	for _, uid := range []string{"1", "2"} {
+		entry, _ := gate.registry.Load(uid)
+		if len(entry.Routes) != 1 || entry.Routes[0] == "" {
+			t.Errorf("expected the route of service %v to be kept, but got %v", uid, entry.Routes)
+		}
+	}
+	if len(gate.config.Endpoints) != 0 {
+		t.Error("expected the current configuration to be kept")
+	}
+}
@@ -0,0 +1,235 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+//trafficSplit shares the routes of a service resource between the versions of the service
+type trafficSplit struct {
+	config  TrafficSplitConfig
+	weights map[string]int
+	routes  map[string]*splitRoute
+}
+
+//splitRoute is the handler of a route shared by several service versions
+type splitRoute struct {
+	routeId      string
+	stickyCookie string
+	stickyHeader string
+	backends     atomic.Pointer[[]splitBackend]
+}
+
+//splitBackend is the endpoint handler of a service version together with its weight
+type splitBackend struct {
+	serviceUID string
+	version    string
+	weight     int
+	handler    http.Handler
+}
+
+func newTrafficSplits(configs []TrafficSplitConfig) map[string]*trafficSplit {
+	splits := map[string]*trafficSplit{}
+	for _, cfg := range configs {
+		weights := map[string]int{}
+		for version, weight := range cfg.Weights {
+			weights[version] = weight
+		}
+		splits[cfg.ServiceName] = &trafficSplit{config: cfg, weights: weights, routes: map[string]*splitRoute{}}
+	}
+	return splits
+}
+
+//SetTrafficWeights changes at runtime the weights of the versions of a service resource.
+//Versions missing from weights stop receiving traffic
+func SetTrafficWeights(gate *Gateway) func(resource string, weights map[string]int) error {
+	return func(resource string, weights map[string]int) error {
+		gate.mutex.Lock()
+		defer gate.mutex.Unlock()
+
+		split, ok := gate.splits[resource]
+		if !ok {
+			return errors.New("no traffic split configured for " + resource)
+		}
+		for version, weight := range weights {
+			if weight < 0 {
+				return fmt.Errorf("invalid weight %d for version %s", weight, version)
+			}
+		}
+
+		split.weights = map[string]int{}
+		for version, weight := range weights {
+			split.weights[version] = weight
+		}
+		for _, route := range split.routes {
+			route.setWeights(split.weights)
+		}
+
+		gate.loggerFactory(nil).Info("Gateway: traffic weights changed", zap.String("resource", resource), zap.Any("weights", weights))
+		return nil
+	}
+}
+
+//addSplitService adds the endpoints of a service version as backends of the shared routes of its resource,
+//it returns the ids of the routes of the endpoints
+func addSplitService(gate *Gateway, split *trafficSplit, service servicediscovery.Service, endpoints []abstraction.Endpoint, addRouteFunc AddRouteFunc) []string {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	var routes []string
+	for _, endp := range endpoints {
+		key := endpointKey(endp)
+		backend := splitBackend{
+			serviceUID: service.UID,
+			version:    service.Version,
+			weight:     split.weights[service.Version],
+			handler:    getEndpointHandler(gate, endp),
+		}
+
+		route, ok := split.routes[key]
+		if ok {
+			route.add(backend)
+			routes = append(routes, route.routeId)
+			continue
+		}
+
+		route = &splitRoute{stickyCookie: split.config.StickyCookie, stickyHeader: split.config.StickyHeader}
+		route.add(backend)
+		routeId, err := addRouteFunc(endp, route)
+		if err != nil {
+			gate.loggerFactory(nil).Error("Gateway: cannot add the traffic split route", zap.Error(err),
+				zap.String("uid", service.UID), zap.String("version", service.Version), zap.Any("endpoint", endp))
+			routes = append(routes, "")
+			continue
+		}
+		route.routeId = routeId
+		split.routes[key] = route
+		routes = append(routes, routeId)
+	}
+
+	gate.loggerFactory(nil).Info("Gateway: added service version to traffic split",
+		zap.String("resource", service.Resource), zap.String("version", service.Version), zap.String("uid", service.UID))
+	return routes
+}
+
+//removeSplitService removes a service version from the shared routes of its resource and
+//removes the routes that have no backend left
+func removeSplitService(gate *Gateway, split *trafficSplit, service servicediscovery.Service, removeRouteFunc func(routeId string)) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	for key, route := range split.routes {
+		if route.remove(service.UID) == 0 {
+			removeRouteFunc(route.routeId)
+			delete(split.routes, key)
+		}
+	}
+}
+
+func (route *splitRoute) add(backend splitBackend) {
+	var backends []splitBackend
+	if current := route.backends.Load(); current != nil {
+		backends = append(backends, *current...)
+	}
+	backends = append(backends, backend)
+	route.backends.Store(&backends)
+}
+
+func (route *splitRoute) remove(serviceUID string) int {
+	var backends []splitBackend
+	for _, b := range *route.backends.Load() {
+		if b.serviceUID != serviceUID {
+			backends = append(backends, b)
+		}
+	}
+	route.backends.Store(&backends)
+	return len(backends)
+}
+
+func (route *splitRoute) setWeights(weights map[string]int) {
+	backends := append([]splitBackend(nil), *route.backends.Load()...)
+	for i := range backends {
+		backends[i].weight = weights[backends[i].version]
+	}
+	route.backends.Store(&backends)
+}
+
+//ServeHTTP forwards the request to the version assigned by the sticky cookie, by the sticky header or by weight
+func (route *splitRoute) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	backends := *route.backends.Load()
+	if len(backends) == 0 {
+		http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if route.stickyCookie != "" {
+		if cookie, err := request.Cookie(route.stickyCookie); err == nil {
+			for _, b := range backends {
+				if b.version == cookie.Value && b.weight > 0 {
+					b.handler.ServeHTTP(writer, request)
+					return
+				}
+			}
+		}
+	}
+
+	var backend splitBackend
+	if value := request.Header.Get(route.stickyHeader); route.stickyHeader != "" && value != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(value))
+		backend = pickBackend(backends, int(h.Sum32()&0x7fffffff))
+	} else {
+		backend = pickBackend(backends, rand.Int())
+	}
+
+	if route.stickyCookie != "" {
+		http.SetCookie(writer, &http.Cookie{Name: route.stickyCookie, Value: backend.version, Path: "/", HttpOnly: true})
+	}
+	backend.handler.ServeHTTP(writer, request)
+}
+
+//pickBackend maps n onto the weighted backends. When all weights are zero the backends share the traffic evenly
+func pickBackend(backends []splitBackend, n int) splitBackend {
+	total := 0
+	for _, b := range backends {
+		total += b.weight
+	}
+	if total == 0 {
+		return backends[n%len(backends)]
+	}
+
+	n = n % total
+	for _, b := range backends {
+		if n < b.weight {
+			return b
+		}
+		n -= b.weight
+	}
+	return backends[len(backends)-1]
+}
+
+//endpointKey identifies the route of an endpoint, the same for all the versions of a service
+func endpointKey(endp abstraction.Endpoint) string {
+	methods := append([]string(nil), endp.Methods...)
+	sort.Strings(methods)
+	hosts := append([]string(nil), endp.Hosts...)
+	sort.Strings(hosts)
+
+	return strings.Join([]string{
+		endp.DownstreamPathPrefix,
+		endp.DownstreamPath,
+		strings.Join(methods, ","),
+		strings.Join(hosts, ","),
+		fmt.Sprint(endp.Headers),
+		fmt.Sprint(endp.Queries),
+	}, "|")
+}
@@ -0,0 +1,115 @@
+package gateway
+
+import (
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry/inmemory"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+var (
+	splitConfig = Config{
+		TrafficSplits: []TrafficSplitConfig{
+			{
+				ServiceName:  "offers",
+				Weights:      map[string]int{"v1": 100, "v2": 0},
+				StickyCookie: "offers-version",
+				StickyHeader: "X-User",
+			},
+		},
+	}
+
+	offersV1 = servicediscovery.Service{UID: "1", Resource: "offers", Version: "v1", Address: "http://offers-v1"}
+	offersV2 = servicediscovery.Service{UID: "2", Resource: "offers", Version: "v2", Address: "http://offers-v2"}
+)
+
+func TestTrafficSplit(t *testing.T) {
+	gate := NewGateway(&splitConfig, inmemory.NewInMemoryStore(), log.ZapLoggerFactory(zap.NewNop()))
+	RegisterHandler(gate)(DefaultHandlerType, func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, endpoint.UpstreamURL)
+		})
+	})
+
+	routes := map[string]http.Handler{}
+	addRoute := func(endpoint abstraction.Endpoint, handler http.Handler) (string, error) {
+		id := strconv.Itoa(len(routes) + 1)
+		routes[id] = handler
+		return id, nil
+	}
+	removeRoute := func(routeId string) {
+		delete(routes, routeId)
+	}
+
+	AddService(gate)(addRoute)(offersV1)
+	AddService(gate)(addRoute)(offersV2)
+	if len(routes) != 1 {
+		t.Fatalf("expected the versions to share 1 route, but got %v", len(routes))
+	}
+	route := routes["1"]
+
+	serve := func(cookie string, user string) (string, *http.Response) {
+		req := httptest.NewRequest("GET", "/offers", nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "offers-version", Value: cookie})
+		}
+		if user != "" {
+			req.Header.Set("X-User", user)
+		}
+		w := httptest.NewRecorder()
+		route.ServeHTTP(w, req)
+		return w.Body.String(), w.Result()
+	}
+
+	for i := 0; i < 20; i++ {
+		if body, _ := serve("", ""); body != "http://offers-v1" {
+			t.Fatalf("expected all traffic on v1, but got %v", body)
+		}
+	}
+	if _, resp := serve("", ""); len(resp.Cookies()) != 1 || resp.Cookies()[0].Value != "v1" {
+		t.Errorf("expected a sticky cookie for v1, but got %v", resp.Cookies())
+	}
+
+	if err := SetTrafficWeights(gate)("offers", map[string]int{"v1": 0, "v2": 100}); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := serve("v1", ""); body != "http://offers-v2" {
+		t.Errorf("expected a version without weight to ignore the sticky cookie, but got %v", body)
+	}
+
+	_ = SetTrafficWeights(gate)("offers", map[string]int{"v1": 50, "v2": 50})
+	for i := 0; i < 20; i++ {
+		if body, _ := serve("v1", ""); body != "http://offers-v1" {
+			t.Fatalf("expected the sticky cookie to keep v1, but got %v", body)
+		}
+	}
+	first, _ := serve("", "user-42")
+	for i := 0; i < 20; i++ {
+		if body, _ := serve("", "user-42"); body != first {
+			t.Fatalf("expected the sticky header to keep %v, but got %v", first, body)
+		}
+	}
+
+	if err := SetTrafficWeights(gate)("partners", map[string]int{"v1": 100}); err == nil {
+		t.Error("expected an error for a service without traffic split")
+	}
+
+	RemoveService(gate)(removeRoute)(offersV1)
+	if len(routes) != 1 {
+		t.Fatalf("expected the route to be kept for v2, but got %v routes", len(routes))
+	}
+	if body, _ := serve("v1", ""); body != "http://offers-v2" {
+		t.Errorf("expected all traffic on v2, but got %v", body)
+	}
+
+	RemoveService(gate)(removeRoute)(offersV2)
+	if len(routes) != 0 {
+		t.Errorf("expected the route to be removed with the last version, but got %v routes", len(routes))
+	}
+}
@@ -2,16 +2,19 @@ package nats
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/mitchellh/mapstructure"
 	"github.com/nats-io/stan.go"
 	"github.com/osstotalsoft/bifrost/abstraction"
 	"github.com/osstotalsoft/bifrost/handler"
+	"github.com/osstotalsoft/bifrost/httputils"
 	"github.com/osstotalsoft/bifrost/log"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"net/http"
+	"time"
 )
 
 //Config is the global NATS configuration
@@ -25,6 +28,7 @@ type Config struct {
 	Source               string `mapstructure:"source"`
 	transformMessageFunc TransformMessageFunc
 	buildResponseFunc    BuildResponseFunc
+	publishObserverFunc  PublishObserverFunc
 	logger               log.Logger
 }
 
@@ -33,6 +37,9 @@ type EndpointConfig struct {
 	Topic string `mapstructure:"topic"`
 }
 
+//PublishObserverFunc is called after each publishing, with its duration and error
+type PublishObserverFunc func(requestContext context.Context, topic string, duration time.Duration, err error)
+
 //CloseConnectionFunc is to be called to close the NATS connection
 type CloseConnectionFunc func() error
 
@@ -50,6 +57,8 @@ type messageContext struct {
 	Topic      string
 	RawPayload []byte
 	Headers    map[string]interface{}
+	//TraceHeaders is the trace context of the publishing, to be added to the message headers
+	TraceHeaders map[string]string
 }
 
 //NewNatsPublisher creates an instance of the NATS publisher handler.
@@ -59,6 +68,7 @@ func NewNatsPublisher(config Config, options ...Option) (handler.Func, CloseConn
 
 	config.transformMessageFunc = NoTransformation
 	config.buildResponseFunc = EmptyResponse
+	config.publishObserverFunc = NoObserver
 	config.logger = log.NewNop()
 
 	config = applyOptions(config, options)
@@ -85,13 +95,25 @@ func NewNatsPublisher(config Config, options ...Option) (handler.Func, CloseConn
 				return
 			}
 
-			messageBytes, err = config.transformMessageFunc(messageContext, request.Context(), messageBytes)
+			ctx, span := startPublishSpan(request.Context(), messageContext.Topic)
+			messageContext.TraceHeaders = traceHeaders(ctx)
+
+			messageBytes, err = config.transformMessageFunc(messageContext, ctx, messageBytes)
 			if err != nil {
+				endPublishSpan(span, messageContext, err)
 				internalServerError(messageContext.Logger, err, "cannot transform", writer)
 				return
 			}
 
-			if err := natsConnection.Publish(messageContext.Topic, messageBytes); err != nil {
+			start := time.Now()
+			err = publish(ctx, natsConnection, messageContext.Topic, messageBytes)
+			endPublishSpan(span, messageContext, err)
+			config.publishObserverFunc(request.Context(), messageContext.Topic, time.Since(start), err)
+			if err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					gatewayTimeout(messageContext.Logger, err, "publish timed out", writer)
+					return
+				}
 				internalServerError(messageContext.Logger, err, "cannot publish", writer)
 				return
 			}
@@ -115,6 +137,29 @@ func NewNatsPublisher(config Config, options ...Option) (handler.Func, CloseConn
 	return handlerFunc, closeConnectionFunc, nil
 }
 
+//publish sends the message and waits for the acknowledgement, unless the request context ends first
+func publish(ctx context.Context, natsConnection stan.Conn, topic string, messageBytes []byte) error {
+	ack := make(chan error, 1)
+	_, err := natsConnection.PublishAsync(topic, messageBytes, func(_ string, err error) {
+		ack <- err
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ack:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func gatewayTimeout(logger log.Logger, err error, msg string, writer http.ResponseWriter) {
+	logger.Error(msg, zap.Error(err))
+	httputils.GatewayTimeout(writer)
+}
+
 func internalServerError(logger log.Logger, err error, msg string, writer http.ResponseWriter) {
 	logger.Error(msg, zap.Error(err))
 	http.Error(writer, err.Error(), http.StatusInternalServerError)
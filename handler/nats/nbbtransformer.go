@@ -53,18 +53,24 @@ func NBBTransformMessage(messageContext messageContext, requestContext context.C
 		return nil, errors.New(CharismaIdClaimKey + " claim not found")
 	}
 
-	correlationId := uuid.Must(uuid.NewV4())
+	correlationId := getCorrelationId(requestContext)
 	commandId := uuid.Must(uuid.NewV4())
+
+	messageId := uuid.Must(uuid.NewV4())
 	now := time.Now()
 
 	headers := map[string]interface{}{
 		UserIdKey:         userId,
 		CharismaUserIdKey: charismaUserId,
 		CorrelationIdKey:  correlationId,
-		MessageIdKey:      uuid.Must(uuid.NewV4()),
+		MessageIdKey:      messageId,
 		SourceKey:         messageContext.Source,
 		PublishTimeKey:    now,
 	}
+	//the trace context, so that the consumers continue the trace
+	for key, value := range messageContext.TraceHeaders {
+		headers[key] = value
+	}
 	payloadChanges := map[string]interface{}{
 		CommandIdKey: commandId,
 		MetadataKey:  map[string]interface{}{CreationDateKey: now},
@@ -72,6 +78,7 @@ func NBBTransformMessage(messageContext messageContext, requestContext context.C
 
 	messageContext.Headers[CorrelationIdKey] = correlationId
 	messageContext.Headers[CommandIdKey] = commandId
+	messageContext.Headers[MessageIdKey] = messageId
 
 	return envelopeMessage(payloadBytes, headers, payloadChanges), nil
 }
@@ -104,6 +111,16 @@ func getClaims(context context.Context) (map[string]interface{}, error) {
 	return claims, nil
 }
 
+//getCorrelationId returns the correlation id of the request, or a new one if it is missing or is not a UUID
+func getCorrelationId(context context.Context) uuid.UUID {
+	if id, ok := context.Value(abstraction.ContextCorrelationIdKey).(string); ok {
+		if correlationId, err := uuid.FromString(id); err == nil {
+			return correlationId
+		}
+	}
+	return uuid.Must(uuid.NewV4())
+}
+
 //envelopeMessage envelopes a message payload with the headers specified and applies changes/additions to the payload
 func envelopeMessage(payloadBytes []byte, headers, payloadChanges map[string]interface{}) []byte {
 
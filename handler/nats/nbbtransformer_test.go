@@ -100,3 +100,51 @@ func TestBuildResponse(t *testing.T) {
 		t.Fatal("Response does not match expected value")
 	}
 }
+
+func TestTransformMessageTraceHeaders(t *testing.T) {
+	var messageContext = messageContext{
+		Headers:      map[string]interface{}{},
+		TraceHeaders: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}
+	var claimsMap = map[string]interface{}{
+		UserIdClaimKey:     "user1",
+		CharismaIdClaimKey: 999,
+	}
+	var requestContext = context.WithValue(context.Background(), abstraction.ContextClaimsKey, claimsMap)
+	var response Message
+
+	responseBytes, _ := NBBTransformMessage(messageContext, requestContext, []byte("{}"))
+	if err := json.Unmarshal(responseBytes, &response); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if response.Headers["traceparent"] != messageContext.TraceHeaders["traceparent"] {
+		t.Errorf("expected the trace context in the message headers, but got %v", response.Headers["traceparent"])
+	}
+	if messageContext.Headers[MessageIdKey] != uuid.FromStringOrNil(response.Headers[MessageIdKey].(string)) {
+		t.Error(MessageIdKey + " not present in the message context")
+	}
+}
+
+func TestTransformMessageCorrelationId(t *testing.T) {
+	correlationId := uuid.Must(uuid.NewV4())
+	var claimsMap = map[string]interface{}{
+		UserIdClaimKey:     "user1",
+		CharismaIdClaimKey: 999,
+	}
+	var requestContext = context.WithValue(context.Background(), abstraction.ContextClaimsKey, claimsMap)
+	requestContext = context.WithValue(requestContext, abstraction.ContextCorrelationIdKey, correlationId.String())
+
+	var reused = messageContext{Headers: map[string]interface{}{}}
+	_, _ = NBBTransformMessage(reused, requestContext, []byte("{}"))
+	if reused.Headers[CorrelationIdKey] != correlationId {
+		t.Errorf("expected the correlation id of the request to be reused, but got %v", reused.Headers[CorrelationIdKey])
+	}
+
+	var created = messageContext{Headers: map[string]interface{}{}}
+	requestContext = context.WithValue(requestContext, abstraction.ContextCorrelationIdKey, "not-a-uuid")
+	_, _ = NBBTransformMessage(created, requestContext, []byte("{}"))
+	if id, ok := created.Headers[CorrelationIdKey].(uuid.UUID); !ok || id == correlationId {
+		t.Errorf("expected a new correlation id, but got %v", created.Headers[CorrelationIdKey])
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/osstotalsoft/bifrost/log"
 	"go.uber.org/zap"
+	"time"
 )
 
 type Option func(Config) Config
@@ -18,6 +19,10 @@ func EmptyResponse(messageContext messageContext, requestContext context.Context
 	return nil, nil
 }
 
+//NoObserver is a no op function
+func NoObserver(requestContext context.Context, topic string, duration time.Duration, err error) {
+}
+
 //TransformMessage adds a TransformMessageFunc to config
 func TransformMessage(f TransformMessageFunc) Option {
 	return func(config Config) Config {
@@ -34,6 +39,14 @@ func BuildResponse(f BuildResponseFunc) Option {
 	}
 }
 
+//PublishObserver adds a PublishObserverFunc to config
+func PublishObserver(f PublishObserverFunc) Option {
+	return func(config Config) Config {
+		config.publishObserverFunc = f
+		return config
+	}
+}
+
 //Logger adds a logger to config
 func Logger(logger log.Logger) Option {
 	return func(config Config) Config {
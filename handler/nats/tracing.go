@@ -0,0 +1,43 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/osstotalsoft/bifrost/handler/nats"
+
+//startPublishSpan starts the producer span of a message. It is started before the message is transformed,
+//so that the consumers continue the trace from it
+func startPublishSpan(ctx context.Context, topic string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "publish "+topic,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nats"),
+			attribute.String("messaging.destination.name", topic),
+		))
+}
+
+//endPublishSpan tags the producer span with the message id and the error, if any, and then ends it
+func endPublishSpan(span trace.Span, messageContext messageContext, err error) {
+	if messageId, ok := messageContext.Headers[MessageIdKey]; ok {
+		span.SetAttributes(attribute.String("messaging.message.id", fmt.Sprint(messageId)))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+//traceHeaders returns the W3C trace context of the current span, ex: traceparent and baggage
+func traceHeaders(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
@@ -0,0 +1,49 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestPublishSpan(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer provider.Shutdown(context.Background())
+
+	ctx, span := startPublishSpan(context.Background(), "ch.commands.CreateOffer")
+	headers := traceHeaders(ctx)
+	messageContext := messageContext{Headers: map[string]interface{}{MessageIdKey: "42"}}
+	endPublishSpan(span, messageContext, errors.New("nats: timeout"))
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected the producer span, but got %v", spans)
+	}
+	published := spans[0]
+	if published.Name != "publish ch.commands.CreateOffer" || published.SpanKind != trace.SpanKindProducer || published.Status.Code != codes.Error {
+		t.Errorf("expected an errored producer span, but got %v %v %v", published.Name, published.SpanKind, published.Status)
+	}
+
+	attributes := map[attribute.Key]string{}
+	for _, a := range published.Attributes {
+		attributes[a.Key] = a.Value.Emit()
+	}
+	if attributes["messaging.destination.name"] != "ch.commands.CreateOffer" || attributes["messaging.message.id"] != "42" {
+		t.Errorf("expected the span to be tagged with the topic and the message id, but got %v", attributes)
+	}
+
+	expected := "00-" + published.SpanContext.TraceID().String() + "-" + published.SpanContext.SpanID().String() + "-01"
+	if headers["traceparent"] != expected {
+		t.Errorf("expected the traceparent %v, but got %v", expected, headers["traceparent"])
+	}
+}
@@ -0,0 +1,138 @@
+package reverseproxy
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	//RoundRobinStrategy sends the requests to each target in turn
+	RoundRobinStrategy = "round_robin"
+	//LeastConnectionsStrategy sends the request to the target with the fewest requests in flight
+	LeastConnectionsStrategy = "least_connections"
+	//RandomTwoChoicesStrategy picks two random targets and sends the request to the one with fewer requests in flight
+	RandomTwoChoicesStrategy = "random_two_choices"
+	//ConsistentHashStrategy sends the requests having the same value of a header to the same target
+	ConsistentHashStrategy = "consistent_hash"
+)
+
+//LoadBalancerConfig is the load balancing configuration of an endpoint
+type LoadBalancerConfig struct {
+	Strategy   string `mapstructure:"strategy"`
+	HashHeader string `mapstructure:"hash_header"`
+}
+
+//Balancer chooses the upstream target of a request
+type Balancer interface {
+	//Next returns one of the targets and a func to be called when the request to that target is done
+	Next(request *http.Request, targets []string) (target string, done func())
+}
+
+//NewBalancer creates the Balancer for a strategy; it returns false if the strategy is unknown
+func NewBalancer(config LoadBalancerConfig) (Balancer, bool) {
+	switch config.Strategy {
+	case RoundRobinStrategy, "":
+		return new(roundRobinBalancer), true
+	case LeastConnectionsStrategy:
+		return &leastConnectionsBalancer{new(connectionCounter)}, true
+	case RandomTwoChoicesStrategy:
+		return &randomTwoChoicesBalancer{new(connectionCounter)}, true
+	case ConsistentHashStrategy:
+		return &consistentHashBalancer{header: config.HashHeader}, true
+	}
+	return new(roundRobinBalancer), false
+}
+
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Next(request *http.Request, targets []string) (string, func()) {
+	n := b.next.Add(1) - 1
+	return targets[n%uint64(len(targets))], noop
+}
+
+type leastConnectionsBalancer struct {
+	connections *connectionCounter
+}
+
+func (b *leastConnectionsBalancer) Next(request *http.Request, targets []string) (string, func()) {
+	//start from a random target so that ties do not always favour the first one
+	offset := rand.IntN(len(targets))
+	best := targets[offset]
+	for i := 1; i < len(targets); i++ {
+		t := targets[(offset+i)%len(targets)]
+		if b.connections.get(t) < b.connections.get(best) {
+			best = t
+		}
+	}
+	return best, b.connections.acquire(best)
+}
+
+type randomTwoChoicesBalancer struct {
+	connections *connectionCounter
+}
+
+func (b *randomTwoChoicesBalancer) Next(request *http.Request, targets []string) (string, func()) {
+	first := targets[rand.IntN(len(targets))]
+	if len(targets) > 1 {
+		second := targets[rand.IntN(len(targets))]
+		if b.connections.get(second) < b.connections.get(first) {
+			first = second
+		}
+	}
+	return first, b.connections.acquire(first)
+}
+
+//consistentHashBalancer uses rendezvous hashing: a key goes to the target with the highest hash of key and target,
+//so only the keys of a removed target move when the set of targets changes.
+//Requests without the header are balanced round robin
+type consistentHashBalancer struct {
+	header   string
+	fallback roundRobinBalancer
+}
+
+func (b *consistentHashBalancer) Next(request *http.Request, targets []string) (string, func()) {
+	key := request.Header.Get(b.header)
+	if key == "" {
+		return b.fallback.Next(request, targets)
+	}
+
+	var best string
+	var bestScore uint64
+	for _, t := range targets {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte(t))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+	return best, noop
+}
+
+//connectionCounter counts the requests in flight for each target
+type connectionCounter struct {
+	counters sync.Map
+}
+
+func (c *connectionCounter) get(target string) int64 {
+	if v, ok := c.counters.Load(target); ok {
+		return v.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+func (c *connectionCounter) acquire(target string) func() {
+	v, _ := c.counters.LoadOrStore(target, new(atomic.Int64))
+	counter := v.(*atomic.Int64)
+	counter.Add(1)
+	return func() {
+		counter.Add(-1)
+	}
+}
+
+func noop() {}
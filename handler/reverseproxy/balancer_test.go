@@ -0,0 +1,148 @@
+package reverseproxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/router"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testTargets = []string{"http://10.0.0.1:80", "http://10.0.0.2:80", "http://10.0.0.3:80"}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(LoadBalancerConfig{Strategy: RoundRobinStrategy})
+	req := httptest.NewRequest("GET", "/", nil)
+
+	for i := 0; i < 2*len(testTargets); i++ {
+		target, done := balancer.Next(req, testTargets)
+		done()
+		if target != testTargets[i%len(testTargets)] {
+			t.Fatalf("expected target %v, but got %v", testTargets[i%len(testTargets)], target)
+		}
+	}
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(LoadBalancerConfig{Strategy: LeastConnectionsStrategy})
+	req := httptest.NewRequest("GET", "/", nil)
+
+	//keep a request in flight on every target but the last one
+	busy := map[string]bool{}
+	for len(busy) < len(testTargets)-1 {
+		target, done := balancer.Next(req, testTargets)
+		if busy[target] {
+			done()
+			continue
+		}
+		busy[target] = true
+	}
+
+	for i := 0; i < 10; i++ {
+		target, done := balancer.Next(req, testTargets)
+		done()
+		if busy[target] {
+			t.Fatalf("expected the idle target, but got %v", target)
+		}
+	}
+}
+
+func TestRandomTwoChoicesBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(LoadBalancerConfig{Strategy: RandomTwoChoicesStrategy})
+	req := httptest.NewRequest("GET", "/", nil)
+	targets := testTargets[:2]
+
+	busy, _ := balancer.Next(req, targets)
+	for i := 0; i < 20; i++ {
+		target, done := balancer.Next(req, targets)
+		done()
+		if target == busy {
+			//both choices can be the busy target
+			continue
+		}
+		return
+	}
+	t.Fatal("expected the idle target to be chosen")
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(LoadBalancerConfig{Strategy: ConsistentHashStrategy, HashHeader: "X-User"})
+
+	assigned := map[string]string{}
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", fmt.Sprint("user", i))
+		target, _ := balancer.Next(req, testTargets)
+		again, _ := balancer.Next(req, testTargets)
+		if target != again {
+			t.Fatalf("expected the same target for the same key, but got %v and %v", target, again)
+		}
+		assigned[req.Header.Get("X-User")] = target
+	}
+
+	//removing a target only moves the keys it was serving
+	for key, target := range assigned {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", key)
+		newTarget, _ := balancer.Next(req, testTargets[:2])
+		if target != testTargets[2] && newTarget != target {
+			t.Fatalf("expected key %v to stay on %v, but got %v", key, target, newTarget)
+		}
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	if _, ok := NewBalancer(LoadBalancerConfig{Strategy: "fastest"}); ok {
+		t.Error("expected an unknown strategy to be reported")
+	}
+}
+
+func TestReverseProxyBalancesTargets(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprint("backend", i)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+		defer backend.Close()
+		addresses = append(addresses, backend.URL)
+	}
+
+	endpoint := abstraction.Endpoint{
+		UpstreamURL:     "http://service.namespace",
+		UpstreamTargets: abstraction.NewUpstreamTargets(addresses),
+	}
+	proxy := NewReverseProxy(http.DefaultTransport, nil, nil)(endpoint, log.ZapLoggerFactory(zap.NewNop()))
+
+	serve := func() (int, string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), router.ContextRouteKey, router.RouteContext{PathPrefix: "/"}))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	if _, first := serve(); first != "backend0" {
+		t.Errorf("expected backend0, but got %v", first)
+	}
+	if _, second := serve(); second != "backend1" {
+		t.Errorf("expected backend1, but got %v", second)
+	}
+
+	endpoint.UpstreamTargets.Store(addresses[1:])
+	for i := 0; i < 3; i++ {
+		if _, body := serve(); body != "backend1" {
+			t.Errorf("expected the updated targets to be used, but got %v", body)
+		}
+	}
+
+	endpoint.UpstreamTargets.Store(nil)
+	if code, _ := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %v, but got %v", http.StatusServiceUnavailable, code)
+	}
+}
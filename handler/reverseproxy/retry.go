@@ -0,0 +1,231 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"go.uber.org/zap"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//retryPolicyKey is the key used to pass the retry policy of the endpoint to the RoundTripper
+const retryPolicyKey = "RetryPolicyKey"
+
+const (
+	//ConnectFailureError is a failure to connect to the upstream
+	ConnectFailureError = "connect_failure"
+	//ResetError is a connection closed by the upstream before the response was received
+	ResetError = "reset"
+	//TimeoutError is an attempt that did not complete in the per-try timeout
+	TimeoutError = "timeout"
+)
+
+//RetryPolicy is the retry configuration of an endpoint
+type RetryPolicy struct {
+	//MaxAttempts is the number of attempts including the first one, the requests are not retried if less than 2
+	MaxAttempts   int           `mapstructure:"max_attempts"`
+	PerTryTimeout time.Duration `mapstructure:"per_try_timeout"`
+	//Backoff is the base delay, doubled after each attempt and randomized with full jitter
+	Backoff       time.Duration `mapstructure:"backoff"`
+	MaxBackoff    time.Duration `mapstructure:"max_backoff"`
+	RetryOnStatus []int         `mapstructure:"retry_on_status"`
+	RetryOnErrors []string      `mapstructure:"retry_on_errors"`
+	//Methods overrides the methods that can be retried, the idempotent ones by default
+	Methods []string `mapstructure:"methods"`
+	//MaxBodySize is the size up to which a request body is buffered to be sent again
+	MaxBodySize int64 `mapstructure:"max_body_size"`
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Backoff:       25 * time.Millisecond,
+	MaxBackoff:    250 * time.Millisecond,
+	RetryOnStatus: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	RetryOnErrors: []string{ConnectFailureError, ResetError, TimeoutError},
+	Methods:       []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete},
+	MaxBodySize:   64 * 1024,
+}
+
+type retryRoundTripper struct {
+	http.RoundTripper
+	loggerFactory log.Factory
+}
+
+//NewRetryRoundTripper creates a RoundTripper that retries the failed requests
+//according to the retry policy of their endpoint
+func NewRetryRoundTripper(transport http.RoundTripper, loggerFactory log.Factory) http.RoundTripper {
+	return &retryRoundTripper{RoundTripper: transport, loggerFactory: loggerFactory}
+}
+
+//withRetryPolicy passes the retry policy of the endpoint to the RoundTripper
+func withRetryPolicy(policy *RetryPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), retryPolicyKey, policy)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func decodeRetryPolicy(input map[string]interface{}) (*RetryPolicy, error) {
+	policy := defaultRetryPolicy
+	err := middleware.DecodeEndpointOptions(input, &policy)
+	return &policy, err
+}
+
+//RoundTrip sends the request and sends it again while the attempt fails and the policy allows it
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy, ok := req.Context().Value(retryPolicyKey).(*RetryPolicy)
+	if !ok {
+		return rt.RoundTripper.RoundTrip(req)
+	}
+	if policy.MaxAttempts < 2 || !contains(policy.Methods, req.Method) {
+		return rt.try(req, nil, policy)
+	}
+
+	getBody, ok := bufferBody(req, policy.MaxBodySize)
+	if !ok {
+		return rt.try(req, nil, policy)
+	}
+
+	logger := rt.loggerFactory(req.Context())
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.try(req, getBody, policy)
+
+		reason := policy.retryReason(resp, err)
+		if reason == "" || attempt >= policy.MaxAttempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		delay := policy.backoff(attempt)
+		logger.Warn("ReverseProxy: retrying upstream request", zap.String("upstream_url", req.URL.String()),
+			zap.Int("attempt", attempt), zap.String("reason", reason), zap.Duration("backoff", delay))
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (rt *retryRoundTripper) try(req *http.Request, getBody func() io.ReadCloser, policy *RetryPolicy) (*http.Response, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if policy.PerTryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, policy.PerTryTimeout)
+	}
+
+	tryReq := req.Clone(ctx)
+	if getBody != nil {
+		tryReq.Body = getBody()
+	}
+
+	resp, err := rt.RoundTripper.RoundTrip(tryReq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	//the per-try timeout applies until the body is read
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+//retryReason returns why an attempt should be retried, or "" if it should not
+func (policy *RetryPolicy) retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		if kind := errorKind(err); kind != "" && contains(policy.RetryOnErrors, kind) {
+			return kind
+		}
+		return ""
+	}
+	for _, status := range policy.RetryOnStatus {
+		if resp.StatusCode == status {
+			return http.StatusText(status)
+		}
+	}
+	return ""
+}
+
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	if policy.Backoff <= 0 {
+		return 0
+	}
+	delay := policy.Backoff << (attempt - 1)
+	if policy.MaxBackoff > 0 && (delay > policy.MaxBackoff || delay <= 0) {
+		delay = policy.MaxBackoff
+	}
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+//bufferBody reads the request body so that it can be sent again.
+//It returns false when the body is larger than the limit, the request is then sent only once
+func bufferBody(req *http.Request, limit int64) (func() io.ReadCloser, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		req.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(data), req.Body), Closer: req.Body}
+		return nil, false
+	}
+	_ = req.Body.Close()
+
+	return func() io.ReadCloser {
+		return io.NopCloser(bytes.NewReader(data))
+	}, true
+}
+
+//errorKind classifies the network errors that can be retried
+func errorKind(err error) string {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return TimeoutError
+	case errors.As(err, &opErr) && opErr.Op == "dial", errors.As(err, &dnsErr), errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectFailureError
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ResetError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return TimeoutError
+	}
+	return ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
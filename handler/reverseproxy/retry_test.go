@@ -0,0 +1,139 @@
+package reverseproxy
+
+import (
+	"context"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/router"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//flakyUpstream fails the first requests with the given func and then echoes the request body
+func flakyUpstream(failures int32, fail func(w http.ResponseWriter)) (*httptest.Server, *atomic.Int32) {
+	calls := new(atomic.Int32)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) <= failures {
+			fail(w)
+			return
+		}
+		_, _ = w.Write(body)
+	})), calls
+}
+
+func retryProxy(upstreamURL string, retry map[string]interface{}) http.Handler {
+	loggerFactory := log.ZapLoggerFactory(zap.NewNop())
+	endpoint := abstraction.Endpoint{UpstreamURL: upstreamURL, Retry: retry}
+	//a new transport, so that it does not retry itself the requests on reused connections
+	return NewReverseProxy(NewRetryRoundTripper(&http.Transport{}, loggerFactory), nil, nil)(endpoint, loggerFactory)
+}
+
+func serveProxy(proxy http.Handler, method string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req = req.WithContext(context.WithValue(req.Context(), router.ContextRouteKey, router.RouteContext{PathPrefix: "/"}))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	return w
+}
+
+func unavailable(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func TestRetryStatus(t *testing.T) {
+	upstream, calls := flakyUpstream(2, unavailable)
+	defer upstream.Close()
+
+	w := serveProxy(retryProxy(upstream.URL, map[string]interface{}{"max_attempts": 3, "backoff": "1ms"}), "PUT", "offer")
+	if w.Code != http.StatusOK || w.Body.String() != "offer" || calls.Load() != 3 {
+		t.Errorf("expected the 3rd attempt to succeed, but got %v %q after %v calls", w.Code, w.Body.String(), calls.Load())
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	upstream, calls := flakyUpstream(5, unavailable)
+	defer upstream.Close()
+
+	w := serveProxy(retryProxy(upstream.URL, map[string]interface{}{"max_attempts": 2}), "GET", "")
+	if w.Code != http.StatusServiceUnavailable || calls.Load() != 2 {
+		t.Errorf("expected the last response after 2 attempts, but got %v after %v calls", w.Code, calls.Load())
+	}
+}
+
+func TestRetryMethods(t *testing.T) {
+	upstream, calls := flakyUpstream(1, unavailable)
+	defer upstream.Close()
+
+	w := serveProxy(retryProxy(upstream.URL, map[string]interface{}{"max_attempts": 3}), "POST", "offer")
+	if w.Code != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("expected POST not to be retried, but got %v after %v calls", w.Code, calls.Load())
+	}
+
+	calls.Store(0)
+	w = serveProxy(retryProxy(upstream.URL, map[string]interface{}{"max_attempts": 3, "methods": []string{"POST"}}), "POST", "offer")
+	if w.Code != http.StatusOK || w.Body.String() != "offer" || calls.Load() != 2 {
+		t.Errorf("expected POST to be retried with its body, but got %v %q after %v calls", w.Code, w.Body.String(), calls.Load())
+	}
+}
+
+func TestRetryBodyLimit(t *testing.T) {
+	upstream, calls := flakyUpstream(1, unavailable)
+	defer upstream.Close()
+
+	retry := map[string]interface{}{"max_attempts": 3, "max_body_size": 4}
+	w := serveProxy(retryProxy(upstream.URL, retry), "PUT", "12345")
+	if w.Code != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("expected a body over the limit not to be retried, but got %v after %v calls", w.Code, calls.Load())
+	}
+
+	w = serveProxy(retryProxy(upstream.URL, retry), "PUT", "12345")
+	if w.Body.String() != "12345" {
+		t.Errorf("expected the whole body to be sent, but got %q", w.Body.String())
+	}
+}
+
+func TestRetryNetworkErrors(t *testing.T) {
+	upstream, calls := flakyUpstream(1, func(w http.ResponseWriter) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	})
+	defer upstream.Close()
+
+	w := serveProxy(retryProxy(upstream.URL, map[string]interface{}{"max_attempts": 2}), "GET", "")
+	if w.Code != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("expected a reset connection to be retried, but got %v after %v calls", w.Code, calls.Load())
+	}
+
+	calls.Store(0)
+	w = serveProxy(retryProxy(upstream.URL, map[string]interface{}{"max_attempts": 2, "retry_on_errors": []string{"timeout"}}), "GET", "")
+	if w.Code != http.StatusBadGateway || calls.Load() != 1 {
+		t.Errorf("expected a reset connection not to be retried, but got %v after %v calls", w.Code, calls.Load())
+	}
+}
+
+func TestRetryPerTryTimeout(t *testing.T) {
+	upstream, calls := flakyUpstream(1, func(w http.ResponseWriter) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	defer upstream.Close()
+
+	retry := map[string]interface{}{"max_attempts": 2, "per_try_timeout": "20ms"}
+	w := serveProxy(retryProxy(upstream.URL, retry), "GET", "offer")
+	if w.Code != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("expected the slow attempt to be retried, but got %v after %v calls", w.Code, calls.Load())
+	}
+
+	calls.Store(0)
+	retry["max_attempts"] = 1
+	w = serveProxy(retryProxy(upstream.URL, retry), "GET", "offer")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status %v, but got %v", http.StatusGatewayTimeout, w.Code)
+	}
+}
@@ -1,9 +1,13 @@
 package reverseproxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/mitchellh/mapstructure"
 	"github.com/osstotalsoft/bifrost/abstraction"
 	"github.com/osstotalsoft/bifrost/handler"
+	"github.com/osstotalsoft/bifrost/httputils"
 	"github.com/osstotalsoft/bifrost/log"
 	"github.com/osstotalsoft/bifrost/router"
 	"github.com/osstotalsoft/bifrost/strutils"
@@ -14,20 +18,80 @@ import (
 	"strings"
 )
 
+//upstreamTargetKey is the key used to pass the target chosen by the balancer to the director
+const upstreamTargetKey = "UpstreamTargetKey"
+
 type RequestModifier func(r *http.Request) error
 type ResponseModifier func(r *http.Response) error
 
+//EndpointConfig is the reverse proxy specific configuration of the endpoint
+type EndpointConfig struct {
+	LoadBalancer LoadBalancerConfig `mapstructure:"load_balancer"`
+}
+
 //NewReverseProxy create a new reverproxy http.Handler for each endpoint
+//When the endpoint has upstream targets, each request is sent to the target chosen by the configured load balancer.
+//The retry policy of the endpoint is applied by the RoundTripper created with NewRetryRoundTripper
 func NewReverseProxy(transport http.RoundTripper, requestModifier RequestModifier, responseModifier ResponseModifier) handler.Func {
 	return func(endPoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
 		//https://github.com/golang/go/issues/16012
 		//http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 100
 
-		return &httputil.ReverseProxy{
+		var proxy http.Handler = &httputil.ReverseProxy{
 			Director:       getDirector(endPoint.UpstreamURL, endPoint.UpstreamPath, endPoint.UpstreamPathPrefix, loggerFactory, requestModifier),
 			ModifyResponse: responseModifier,
 			Transport:      transport,
+			ErrorHandler:   getErrorHandler(loggerFactory),
+		}
+		if endPoint.Retry != nil {
+			policy, err := decodeRetryPolicy(endPoint.Retry)
+			if err != nil {
+				loggerFactory(nil).Error("ReverseProxy: cannot decode the retry policy, requests will not be retried", zap.Error(err))
+			} else {
+				proxy = withRetryPolicy(policy, proxy)
+			}
+		}
+		if endPoint.UpstreamTargets == nil {
+			return proxy
+		}
+
+		var cfg EndpointConfig
+		_ = mapstructure.Decode(endPoint.HandlerConfig, &cfg)
+		balancer, ok := NewBalancer(cfg.LoadBalancer)
+		if !ok {
+			loggerFactory(nil).Error("ReverseProxy: unknown load balancing strategy, using round robin", zap.String("strategy", cfg.LoadBalancer.Strategy))
 		}
+
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			targets := endPoint.UpstreamTargets.Healthy()
+			if len(targets) == 0 {
+				loggerFactory(request.Context()).Error("ReverseProxy: no healthy upstream target available", zap.String("upstream_url", endPoint.UpstreamURL))
+				http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+
+			target, done := balancer.Next(request, targets)
+			defer done()
+
+			ctx := context.WithValue(request.Context(), upstreamTargetKey, target)
+			proxy.ServeHTTP(writer, request.WithContext(ctx))
+		})
+	}
+}
+
+//getErrorHandler answers with 504 when the route timeout or the per-try timeout aborted the upstream call
+//and with 502 for any other upstream error
+func getErrorHandler(loggerFactory log.Factory) func(writer http.ResponseWriter, req *http.Request, err error) {
+	return func(writer http.ResponseWriter, req *http.Request, err error) {
+		logger := loggerFactory(req.Context())
+		if errors.Is(err, context.DeadlineExceeded) {
+			logger.Error("upstream request timed out", zap.Error(err), zap.String("upstream_url", req.URL.String()))
+			httputils.GatewayTimeout(writer)
+			return
+		}
+
+		logger.Error("upstream request failed", zap.Error(err), zap.String("upstream_url", req.URL.String()))
+		writer.WriteHeader(http.StatusBadGateway)
 	}
 }
 
@@ -53,29 +117,17 @@ func getDirector(targetUrl, targetUrlPath, targetUrlPrefix string, loggerFactory
 			logger.Panic("Error when converting to url "+targetUrl, zap.String("target_url", targetUrl))
 			return
 		}
-		targetQuery := target.RawQuery
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.Host = target.Host
-		if targetUrlPath == "" {
-			path := req.URL.RawPath //do not use escapedPath
-			if path == "" {         //if no escaping
-				path = req.URL.Path
-			}
-			req.URL.Path = strutils.SingleJoiningSlash(target.Path, strings.TrimPrefix(path, routeContext.PathPrefix))
-
-			if targetQuery == "" || req.URL.RawQuery == "" {
-				req.URL.RawQuery = targetQuery + req.URL.RawQuery
-			} else {
-				req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+		if address, ok := req.Context().Value(upstreamTargetKey).(string); ok {
+			upstreamTarget, err := url.Parse(address)
+			if err != nil {
+				logger.Panic("Error when converting to url "+address, zap.String("upstream_target", address))
+				return
 			}
-		} else {
-			req.URL.Path = target.Path
-			req.URL.RawQuery = targetQuery
+			target.Scheme = upstreamTarget.Scheme
+			target.Host = upstreamTarget.Host
 		}
-
-		req.URL.Path = replaceVarsInTarget(req.URL.Path, routeContext.Vars)
-		req.URL.RawQuery = replaceVarsInTarget(req.URL.RawQuery, routeContext.Vars)
+		req.URL = rewriteURL(req.URL, target, targetUrlPath, routeContext)
+		req.Host = target.Host
 
 		if _, ok := req.Header["User-Agent"]; !ok {
 			// explicitly disable User-Agent so it's not set to default value
@@ -86,6 +138,44 @@ func getDirector(targetUrl, targetUrlPath, targetUrlPrefix string, loggerFactory
 	}
 }
 
+//UpstreamURL returns the url a request matching the route of the endpoint is forwarded to,
+//before one of the upstream targets is chosen
+func UpstreamURL(endPoint abstraction.Endpoint, request *http.Request, routeContext router.RouteContext) (string, error) {
+	target, err := url.Parse(endPoint.UpstreamURL)
+	if err != nil {
+		return "", err
+	}
+	return rewriteURL(request.URL, target, endPoint.UpstreamPath, routeContext).String(), nil
+}
+
+//rewriteURL replaces the scheme, host and path prefix of the request url with the ones of the target url
+func rewriteURL(requestUrl *url.URL, target *url.URL, targetUrlPath string, routeContext router.RouteContext) *url.URL {
+	result := *requestUrl
+	targetQuery := target.RawQuery
+	result.Scheme = target.Scheme
+	result.Host = target.Host
+	if targetUrlPath == "" {
+		path := result.RawPath //do not use escapedPath
+		if path == "" {        //if no escaping
+			path = result.Path
+		}
+		result.Path = strutils.SingleJoiningSlash(target.Path, strings.TrimPrefix(path, routeContext.PathPrefix))
+
+		if targetQuery == "" || result.RawQuery == "" {
+			result.RawQuery = targetQuery + result.RawQuery
+		} else {
+			result.RawQuery = targetQuery + "&" + result.RawQuery
+		}
+	} else {
+		result.Path = target.Path
+		result.RawQuery = targetQuery
+	}
+
+	result.Path = replaceVarsInTarget(result.Path, routeContext.Vars)
+	result.RawQuery = replaceVarsInTarget(result.RawQuery, routeContext.Vars)
+	return &result
+}
+
 func replaceVarsInTarget(targetUrl string, vars map[string]string) string {
 	for key, val := range vars {
 		targetUrl = strings.Replace(targetUrl, "{"+key+"}", val, 1)
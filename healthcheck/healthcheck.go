@@ -0,0 +1,382 @@
+package healthcheck
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Config is the configuration of the active health checks, loaded from config.json
+type Config struct {
+	Enabled     bool `mapstructure:"enabled"`
+	ProbeConfig `mapstructure:",squash"`
+	Services    map[string]ProbeConfig `mapstructure:"services"`
+}
+
+//ProbeConfig configures how the targets of a service are probed.
+//The settings of a service override the default ones
+type ProbeConfig struct {
+	//Disabled is nil when not set, so that a service can be checked even if the checks are disabled by default
+	Disabled           *bool         `mapstructure:"disabled"`
+	Path               string        `mapstructure:"path"`
+	Interval           time.Duration `mapstructure:"interval"`
+	Timeout            time.Duration `mapstructure:"timeout"`
+	HealthyThreshold   int           `mapstructure:"healthy_threshold"`
+	UnhealthyThreshold int           `mapstructure:"unhealthy_threshold"`
+	ExpectedStatus     []int         `mapstructure:"expected_status"`
+}
+
+var defaultProbeConfig = ProbeConfig{
+	Path:               "/health",
+	Interval:           10 * time.Second,
+	Timeout:            2 * time.Second,
+	HealthyThreshold:   2,
+	UnhealthyThreshold: 3,
+}
+
+//HealthChecker periodically probes the upstream targets of the services
+//and takes the unhealthy ones out of rotation
+type HealthChecker struct {
+	config   Config
+	client   *http.Client
+	logger   log.Logger
+	mutex    sync.Mutex
+	services map[string]*serviceCheck
+}
+
+type serviceCheck struct {
+	service servicediscovery.Service
+	config  ProbeConfig
+	targets *abstraction.UpstreamTargets
+	stop    chan struct{}
+	mutex   sync.Mutex
+	states  map[string]*TargetStatus
+}
+
+//ServiceStatus is the health state of the targets of a service
+type ServiceStatus struct {
+	UID       string         `json:"uid"`
+	Name      string         `json:"name"`
+	Namespace string         `json:"namespace"`
+	Resource  string         `json:"resource"`
+	Targets   []TargetStatus `json:"targets"`
+}
+
+//TargetStatus is the health state of an upstream target
+type TargetStatus struct {
+	Address              string    `json:"address"`
+	Healthy              bool      `json:"healthy"`
+	LastStatus           int       `json:"last_status,omitempty"`
+	LastError            string    `json:"last_error,omitempty"`
+	LastCheck            time.Time `json:"last_check"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+}
+
+//NewHealthChecker is the HealthChecker constructor
+func NewHealthChecker(config Config, loggerFactory log.Factory) *HealthChecker {
+	logger := loggerFactory(nil)
+	logger = logger.With(zap.String("component", "health_checker"))
+
+	return &HealthChecker{
+		config:   config,
+		client:   &http.Client{},
+		logger:   logger,
+		services: map[string]*serviceCheck{},
+	}
+}
+
+//Watch starts probing the targets of a service
+func Watch(checker *HealthChecker) func(service servicediscovery.Service, targets *abstraction.UpstreamTargets) {
+	return func(service servicediscovery.Service, targets *abstraction.UpstreamTargets) {
+		config := probeConfig(checker.config, service.Resource)
+		if !checker.config.Enabled || config.Disabled != nil && *config.Disabled {
+			return
+		}
+
+		check := &serviceCheck{
+			service: service,
+			config:  config,
+			targets: targets,
+			stop:    make(chan struct{}),
+			states:  map[string]*TargetStatus{},
+		}
+
+		checker.mutex.Lock()
+		if old, ok := checker.services[service.UID]; ok {
+			close(old.stop)
+		}
+		checker.services[service.UID] = check
+		checker.mutex.Unlock()
+
+		go run(checker, check)
+	}
+}
+
+//Unwatch stops probing the targets of a service
+func Unwatch(checker *HealthChecker) func(service servicediscovery.Service) {
+	return func(service servicediscovery.Service) {
+		checker.mutex.Lock()
+		defer checker.mutex.Unlock()
+
+		if check, ok := checker.services[service.UID]; ok {
+			close(check.stop)
+			delete(checker.services, service.UID)
+		}
+	}
+}
+
+//WatchRegistry keeps the health checks in line with the services of the registry.
+//The checks of a service are restarted only when its targets are replaced, not when its addresses change
+func WatchRegistry(checker *HealthChecker) func(event registry.Event) {
+	return func(event registry.Event) {
+		entry := event.Entry
+		if event.Type == registry.EntryDeleted {
+			Unwatch(checker)(entry.Service)
+			return
+		}
+		if entry.Targets == nil {
+			return
+		}
+
+		checker.mutex.Lock()
+		check, ok := checker.services[entry.Service.UID]
+		checker.mutex.Unlock()
+		if ok && check.targets == entry.Targets {
+			return
+		}
+		Watch(checker)(entry.Service, entry.Targets)
+	}
+}
+
+//Stop stops all the health checks
+func Stop(checker *HealthChecker) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	for uid, check := range checker.services {
+		close(check.stop)
+		delete(checker.services, uid)
+	}
+}
+
+//Status returns the health state of the targets of all the checked services
+func Status(checker *HealthChecker) []ServiceStatus {
+	checker.mutex.Lock()
+	checks := make([]*serviceCheck, 0, len(checker.services))
+	for _, check := range checker.services {
+		checks = append(checks, check)
+	}
+	checker.mutex.Unlock()
+
+	statuses := make([]ServiceStatus, 0, len(checks))
+	for _, check := range checks {
+		status := ServiceStatus{
+			UID:       check.service.UID,
+			Name:      check.service.Name,
+			Namespace: check.service.Namespace,
+			Resource:  check.service.Resource,
+			Targets:   []TargetStatus{},
+		}
+		check.mutex.Lock()
+		for _, state := range check.states {
+			status.Targets = append(status.Targets, *state)
+		}
+		check.mutex.Unlock()
+
+		sort.Slice(status.Targets, func(i, j int) bool {
+			return status.Targets[i].Address < status.Targets[j].Address
+		})
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Namespace+"/"+statuses[i].Name < statuses[j].Namespace+"/"+statuses[j].Name
+	})
+	return statuses
+}
+
+//StatusHandler returns the health state of the targets as json
+func StatusHandler(checker *HealthChecker) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(Status(checker))
+	})
+}
+
+func probeConfig(config Config, resource string) ProbeConfig {
+	result := config.ProbeConfig
+	if override, ok := config.Services[resource]; ok {
+		result = merge(override, result)
+	}
+	return merge(result, defaultProbeConfig)
+}
+
+//merge fills the settings missing from config with the defaults
+func merge(config ProbeConfig, defaults ProbeConfig) ProbeConfig {
+	if config.Disabled == nil {
+		config.Disabled = defaults.Disabled
+	}
+	if config.Path == "" {
+		config.Path = defaults.Path
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaults.Interval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+	if config.HealthyThreshold <= 0 {
+		config.HealthyThreshold = defaults.HealthyThreshold
+	}
+	if config.UnhealthyThreshold <= 0 {
+		config.UnhealthyThreshold = defaults.UnhealthyThreshold
+	}
+	if len(config.ExpectedStatus) == 0 {
+		config.ExpectedStatus = defaults.ExpectedStatus
+	}
+	return config
+}
+
+func run(checker *HealthChecker, check *serviceCheck) {
+	ticker := time.NewTicker(check.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		probeTargets(checker, check)
+		select {
+		case <-check.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//probeTargets probes the current targets of a service and marks as unhealthy the ones that reached the threshold
+func probeTargets(checker *HealthChecker, check *serviceCheck) {
+	addresses := check.targets.Load()
+
+	type result struct {
+		status int
+		err    error
+	}
+	results := make([]result, len(addresses))
+	wg := sync.WaitGroup{}
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			results[i].status, results[i].err = probe(checker.client, address, check.config)
+		}(i, address)
+	}
+	wg.Wait()
+
+	check.mutex.Lock()
+	defer check.mutex.Unlock()
+
+	current := map[string]bool{}
+	var unhealthy []string
+	for i, address := range addresses {
+		current[address] = true
+		state, ok := check.states[address]
+		if !ok {
+			state = &TargetStatus{Address: address, Healthy: true}
+			check.states[address] = state
+		}
+
+		wasHealthy := state.Healthy
+		update(state, results[i].status, results[i].err, check.config)
+		if state.Healthy != wasHealthy {
+			logTransition(checker.logger, check.service, *state)
+		}
+		if !state.Healthy {
+			unhealthy = append(unhealthy, address)
+		}
+	}
+	for address := range check.states {
+		if !current[address] {
+			delete(check.states, address)
+		}
+	}
+
+	check.targets.SetUnhealthy(unhealthy)
+}
+
+func probe(client *http.Client, address string, config ProbeConfig) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(address, "/")+config.Path, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func update(state *TargetStatus, status int, err error, config ProbeConfig) {
+	state.LastCheck = time.Now()
+	state.LastStatus = status
+	state.LastError = ""
+	if err != nil {
+		state.LastError = err.Error()
+	}
+
+	if err == nil && expectedStatus(status, config.ExpectedStatus) {
+		state.ConsecutiveSuccesses++
+		state.ConsecutiveFailures = 0
+		if state.ConsecutiveSuccesses >= config.HealthyThreshold {
+			state.Healthy = true
+		}
+		return
+	}
+
+	state.ConsecutiveFailures++
+	state.ConsecutiveSuccesses = 0
+	if state.ConsecutiveFailures >= config.UnhealthyThreshold {
+		state.Healthy = false
+	}
+}
+
+//expectedStatus checks the status of a probe response, any 2xx status is expected by default
+func expectedStatus(status int, expected []int) bool {
+	if len(expected) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, s := range expected {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func logTransition(logger log.Logger, service servicediscovery.Service, state TargetStatus) {
+	fields := []zap.Field{
+		zap.String("service", service.Name),
+		zap.String("namespace", service.Namespace),
+		zap.String("address", state.Address),
+		zap.Int("last_status", state.LastStatus),
+		zap.String("last_error", state.LastError),
+	}
+	if state.Healthy {
+		logger.Info("HealthChecker: target is healthy", fields...)
+		return
+	}
+	logger.Warn("HealthChecker: target is unhealthy, taking it out of rotation", fields...)
+}
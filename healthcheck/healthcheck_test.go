@@ -0,0 +1,168 @@
+package healthcheck
+
+import (
+	"encoding/json"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry/inmemory"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	sick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer sick.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+
+	config := Config{
+		Enabled: true,
+		ProbeConfig: ProbeConfig{
+			Interval:           10 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+		Services: map[string]ProbeConfig{
+			"offers":   {Path: "/api/health"},
+			"partners": {Disabled: boolPtr(true)},
+		},
+	}
+	checker := NewHealthChecker(config, log.ZapLoggerFactory(zap.NewNop()))
+	defer Stop(checker)
+
+	service := servicediscovery.Service{UID: "1", Name: "offers", Namespace: "lsng", Resource: "offers"}
+	targets := abstraction.NewUpstreamTargets([]string{sick.URL, healthy.URL})
+	Watch(checker)(service, targets)
+	Watch(checker)(servicediscovery.Service{UID: "2", Resource: "partners"}, abstraction.NewUpstreamTargets([]string{sick.URL}))
+
+	status.Store(http.StatusServiceUnavailable)
+	waitFor(t, func() bool { return reflect.DeepEqual(targets.Healthy(), []string{healthy.URL}) })
+
+	statuses := Status(checker)
+	if len(statuses) != 1 || len(statuses[0].Targets) != 2 {
+		t.Fatalf("expected the status of the 2 targets of the checked service, but got %v", statuses)
+	}
+	if target := statuses[0].Targets[indexOf(statuses[0].Targets, sick.URL)]; target.Healthy || target.LastStatus != http.StatusServiceUnavailable {
+		t.Errorf("expected the target to be unhealthy, but got %v", target)
+	}
+
+	targets.Store([]string{sick.URL})
+	waitFor(t, func() bool { return len(targets.Healthy()) == 0 })
+
+	status.Store(http.StatusOK)
+	waitFor(t, func() bool { return reflect.DeepEqual(targets.Healthy(), []string{sick.URL}) })
+
+	Unwatch(checker)(service)
+	if statuses := Status(checker); len(statuses) != 0 {
+		t.Errorf("expected no checked service, but got %v", statuses)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	checker := NewHealthChecker(Config{Enabled: true}, log.ZapLoggerFactory(zap.NewNop()))
+	defer Stop(checker)
+	Watch(checker)(servicediscovery.Service{UID: "1", Name: "offers"}, abstraction.NewUpstreamTargets([]string{backend.URL}))
+	waitFor(t, func() bool { return len(Status(checker)[0].Targets) == 1 })
+
+	w := httptest.NewRecorder()
+	StatusHandler(checker).ServeHTTP(w, httptest.NewRequest("GET", "/health/targets", nil))
+
+	var statuses []ServiceStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Name != "offers" || statuses[0].Targets[0].Address != backend.URL || !statuses[0].Targets[0].Healthy {
+		t.Errorf("expected the healthy target of offers, but got %v", statuses)
+	}
+}
+
+func TestWatchRegistry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	checker := NewHealthChecker(Config{Enabled: true}, log.ZapLoggerFactory(zap.NewNop()))
+	defer Stop(checker)
+	store := inmemory.NewInMemoryStore()
+	store.Watch(WatchRegistry(checker))
+
+	targets := abstraction.NewUpstreamTargets([]string{backend.URL})
+	entry := registry.Entry{Service: servicediscovery.Service{UID: "1", Name: "offers"}, Targets: targets}
+	store.Store(entry)
+	waitFor(t, func() bool { return len(Status(checker)) == 1 && len(Status(checker)[0].Targets) == 1 })
+
+	checker.mutex.Lock()
+	check := checker.services["1"]
+	checker.mutex.Unlock()
+	store.Store(entry)
+	checker.mutex.Lock()
+	kept := checker.services["1"] == check
+	checker.mutex.Unlock()
+	if !kept {
+		t.Error("expected the check to be kept while the targets are the same")
+	}
+
+	store.Delete("1")
+	if statuses := Status(checker); len(statuses) != 0 {
+		t.Errorf("expected no checked service after the entry is deleted, but got %v", statuses)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func indexOf(targets []TargetStatus, address string) int {
+	for i, t := range targets {
+		if t.Address == address {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestProbeConfigDisabled(t *testing.T) {
+	config := Config{
+		Enabled:     true,
+		ProbeConfig: ProbeConfig{Disabled: boolPtr(true)},
+		Services: map[string]ProbeConfig{
+			"offers":   {Disabled: boolPtr(false)},
+			"partners": {Path: "/api/health"},
+		},
+	}
+
+	if disabled := probeConfig(config, "offers").Disabled; disabled == nil || *disabled {
+		t.Error("expected a service to be able to opt in when the checks are disabled by default")
+	}
+	if disabled := probeConfig(config, "partners").Disabled; disabled == nil || !*disabled {
+		t.Error("expected a service without setting to inherit the default")
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
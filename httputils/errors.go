@@ -0,0 +1,8 @@
+package httputils
+
+import "net/http"
+
+//GatewayTimeout writes the response returned when an endpoint does not answer in its configured timeout
+func GatewayTimeout(writer http.ResponseWriter) {
+	http.Error(writer, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+}
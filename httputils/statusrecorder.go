@@ -0,0 +1,41 @@
+package httputils
+
+import "net/http"
+
+//StatusRecorder records the status and the size of the response written through it
+type StatusRecorder struct {
+	http.ResponseWriter
+	//Status is the status of the response, StatusOK when the body is written without a status
+	Status int
+	//Size is the number of bytes of the body written
+	Size int64
+	//WroteHeader tells whether the response has been started
+	WroteHeader bool
+}
+
+//NewStatusRecorder is the StatusRecorder constructor
+func NewStatusRecorder(writer http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: writer, Status: http.StatusOK}
+}
+
+//WriteHeader records the status of the response, only the first one is kept as it is the one sent
+func (w *StatusRecorder) WriteHeader(status int) {
+	if !w.WroteHeader {
+		w.Status = status
+		w.WroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+//Write records that the response has been started and counts the bytes written
+func (w *StatusRecorder) Write(b []byte) (int, error) {
+	w.WroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.Size += int64(n)
+	return n, err
+}
+
+//Unwrap gives http.ResponseController access to the Flusher and Hijacker of the original writer
+func (w *StatusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -1,33 +1,51 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"github.com/opentracing/opentracing-go"
+	"github.com/osstotalsoft/bifrost/accesslog"
+	"github.com/osstotalsoft/bifrost/admin"
 	"github.com/osstotalsoft/bifrost/gateway"
 	"github.com/osstotalsoft/bifrost/handler"
 	"github.com/osstotalsoft/bifrost/handler/nats"
 	"github.com/osstotalsoft/bifrost/handler/reverseproxy"
+	"github.com/osstotalsoft/bifrost/healthcheck"
 	"github.com/osstotalsoft/bifrost/httputils"
 	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/metrics"
 	"github.com/osstotalsoft/bifrost/middleware"
 	"github.com/osstotalsoft/bifrost/middleware/auth"
+	"github.com/osstotalsoft/bifrost/middleware/circuitbreaker"
+	"github.com/osstotalsoft/bifrost/middleware/concurrency"
+	"github.com/osstotalsoft/bifrost/middleware/correlation"
 	"github.com/osstotalsoft/bifrost/middleware/cors"
+	"github.com/osstotalsoft/bifrost/middleware/ratelimit"
 	r "github.com/osstotalsoft/bifrost/router"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/provider/composite"
+	"github.com/osstotalsoft/bifrost/servicediscovery/provider/consul"
+	"github.com/osstotalsoft/bifrost/servicediscovery/provider/file"
 	"github.com/osstotalsoft/bifrost/servicediscovery/provider/kubernetes"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry/inmemory"
 	"github.com/osstotalsoft/bifrost/tracing"
 	"github.com/spf13/viper"
-	"github.com/uber/jaeger-client-go"
-	jaegercfg "github.com/uber/jaeger-client-go/config"
-	jaegerlog "github.com/uber/jaeger-client-go/log"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
+const (
+	//KubernetesServiceDiscoveryProvider discovers the labelled Kubernetes services
+	KubernetesServiceDiscoveryProvider = "kubernetes"
+	//FileServiceDiscoveryProvider discovers the services declared in the services file
+	FileServiceDiscoveryProvider = "file"
+	//ConsulServiceDiscoveryProvider discovers the healthy instances of the tagged Consul services
+	ConsulServiceDiscoveryProvider = "consul"
+)
+
 func main() {
 	//https://github.com/golang/go/issues/16012
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 100
@@ -38,19 +56,33 @@ func main() {
 	cfg := getConfig(zlogger)
 	changeLogLevel(level, cfg.LogLevel)
 
-	loggerFactory := tracing.SpanLoggerFactory(zlogger.With(zap.String("service", "api gateway")))
+	loggerFactory := correlation.LoggerFactory(tracing.SpanLoggerFactory(zlogger.With(zap.String("service", "api gateway"))))
 	logger := loggerFactory(nil)
 
-	closer := setupJaeger(zlogger)
-	defer closer.Close()
+	shutdownTracing := setupTracing(zlogger)
+	defer shutdownTracing(context.Background())
 
-	provider := kubernetes.NewKubernetesServiceDiscoveryProvider(cfg.InCluster, cfg.OverrideServiceAddress, cfg.ServiceNamespacePrefixFilter, loggerFactory)
 	dynRouter := r.NewDynamicRouter(r.GorillaMuxRouteMatcher, loggerFactory)
-	//registry := in_memory_registry.NewInMemoryStore()
+	registry := inmemory.NewInMemoryStore()
+
+	gatewayMetrics := metrics.NewMetrics(getMetricsConfig(zlogger), loggerFactory)
+	go func() {
+		if err := metrics.ListenAndServe(gatewayMetrics); err != nil {
+			logger.Error("metrics listener cannot start", zap.Error(err))
+		}
+	}()
+	defer metrics.Shutdown(gatewayMetrics)
+
+	accessLogger, err := accesslog.NewAccessLogger(getAccessLogConfig(zlogger), zlogger.Named("access"))
+	if err != nil {
+		logger.Panic("unable to create the access logger", zap.Error(err))
+	}
+	defer accesslog.Close(accessLogger)
 
 	natsHandler, closeNatsConnection, err := nats.NewNatsPublisher(getNatsHandlerConfig(zlogger),
 		nats.TransformMessage(nats.NBBTransformMessage),
 		nats.BuildResponse(nats.NBBBuildResponse),
+		nats.PublishObserver(metrics.NatsPublishObserver(gatewayMetrics)),
 		nats.Logger(logger),
 	)
 	if err != nil {
@@ -58,40 +90,86 @@ func main() {
 	}
 	defer closeNatsConnection()
 
-	gate := gateway.NewGateway(cfg, loggerFactory)
+	gate := gateway.NewGateway(cfg, registry, loggerFactory)
 	registerHandlerFunc := gateway.RegisterHandler(gate)
 	gateMiddlewareFunc := gateway.UseMiddleware(gate)
 
-	//gateMiddlewareFunc(ratelimit.RateLimitingFilterCode, ratelimit.RateLimiting(ratelimit.MaxRequestLimit))
-
-	gateMiddlewareFunc(cors.CORSFilterCode, middleware.Compose(tracing.MiddlewareSpanWrapper("CORS Filter"))(cors.CORSFilter(getCORSConfig(zlogger))))
-	gateMiddlewareFunc(auth.AuthorizationFilterCode, middleware.Compose(
-		tracing.MiddlewareSpanWrapper("Authorization Filter"),
-	)(auth.AuthorizationFilter(getIdentityServerConfig(zlogger))))
+	//the rate limiting store is kept when the configuration is reloaded
+	rateLimitingStore := getRateLimitingStore(getRateLimitingConfig(zlogger), zlogger)
+	useFilters := func(useMiddleware func(key string, mwf middleware.Func)) {
+		useMiddleware(metrics.MetricsFilterCode, metrics.EndpointMetrics(gatewayMetrics))
+		useMiddleware(accesslog.AccessLogFilterCode, accesslog.EndpointFilter())
+		useMiddleware(cors.CORSFilterCode, middleware.Compose(tracing.MiddlewareSpanWrapper("CORS Filter"))(cors.CORSFilter(getCORSConfig(zlogger))))
+		useMiddleware(auth.AuthorizationFilterCode, middleware.Compose(
+			metrics.MiddlewareWrapper(gatewayMetrics, auth.AuthorizationFilterCode),
+			tracing.MiddlewareSpanWrapper("Authorization Filter"),
+		)(auth.AuthorizationFilter(getIdentityServerConfig(zlogger))))
+		useMiddleware(ratelimit.RateLimitingFilterCode, middleware.Compose(
+			metrics.MiddlewareWrapper(gatewayMetrics, ratelimit.RateLimitingFilterCode),
+			tracing.MiddlewareSpanWrapper("Rate Limiting Filter"),
+		)(ratelimit.RateLimiting(getRateLimitingConfig(zlogger), rateLimitingStore)))
+		useMiddleware(concurrency.ConcurrencyFilterCode, middleware.Compose(
+			metrics.MiddlewareWrapper(gatewayMetrics, concurrency.ConcurrencyFilterCode),
+			tracing.MiddlewareSpanWrapper("Concurrency Filter"),
+		)(concurrency.ConcurrencyFilter(getConcurrencyConfig(zlogger))))
+		useMiddleware(circuitbreaker.CircuitBreakerFilterCode, middleware.Compose(
+			metrics.MiddlewareWrapper(gatewayMetrics, circuitbreaker.CircuitBreakerFilterCode),
+			tracing.MiddlewareSpanWrapper("Circuit Breaker Filter"),
+		)(circuitbreaker.CircuitBreakerFilter(getCircuitBreakerConfig(zlogger))))
+	}
+	useFilters(gateMiddlewareFunc)
 
-	registerHandlerFunc(handler.EventPublisherHandlerType, handler.Compose(tracing.HandlerSpanWrapper("Nats Handler"))(natsHandler))
+	registerHandlerFunc(handler.EventPublisherHandlerType, handler.Compose(
+		tracing.HandlerSpanWrapper("Nats Handler"),
+		accesslog.HandlerWrapper,
+	)(natsHandler))
 	registerHandlerFunc(handler.ReverseProxyHandlerType, handler.Compose(
 		tracing.HandlerSpanWrapper("Reverse Proxy Handler"),
-	)(reverseproxy.NewReverseProxy(tracing.NewRoundTripperWithOpenTrancing(),
+		accesslog.HandlerWrapper,
+	)(reverseproxy.NewReverseProxy(reverseproxy.NewRetryRoundTripper(metrics.NewRoundTripper(gatewayMetrics, accesslog.NewRoundTripper(tracing.NewRoundTripperWithOpenTrancing())), loggerFactory),
 		reverseproxy.AddUserIdToHeader,
 		reverseproxy.ClearCorsHeaders)))
 
 	addRouteFunc := r.AddRoute(dynRouter)
 	removeRouteFunc := r.RemoveRoute(dynRouter)
 
+	checker := healthcheck.NewHealthChecker(getHealthCheckConfig(zlogger), loggerFactory)
+	registry.Watch(healthcheck.WatchRegistry(checker))
+	defer healthcheck.Stop(checker)
+
 	//configure and start ServiceDiscovery
-	kubernetes.Compose(
-		kubernetes.SubscribeOnAddService(gateway.AddService(gate)(addRouteFunc)),
-		kubernetes.SubscribeOnRemoveService(gateway.RemoveService(gate)(removeRouteFunc)),
-		kubernetes.SubscribeOnUpdateService(gateway.UpdateService(gate)(addRouteFunc, removeRouteFunc)),
-		kubernetes.Start,
-	)(provider)
-	defer kubernetes.Stop(provider)
+	provider := getServiceDiscoveryProvider(cfg, loggerFactory, zlogger)
+	provider.SubscribeOnAddService(gateway.AddService(gate)(addRouteFunc))
+	provider.SubscribeOnRemoveService(gateway.RemoveService(gate)(removeRouteFunc))
+	provider.SubscribeOnUpdateService(gateway.UpdateService(gate)(addRouteFunc, removeRouteFunc))
+	provider.Start()
+	defer provider.Stop()
+
+	settings := watchConfig(zlogger, level, gateway.Reload(gate)(r.Transaction(dynRouter)), useFilters)
+
+	adminServer := admin.NewAdminServer(getAdminConfig(zlogger), loggerFactory)
+	adminHandle := admin.Handle(adminServer)
+	adminHandle("/health/targets", healthcheck.StatusHandler(checker))
+	adminHandle("/services", admin.ServicesHandler(registry))
+	adminHandle("/endpoints", admin.EndpointsHandler(registry, func() []string { return gateway.Middlewares(gate) }))
+	adminHandle("/routes", admin.RoutesHandler(r.Routes(dynRouter)))
+	adminHandle("/config", admin.ConfigHandler(settings))
+	adminHandle("/match", admin.MatchHandler(r.MatchRoute(dynRouter), registry))
+	adminHandle("/traffic_weights", admin.TrafficWeightsHandler(gateway.SetTrafficWeights(gate)))
+	go func() {
+		if err := admin.ListenAndServe(adminServer); err != nil {
+			logger.Error("admin listener cannot start", zap.Error(err))
+		}
+	}()
+	defer admin.Shutdown(adminServer)
 
 	go Shutdown(logger, gate)
 
 	err = gateway.ListenAndServe(gate, httputils.Compose(
 		httputils.RecoveryHandler(loggerFactory),
+		accesslog.Handler(accessLogger),
+		correlation.Handler(getCorrelationConfig(zlogger)),
+		metrics.RouterWrapper(gatewayMetrics),
 		tracing.SpanWrapper,
 	)(r.GetHandler(dynRouter)))
 
@@ -137,7 +215,6 @@ func getConfig(logger *zap.Logger) *gateway.Config {
 	viper.AddConfigPath(".")
 	viper.SetConfigType("json")
 	viper.AutomaticEnv()
-	//viper.WatchConfig()
 
 	err := viper.ReadInConfig() // Find and read the config file
 	if err != nil {             // Handle errors reading the config file
@@ -149,7 +226,7 @@ func getConfig(logger *zap.Logger) *gateway.Config {
 	if err != nil {
 		logger.Panic("unable to decode into struct", zap.Error(err))
 	}
-	logger.Info(fmt.Sprintf("using configuration: %v", viper.AllSettings()))
+	logger.Info(fmt.Sprintf("using configuration: %v", maskSettings(viper.AllSettings())))
 
 	return cfg
 }
@@ -174,6 +251,16 @@ func getIdentityServerConfig(logger *zap.Logger) auth.AuthorizationOptions {
 	return *cfg
 }
 
+func getCorrelationConfig(logger *zap.Logger) correlation.Options {
+	var cfg = new(correlation.Options)
+	err := viper.UnmarshalKey("correlation", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into correlation.Options", zap.Error(err))
+	}
+
+	return *cfg
+}
+
 func getCORSConfig(logger *zap.Logger) cors.Options {
 	var cfg = new(cors.Options)
 	err := viper.UnmarshalKey("filters.cors", cfg)
@@ -184,41 +271,146 @@ func getCORSConfig(logger *zap.Logger) cors.Options {
 	return *cfg
 }
 
-func setupJaeger(logger *zap.Logger) io.Closer {
-	var cfg = &struct {
-		Enabled bool   `json:"enabled"`
-		Agent   string `json:"agent"`
-	}{}
+func getRateLimitingConfig(logger *zap.Logger) ratelimit.Options {
+	var cfg = new(ratelimit.Options)
+	err := viper.UnmarshalKey("filters.rate_limit", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into ratelimit.Options", zap.Error(err))
+	}
+
+	return *cfg
+}
+
+func getRateLimitingStore(cfg ratelimit.Options, logger *zap.Logger) ratelimit.Store {
+	store, err := ratelimit.NewStore(cfg)
+	if err != nil {
+		logger.Panic("unable to create the rate limiting store", zap.Error(err))
+	}
+
+	return store
+}
 
-	err := viper.UnmarshalKey("opentracing", cfg)
+func getConcurrencyConfig(logger *zap.Logger) concurrency.Options {
+	var cfg = new(concurrency.Options)
+	err := viper.UnmarshalKey("filters.concurrency", cfg)
 	if err != nil {
-		logger.Panic("unable to decode into Jaeger Config", zap.Error(err))
+		logger.Panic("unable to decode into concurrency.Options", zap.Error(err))
 	}
 
-	jconfig := jaegercfg.Configuration{
-		Disabled:    !cfg.Enabled,
-		ServiceName: "Bifrost API Gateway",
-		Sampler: &jaegercfg.SamplerConfig{
-			Type:  jaeger.SamplerTypeConst,
-			Param: 1,
-		},
-		Reporter: &jaegercfg.ReporterConfig{
-			LogSpans:           false,
-			LocalAgentHostPort: cfg.Agent,
-		},
+	return *cfg
+}
+
+func getMetricsConfig(logger *zap.Logger) metrics.Config {
+	var cfg = new(metrics.Config)
+	err := viper.UnmarshalKey("metrics", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into metrics.Config", zap.Error(err))
 	}
 
-	jLogger := jaegerlog.StdLogger
-	//jMetricsFactory := jaegerprom.New() //metrics.NullFactory
-	//jaeger.NewMetrics(factory, map[string]string{"lib": "jaeger"})
+	return *cfg
+}
 
-	// Initialize tracer with a logger and a metrics factory
-	tracer, closer, _ := jconfig.NewTracer(
-		jaegercfg.Logger(jLogger),
-		//jaegercfg.Metrics(jMetricsFactory),
-	)
-	// Set the singleton opentracing.Tracer with the Jaeger tracer.
-	opentracing.SetGlobalTracer(tracer)
+func getAccessLogConfig(logger *zap.Logger) accesslog.Config {
+	var cfg = new(accesslog.Config)
+	err := viper.UnmarshalKey("access_log", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into accesslog.Config", zap.Error(err))
+	}
+
+	return *cfg
+}
+
+func getCircuitBreakerConfig(logger *zap.Logger) circuitbreaker.Options {
+	var cfg = new(circuitbreaker.Options)
+	err := viper.UnmarshalKey("filters.circuit_breaker", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into circuitbreaker.Options", zap.Error(err))
+	}
+
+	return *cfg
+}
+
+func getHealthCheckConfig(logger *zap.Logger) healthcheck.Config {
+	var cfg = new(healthcheck.Config)
+	err := viper.UnmarshalKey("health_check", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into healthcheck.Config", zap.Error(err))
+	}
+
+	return *cfg
+}
+
+func getAdminConfig(logger *zap.Logger) admin.Config {
+	var cfg = new(admin.Config)
+	err := viper.UnmarshalKey("admin", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into admin.Config", zap.Error(err))
+	}
+	err = admin.ValidateConfig(*cfg)
+	if err != nil {
+		logger.Panic("invalid admin configuration", zap.Error(err))
+	}
+
+	return *cfg
+}
+
+func getConsulConfig(logger *zap.Logger) consul.Options {
+	var cfg = new(consul.Options)
+	err := viper.UnmarshalKey("consul", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into consul.Options", zap.Error(err))
+	}
+
+	return *cfg
+}
+
+//getServiceDiscoveryProvider creates the configured providers, kubernetes by default.
+//When several providers are configured, the first one that finds a resource publishes its services
+//and the UIDs of the services are prefixed with the name of their provider, ex: consul/offers
+func getServiceDiscoveryProvider(cfg *gateway.Config, loggerFactory log.Factory, logger *zap.Logger) servicediscovery.Provider {
+	names := cfg.ServiceDiscoveryProviders
+	if len(names) == 0 {
+		names = []string{KubernetesServiceDiscoveryProvider}
+	}
+
+	var providers []composite.NamedProvider
+	for _, name := range names {
+		var provider servicediscovery.Provider
+		switch name {
+		case KubernetesServiceDiscoveryProvider:
+			kubeProvider := kubernetes.NewKubernetesServiceDiscoveryProvider(cfg.InCluster, cfg.OverrideServiceAddress, cfg.ServiceNamespacePrefixFilter, loggerFactory)
+			if cfg.EndpointSlices {
+				kubeProvider = kubernetes.UseEndpointSlices(kubeProvider)
+			}
+			provider = kubeProvider
+		case FileServiceDiscoveryProvider:
+			provider = file.NewFileServiceProvider(cfg.ServicesFile, loggerFactory)
+		case ConsulServiceDiscoveryProvider:
+			provider = consul.NewConsulServiceProvider(getConsulConfig(logger), loggerFactory)
+		default:
+			logger.Panic("unknown service discovery provider", zap.String("provider", name))
+		}
+		providers = append(providers, composite.NamedProvider{Name: name, Provider: provider})
+	}
+
+	if len(providers) == 1 {
+		return providers[0].Provider
+	}
+	return composite.NewCompositeServiceProvider(loggerFactory, providers...)
+}
+
+func setupTracing(logger *zap.Logger) func(ctx context.Context) error {
+	var cfg = new(tracing.Config)
+	err := viper.UnmarshalKey("tracing", cfg)
+	if err != nil {
+		logger.Panic("unable to decode into tracing.Config", zap.Error(err))
+	}
+
+	provider, err := tracing.NewTracerProvider(*cfg)
+	if err != nil {
+		logger.Panic("unable to create the tracer provider", zap.Error(err))
+	}
+	tracing.SetGlobalTracerProvider(provider)
 
-	return closer
+	return provider.Shutdown
 }
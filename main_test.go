@@ -7,11 +7,15 @@ import (
 	"github.com/osstotalsoft/bifrost/log"
 	r "github.com/osstotalsoft/bifrost/router"
 	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry/inmemory"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -166,7 +170,7 @@ func TestGatewayReverseProxy(t *testing.T) {
 	factory := log.ZapLoggerFactory(logger)
 
 	dynRouter := r.NewDynamicRouter(r.GorillaMuxRouteMatcher, factory)
-	gate := gateway.NewGateway(&testConfig2, factory)
+	gate := gateway.NewGateway(&testConfig2, inmemory.NewInMemoryStore(), factory)
 	gateway.RegisterHandler(gate)(handler.ReverseProxyHandlerType, reverseproxy.NewReverseProxy(http.DefaultTransport, nil, nil))
 	frontendProxy := httptest.NewServer(r.GetHandler(dynRouter))
 	defer frontendProxy.Close()
@@ -229,7 +233,7 @@ func BenchmarkGatewayReverseProxy(b *testing.B) {
 
 	factory := log.ZapLoggerFactory(zap.NewNop())
 	dynRouter := r.NewDynamicRouter(r.GorillaMuxRouteMatcher, factory)
-	gate := gateway.NewGateway(&testConfig2, factory)
+	gate := gateway.NewGateway(&testConfig2, inmemory.NewInMemoryStore(), factory)
 	gateway.RegisterHandler(gate)(handler.ReverseProxyHandlerType, reverseproxy.NewReverseProxy(http.DefaultTransport, nil, nil))
 
 	gateHandler := r.GetHandler(dynRouter)
@@ -249,3 +253,73 @@ func BenchmarkGatewayReverseProxy(b *testing.B) {
 		w.Result()
 	}
 }
+
+func TestSettingsDiff(t *testing.T) {
+	oldSettings := map[string]interface{}{
+		"log_level": "debug",
+		"endpoints": []interface{}{
+			map[string]interface{}{"service_name": "users", "filters": map[string]interface{}{"rate_limit": map[string]interface{}{"limit": 500}}},
+		},
+		"filters": map[string]interface{}{"rate_limit": map[string]interface{}{"redis": map[string]interface{}{"password": "old"}}},
+	}
+	newSettings := map[string]interface{}{
+		"log_level": "debug",
+		"endpoints": []interface{}{
+			map[string]interface{}{"service_name": "users", "filters": map[string]interface{}{"rate_limit": map[string]interface{}{"limit": 100}}},
+			map[string]interface{}{"service_name": "partners"},
+		},
+		"filters": map[string]interface{}{"rate_limit": map[string]interface{}{"redis": map[string]interface{}{"password": "new"}}},
+	}
+
+	expected := []string{
+		"endpoints.0.filters.rate_limit.limit: 500 -> 100",
+		"endpoints.1.service_name: added partners",
+		"filters.rate_limit.redis.password: *** -> ***",
+	}
+	diff := settingsDiff(oldSettings, newSettings)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected the diff %v, but got %v", expected, diff)
+	}
+}
+
+func TestRestoreSettings(t *testing.T) {
+	defer viper.Reset()
+	viper.SetConfigType("json")
+	err := viper.ReadConfig(strings.NewReader(`{"port": 8000, "filters": {"rate_limit": {"limit": 100}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := viper.AllSettings()
+
+	err = viper.ReadConfig(strings.NewReader(`{"port": 9000, "timeout": "1s"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restoreSettings(applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := settingsDiff(applied, viper.AllSettings()); len(diff) != 0 {
+		t.Errorf("expected the applied settings to be restored, but got the changes %v", diff)
+	}
+}
+
+func TestMaskSettings(t *testing.T) {
+	settings := map[string]interface{}{
+		"admin":     map[string]interface{}{"port": 8091, "password": "pass"},
+		"endpoints": []interface{}{map[string]interface{}{"client_secret": "secret", "service_name": "offers"}},
+	}
+
+	masked := maskSettings(settings).(map[string]interface{})
+	expected := map[string]interface{}{
+		"admin":     map[string]interface{}{"port": 8091, "password": "***"},
+		"endpoints": []interface{}{map[string]interface{}{"client_secret": "***", "service_name": "offers"}},
+	}
+	if !reflect.DeepEqual(masked, expected) {
+		t.Errorf("expected %v, but got %v", expected, masked)
+	}
+	if settings["admin"].(map[string]interface{})["password"] != "pass" {
+		t.Error("expected the settings not to be modified")
+	}
+}
@@ -0,0 +1,204 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/httputils"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"github.com/osstotalsoft/bifrost/strutils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//MetricsFilterCode is the code used to register the endpoint metrics middleware
+const MetricsFilterCode = "metrics"
+
+const (
+	endpointLabelsKey = "MetricsEndpointLabelsKey"
+	//filterPassedKey is suffixed with the filter code
+	filterPassedKey = "MetricsFilterPassedKey:"
+)
+
+var bearerError = regexp.MustCompile(`error="([^"]*)"`)
+
+//RouterWrapper measures all the requests received by the gateway
+func RouterWrapper(m *Metrics) func(inner http.Handler) http.Handler {
+	return func(inner http.Handler) http.Handler {
+		if m.requests == nil {
+			return inner
+		}
+		return promhttp.InstrumentHandlerInFlight(m.requestsInFlight,
+			promhttp.InstrumentHandlerDuration(m.requestDuration,
+				promhttp.InstrumentHandlerCounter(m.requests, inner)))
+	}
+}
+
+//EndpointMetrics is a middleware that measures the requests by route, service and handler type.
+//It should be the first middleware, so that it measures the requests rejected by the filters as well
+func EndpointMetrics(m *Metrics) middleware.Func {
+	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		labels := prometheus.Labels{
+			"route":        route(endpoint),
+			"service":      endpoint.ServiceName,
+			"handler_type": endpoint.HandlerType,
+		}
+
+		return func(next http.Handler) http.Handler {
+			if !m.config.Enabled {
+				return next
+			}
+
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				request = request.WithContext(context.WithValue(request.Context(), endpointLabelsKey, labels))
+				if m.endpointRequests == nil {
+					next.ServeHTTP(writer, request)
+					return
+				}
+
+				inFlight := m.endpointInFlight.With(labels)
+				inFlight.Inc()
+				start := time.Now()
+				rw := httputils.NewStatusRecorder(writer)
+				completed := false
+				defer func() {
+					inFlight.Dec()
+					status := rw.Status
+					if !completed {
+						status = http.StatusInternalServerError
+					}
+					values := withLabels(labels, prometheus.Labels{"status": strconv.Itoa(status)})
+					m.endpointRequests.With(values).Inc()
+					m.endpointDuration.With(values).Observe(time.Since(start).Seconds())
+					m.endpointResponseSize.With(values).Observe(float64(rw.Size))
+				}()
+
+				next.ServeHTTP(rw, request)
+				completed = true
+			})
+		}
+	}
+}
+
+//MiddlewareWrapper counts the requests rejected by a filter, the ones it answers without calling the next handler.
+//The reason is the error of the WWW-Authenticate header if any, ex: invalid_token, or else the status
+func MiddlewareWrapper(m *Metrics, filterCode string) func(inner middleware.Func) middleware.Func {
+	return func(inner middleware.Func) middleware.Func {
+		if m.filterRejections == nil {
+			return inner
+		}
+		return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+			innerMiddleware := inner(endpoint, loggerFactory)
+			labels := prometheus.Labels{
+				"route":        route(endpoint),
+				"service":      endpoint.ServiceName,
+				"handler_type": endpoint.HandlerType,
+				"filter":       filterCode,
+			}
+
+			passedKey := filterPassedKey + filterCode
+
+			return func(next http.Handler) http.Handler {
+				h := innerMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+					if passed, ok := request.Context().Value(passedKey).(*bool); ok {
+						*passed = true
+					}
+					next.ServeHTTP(writer, request)
+				}))
+
+				return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+					passed := new(bool)
+					request = request.WithContext(context.WithValue(request.Context(), passedKey, passed))
+					rw := httputils.NewStatusRecorder(writer)
+					h.ServeHTTP(rw, request)
+					if !*passed {
+						m.filterRejections.With(withLabels(labels, prometheus.Labels{
+							"status": strconv.Itoa(rw.Status),
+							"reason": reason(rw),
+						})).Inc()
+					}
+				})
+			}
+		}
+	}
+}
+
+//RoundTripper measures the round trips to the upstream services
+type RoundTripper struct {
+	http.RoundTripper
+	metrics *Metrics
+}
+
+//NewRoundTripper creates a RoundTripper which measures the round trips of the inner one
+func NewRoundTripper(m *Metrics, inner http.RoundTripper) http.RoundTripper {
+	if m.upstreamDuration == nil {
+		return inner
+	}
+	return &RoundTripper{RoundTripper: inner, metrics: m}
+}
+
+//RoundTrip delegates the request to the inner RoundTripper and observes its duration
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.RoundTripper.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	labels, _ := req.Context().Value(endpointLabelsKey).(prometheus.Labels)
+	if labels == nil {
+		labels = prometheus.Labels{"route": "", "service": "", "handler_type": ""}
+	}
+	rt.metrics.upstreamDuration.With(withLabels(labels, prometheus.Labels{"method": req.Method, "status": status})).
+		Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+//NatsPublishObserver observes the outcome of the NATS publishing: success, timeout or error
+func NatsPublishObserver(m *Metrics) func(ctx context.Context, topic string, duration time.Duration, err error) {
+	return func(ctx context.Context, topic string, duration time.Duration, err error) {
+		if m.natsPublishDuration == nil {
+			return
+		}
+		outcome := "success"
+		if errors.Is(err, context.DeadlineExceeded) {
+			outcome = "timeout"
+		} else if err != nil {
+			outcome = "error"
+		}
+		m.natsPublishDuration.WithLabelValues(topic, outcome).Observe(duration.Seconds())
+	}
+}
+
+//route is the configured downstream path of the endpoint, so that the number of series is bounded
+func route(endpoint abstraction.Endpoint) string {
+	if endpoint.DownstreamPath == "" {
+		return endpoint.DownstreamPathPrefix
+	}
+	return strutils.SingleJoiningSlash(endpoint.DownstreamPathPrefix, endpoint.DownstreamPath)
+}
+
+func reason(rw *httputils.StatusRecorder) string {
+	if match := bearerError.FindStringSubmatch(rw.Header().Get("WWW-Authenticate")); match != nil {
+		return match[1]
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(rw.Status)), " ", "_")
+}
+
+func withLabels(labels prometheus.Labels, more prometheus.Labels) prometheus.Labels {
+	result := prometheus.Labels{}
+	for k, v := range labels {
+		result[k] = v
+	}
+	for k, v := range more {
+		result[k] = v
+	}
+	return result
+}
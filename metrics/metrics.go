@@ -0,0 +1,176 @@
+package metrics
+
+import (
+	"context"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+const namespace = "bifrost"
+
+//Config is the configuration of the metrics, loaded from config.json
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	//ListenAddress is the address of the /metrics listener, ex: 8090 or 127.0.0.1:8090
+	ListenAddress string `mapstructure:"listen_address"`
+	//RouterDisabled disables the metrics of all the requests received by the gateway
+	RouterDisabled bool `mapstructure:"router_disabled"`
+	//EndpointDisabled disables the metrics of the requests by route, service and handler type
+	EndpointDisabled bool `mapstructure:"endpoint_disabled"`
+	//ProxyDisabled disables the metrics of the requests rejected by the filters, ex: auth failures, rate limiting
+	ProxyDisabled bool `mapstructure:"proxy_disabled"`
+	//BackendDisabled disables the metrics of the upstream round trips and of the NATS publishing
+	BackendDisabled bool `mapstructure:"backend_disabled"`
+}
+
+//Metrics holds the Prometheus collectors of the gateway
+type Metrics struct {
+	config        Config
+	registry      *prometheus.Registry
+	loggerFactory log.Factory
+	closer        func() error
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	requestsInFlight prometheus.Gauge
+
+	endpointRequests     *prometheus.CounterVec
+	endpointDuration     *prometheus.HistogramVec
+	endpointInFlight     *prometheus.GaugeVec
+	endpointResponseSize *prometheus.HistogramVec
+	filterRejections     *prometheus.CounterVec
+	upstreamDuration     *prometheus.HistogramVec
+	natsPublishDuration  *prometheus.HistogramVec
+}
+
+var (
+	endpointLabels = []string{"route", "service", "handler_type"}
+	statusLabels   = append(endpointLabels, "status")
+)
+
+//NewMetrics creates the collectors which are enabled in the config
+func NewMetrics(config Config, loggerFactory log.Factory) *Metrics {
+	m := &Metrics{
+		config:        config,
+		registry:      prometheus.NewRegistry(),
+		loggerFactory: loggerFactory,
+		closer: func() error {
+			return nil
+		},
+	}
+	if !config.Enabled {
+		return m
+	}
+
+	m.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	if !config.RouterDisabled {
+		m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "router", Name: "requests_total",
+			Help: "Number of requests received by the gateway.",
+		}, []string{"method", "code"})
+		m.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "router", Name: "request_duration_seconds",
+			Help: "Duration of the requests received by the gateway.", Buckets: prometheus.DefBuckets,
+		}, []string{"method", "code"})
+		m.requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "router", Name: "requests_in_flight",
+			Help: "Number of requests being served by the gateway.",
+		})
+		m.registry.MustRegister(m.requests, m.requestDuration, m.requestsInFlight)
+	}
+
+	if !config.EndpointDisabled {
+		m.endpointRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "endpoint", Name: "requests_total",
+			Help: "Number of requests by endpoint.",
+		}, statusLabels)
+		m.endpointDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "endpoint", Name: "request_duration_seconds",
+			Help: "Duration of the requests by endpoint.", Buckets: prometheus.DefBuckets,
+		}, statusLabels)
+		m.endpointInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "endpoint", Name: "requests_in_flight",
+			Help: "Number of requests being served by endpoint.",
+		}, endpointLabels)
+		m.endpointResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "endpoint", Name: "response_size_bytes",
+			Help: "Size of the responses by endpoint.", Buckets: prometheus.ExponentialBuckets(100, 10, 6),
+		}, statusLabels)
+		m.registry.MustRegister(m.endpointRequests, m.endpointDuration, m.endpointInFlight, m.endpointResponseSize)
+	}
+
+	if !config.ProxyDisabled {
+		m.filterRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "filter", Name: "rejections_total",
+			Help: "Number of requests rejected by a filter, ex: auth failures by reason, rate limiting.",
+		}, append(endpointLabels, "filter", "status", "reason"))
+		m.registry.MustRegister(m.filterRejections)
+	}
+
+	if !config.BackendDisabled {
+		m.upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "upstream", Name: "round_trip_duration_seconds",
+			Help: "Duration of the round trips to the upstream services.", Buckets: prometheus.DefBuckets,
+		}, append(endpointLabels, "method", "status"))
+		m.natsPublishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "nats", Name: "publish_duration_seconds",
+			Help: "Duration of the NATS publishing by outcome.", Buckets: prometheus.DefBuckets,
+		}, []string{"topic", "outcome"})
+		m.registry.MustRegister(m.upstreamDuration, m.natsPublishDuration)
+	}
+
+	return m
+}
+
+//Handler serves the metrics in the Prometheus format
+func Handler(m *Metrics) http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+//ListenAndServe starts the /metrics listener, if enabled
+func ListenAndServe(m *Metrics) error {
+	if !m.config.Enabled {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(m))
+	srv := &http.Server{
+		Addr:    listenAddress(m.config.ListenAddress),
+		Handler: mux,
+	}
+
+	idleConnsClosed := make(chan struct{})
+	m.closer = func() error {
+		err := srv.Shutdown(context.Background())
+		close(idleConnsClosed)
+		return err
+	}
+
+	m.loggerFactory(nil).Info("Metrics: listening", zap.String("address", srv.Addr))
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-idleConnsClosed
+	return nil
+}
+
+//Shutdown stops the /metrics listener
+func Shutdown(m *Metrics) error {
+	return m.closer()
+}
+
+//listenAddress accepts a port alone, as in config.json
+func listenAddress(address string) string {
+	if !strings.Contains(address, ":") {
+		return ":" + address
+	}
+	return address
+}
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var endpoint = abstraction.Endpoint{
+	ServiceName:          "offers-api",
+	HandlerType:          "reverseproxy",
+	DownstreamPathPrefix: "/offers",
+	DownstreamPath:       "/{id}",
+}
+
+var loggerFactory = log.ZapLoggerFactory(zap.NewNop())
+
+//rejectWith is a filter which rejects the requests with the status
+func rejectWith(status int, header string) middleware.Func {
+	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if status == http.StatusOK {
+					next.ServeHTTP(w, r)
+					return
+				}
+				if header != "" {
+					w.Header().Set("WWW-Authenticate", header)
+				}
+				w.WriteHeader(status)
+			})
+		}
+	}
+}
+
+func newTestHandler(m *Metrics, filter middleware.Func, upstream http.Handler) http.Handler {
+	filter = MiddlewareWrapper(m, "auth")(filter)
+	return EndpointMetrics(m)(endpoint, loggerFactory)(filter(endpoint, loggerFactory)(upstream))
+}
+
+func serve(handler http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/offers/1", nil))
+	return w
+}
+
+func TestEndpointMetrics(t *testing.T) {
+	m := NewMetrics(Config{Enabled: true}, loggerFactory)
+	handler := newTestHandler(m, rejectWith(http.StatusOK, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("offer"))
+	}))
+
+	serve(handler)
+	serve(handler)
+
+	if count := testutil.ToFloat64(m.endpointRequests.WithLabelValues("/offers/{id}", "offers-api", "reverseproxy", "200")); count != 2 {
+		t.Errorf("expected 2 requests, but got %v", count)
+	}
+	if count := testutil.CollectAndCount(m.endpointResponseSize); count != 1 {
+		t.Errorf("expected a response size series, but got %v", count)
+	}
+	if inFlight := testutil.ToFloat64(m.endpointInFlight.WithLabelValues("/offers/{id}", "offers-api", "reverseproxy")); inFlight != 0 {
+		t.Errorf("expected no request in flight, but got %v", inFlight)
+	}
+	if count := testutil.CollectAndCount(m.filterRejections); count != 0 {
+		t.Errorf("expected no rejection, but got %v", count)
+	}
+}
+
+func TestFilterRejections(t *testing.T) {
+	m := NewMetrics(Config{Enabled: true}, loggerFactory)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	serve(newTestHandler(m, rejectWith(http.StatusUnauthorized, `Bearer error="invalid_token", error_description="expired"`), upstream))
+	serve(newTestHandler(m, rejectWith(http.StatusForbidden, ""), upstream))
+
+	expected := `
+		# HELP bifrost_filter_rejections_total Number of requests rejected by a filter, ex: auth failures by reason, rate limiting.
+		# TYPE bifrost_filter_rejections_total counter
+		bifrost_filter_rejections_total{filter="auth",handler_type="reverseproxy",reason="forbidden",route="/offers/{id}",service="offers-api",status="403"} 1
+		bifrost_filter_rejections_total{filter="auth",handler_type="reverseproxy",reason="invalid_token",route="/offers/{id}",service="offers-api",status="401"} 1
+	`
+	if err := testutil.CollectAndCompare(m.filterRejections, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	if count := testutil.ToFloat64(m.endpointRequests.WithLabelValues("/offers/{id}", "offers-api", "reverseproxy", "401")); count != 1 {
+		t.Errorf("expected the rejected request to be measured by the endpoint, but got %v", count)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	m := NewMetrics(Config{Enabled: true}, loggerFactory)
+	client := &http.Client{Transport: NewRoundTripper(m, http.DefaultTransport)}
+	handler := EndpointMetrics(m)(endpoint, loggerFactory)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), "GET", upstream.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+	}))
+
+	serve(handler)
+
+	expected := `bifrost_upstream_round_trip_duration_seconds_count{handler_type="reverseproxy",method="GET",route="/offers/{id}",service="offers-api",status="202"} 1`
+	if body := serve(Handler(m)).Body.String(); !strings.Contains(body, expected) {
+		t.Errorf("expected the round trip to be measured, but got %v", body)
+	}
+}
+
+func TestNatsPublishObserver(t *testing.T) {
+	m := NewMetrics(Config{Enabled: true}, loggerFactory)
+	observe := NatsPublishObserver(m)
+
+	observe(context.Background(), "offers", time.Millisecond, nil)
+	observe(context.Background(), "offers", time.Second, context.DeadlineExceeded)
+	observe(context.Background(), "offers", time.Millisecond, errors.New("nats: connection closed"))
+
+	if count := testutil.CollectAndCount(m.natsPublishDuration); count != 3 {
+		t.Errorf("expected a series for each outcome, but got %v", count)
+	}
+}
+
+func TestDisabledMetrics(t *testing.T) {
+	m := NewMetrics(Config{Enabled: true, EndpointDisabled: true, ProxyDisabled: true, BackendDisabled: true, RouterDisabled: true}, loggerFactory)
+	if m.endpointRequests != nil || m.filterRejections != nil || m.upstreamDuration != nil || m.requests != nil {
+		t.Fatal("expected the disabled collectors not to be created")
+	}
+	handler := newTestHandler(m, rejectWith(http.StatusUnauthorized, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if code := serve(RouterWrapper(m)(handler)).Code; code != http.StatusUnauthorized {
+		t.Errorf("expected the requests to be served, but got %v", code)
+	}
+	NatsPublishObserver(m)(context.Background(), "offers", time.Millisecond, nil)
+
+	m = NewMetrics(Config{}, loggerFactory)
+	if err := ListenAndServe(m); err != nil {
+		t.Errorf("expected the listener not to start, but got %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := NewMetrics(Config{Enabled: true}, loggerFactory)
+	serve(RouterWrapper(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	w := serve(Handler(m))
+	if !strings.Contains(w.Body.String(), `bifrost_router_requests_total{code="200",method="get"} 1`) {
+		t.Errorf("expected the router metrics to be served, but got %v", w.Body.String())
+	}
+}
@@ -36,7 +36,7 @@ type AuthorizationEndpointOptions struct {
 //an OpendID Connect server
 func AuthorizationFilter(opts AuthorizationOptions) middleware.Func {
 	if opts.SecretProvider == nil {
-		opts.SecretProvider = oidc.NewOidcSecretProvider(discovery.NewClient(discovery.Options{opts.Authority}))
+		opts.SecretProvider = oidc.NewOidcSecretProvider(discovery.NewClient(discovery.Options{Authority: opts.Authority}))
 	}
 
 	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
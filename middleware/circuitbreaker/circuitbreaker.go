@@ -0,0 +1,228 @@
+package circuitbreaker
+
+import (
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/httputils"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//CircuitBreakerFilterCode is the code used to register this middleware
+const CircuitBreakerFilterCode = "circuit_breaker"
+
+//Options are the options configured for all endpoints, each endpoint can override them
+type Options struct {
+	Enabled bool `mapstructure:"enabled"`
+	//Window is the period over which the requests are counted
+	Window time.Duration `mapstructure:"window"`
+	//MinimumRequests is the number of requests needed in a window before the circuit can open
+	MinimumRequests int `mapstructure:"minimum_requests"`
+	//FailureRatio opens the circuit when reached by the ratio of 5xx responses
+	FailureRatio float64 `mapstructure:"failure_ratio"`
+	//SlowCallDuration is the duration after which a request is considered slow
+	SlowCallDuration time.Duration `mapstructure:"slow_call_duration"`
+	//SlowCallRatio opens the circuit when reached by the ratio of slow requests
+	SlowCallRatio float64 `mapstructure:"slow_call_ratio"`
+	//OpenDuration is how long the circuit stays open before letting probe requests through
+	OpenDuration time.Duration `mapstructure:"open_duration"`
+	//HalfOpenRequests is the number of successful probe requests needed to close the circuit
+	HalfOpenRequests int `mapstructure:"half_open_requests"`
+}
+
+const (
+	closed   = "closed"
+	open     = "open"
+	halfOpen = "half_open"
+)
+
+var defaultOptions = Options{
+	Window:           10 * time.Second,
+	MinimumRequests:  20,
+	FailureRatio:     0.5,
+	SlowCallRatio:    1,
+	OpenDuration:     30 * time.Second,
+	HalfOpenRequests: 1,
+}
+
+//CircuitBreakerFilter is a middleware that stops calling an endpoint that fails or responds slowly.
+//While the circuit is open the requests fail fast with StatusServiceUnavailable,
+//then a few probe requests are let through to check if the endpoint recovered
+func CircuitBreakerFilter(options Options) middleware.Func {
+	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		cfg := options
+		if fl, ok := endpoint.Filters[CircuitBreakerFilterCode]; ok {
+			err := middleware.DecodeEndpointOptions(fl, &cfg)
+			if err != nil {
+				loggerFactory(nil).Error("CircuitBreakerFilter: Cannot decode the endpoint options for circuit breaker filter", zap.Error(err))
+			}
+		}
+
+		//the breaker is shared by all the requests of the endpoint
+		var endpointBreaker *breaker
+		if cfg.Enabled {
+			endpointBreaker = newBreaker(withDefaults(cfg))
+		}
+
+		return func(next http.Handler) http.Handler {
+			if !cfg.Enabled {
+				return next
+			}
+
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				logger := loggerFactory(request.Context()).With(zap.String("upstream_url", endpoint.UpstreamURL))
+
+				generation, ok, retryAfter := endpointBreaker.allow(time.Now(), logger)
+				if !ok {
+					logger.Debug("CircuitBreakerFilter: circuit is open, request rejected")
+					writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+					return
+				}
+
+				start := time.Now()
+				sw := httputils.NewStatusRecorder(writer)
+				completed := false
+				defer func() {
+					//a panic is a failure as well
+					endpointBreaker.done(generation, time.Now(), completed && sw.Status < 500, time.Since(start), logger)
+				}()
+
+				next.ServeHTTP(sw, request)
+				completed = true
+			})
+		}
+	}
+}
+
+func withDefaults(options Options) Options {
+	if options.Window <= 0 {
+		options.Window = defaultOptions.Window
+	}
+	if options.MinimumRequests <= 0 {
+		options.MinimumRequests = defaultOptions.MinimumRequests
+	}
+	if options.FailureRatio <= 0 {
+		options.FailureRatio = defaultOptions.FailureRatio
+	}
+	if options.SlowCallRatio <= 0 {
+		options.SlowCallRatio = defaultOptions.SlowCallRatio
+	}
+	if options.OpenDuration <= 0 {
+		options.OpenDuration = defaultOptions.OpenDuration
+	}
+	if options.HalfOpenRequests <= 0 {
+		options.HalfOpenRequests = defaultOptions.HalfOpenRequests
+	}
+	return options
+}
+
+//breaker is the state of the circuit of an endpoint
+type breaker struct {
+	options     Options
+	mutex       sync.Mutex
+	state       string
+	generation  int
+	windowStart time.Time
+	requests    int
+	failures    int
+	slowCalls   int
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+func newBreaker(options Options) *breaker {
+	return &breaker{options: options, state: closed}
+}
+
+//allow tells if a request can go through, or else how long until the circuit half-opens.
+//The generation of the state is returned so that the outcome of the request is ignored if the state changed meanwhile
+func (b *breaker) allow(now time.Time, logger log.Logger) (int, bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case open:
+		if wait := b.openedAt.Add(b.options.OpenDuration).Sub(now); wait > 0 {
+			return b.generation, false, wait
+		}
+		b.transition(halfOpen, now, logger)
+		fallthrough
+	case halfOpen:
+		if b.probes >= b.options.HalfOpenRequests {
+			return b.generation, false, b.options.OpenDuration
+		}
+		b.probes++
+	}
+	return b.generation, true, 0
+}
+
+//done records the outcome of a request that went through
+func (b *breaker) done(generation int, now time.Time, success bool, duration time.Duration, logger log.Logger) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	slow := b.options.SlowCallDuration > 0 && duration >= b.options.SlowCallDuration
+
+	switch b.state {
+	case halfOpen:
+		b.probes--
+		if !success || slow {
+			b.transition(open, now, logger, zap.Bool("success", success), zap.Duration("duration", duration))
+			return
+		}
+		b.successes++
+		if b.successes >= b.options.HalfOpenRequests {
+			b.transition(closed, now, logger)
+		}
+	case closed:
+		if now.Sub(b.windowStart) >= b.options.Window {
+			b.windowStart, b.requests, b.failures, b.slowCalls = now, 0, 0, 0
+		}
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if slow {
+			b.slowCalls++
+		}
+		if b.requests < b.options.MinimumRequests {
+			return
+		}
+
+		failureRatio := float64(b.failures) / float64(b.requests)
+		slowCallRatio := float64(b.slowCalls) / float64(b.requests)
+		if failureRatio >= b.options.FailureRatio || (b.slowCalls > 0 && slowCallRatio >= b.options.SlowCallRatio) {
+			b.transition(open, now, logger,
+				zap.Int("requests", b.requests), zap.Float64("failure_ratio", failureRatio), zap.Float64("slow_call_ratio", slowCallRatio))
+		}
+	}
+}
+
+func (b *breaker) transition(state string, now time.Time, logger log.Logger, fields ...zap.Field) {
+	fields = append(fields, zap.String("from", b.state), zap.String("to", state))
+	b.state = state
+	b.generation++
+	b.probes, b.successes = 0, 0
+
+	switch state {
+	case open:
+		b.openedAt = now
+		logger.Warn("CircuitBreakerFilter: circuit opened", fields...)
+	case halfOpen:
+		logger.Info("CircuitBreakerFilter: circuit half-opened", fields...)
+	case closed:
+		b.windowStart, b.requests, b.failures, b.slowCalls = now, 0, 0, 0
+		logger.Info("CircuitBreakerFilter: circuit closed", fields...)
+	}
+}
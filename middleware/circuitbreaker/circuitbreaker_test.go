@@ -0,0 +1,120 @@
+package circuitbreaker
+
+import (
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var options = Options{
+	Enabled:          true,
+	Window:           time.Minute,
+	MinimumRequests:  4,
+	FailureRatio:     0.5,
+	OpenDuration:     50 * time.Millisecond,
+	HalfOpenRequests: 2,
+}
+
+type testUpstream struct {
+	status atomic.Int32
+	delay  atomic.Int64
+	calls  atomic.Int32
+}
+
+func (u *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.calls.Add(1)
+	time.Sleep(time.Duration(u.delay.Load()))
+	w.WriteHeader(int(u.status.Load()))
+}
+
+func newTestFilter(options Options, endpoint abstraction.Endpoint) (http.Handler, *testUpstream) {
+	upstream := new(testUpstream)
+	upstream.status.Store(http.StatusOK)
+	return CircuitBreakerFilter(options)(endpoint, log.ZapLoggerFactory(zap.NewNop()))(upstream), upstream
+}
+
+func serve(handler http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/offers", nil))
+	return w
+}
+
+func TestCircuitBreakerFilter(t *testing.T) {
+	filter, upstream := newTestFilter(options, abstraction.Endpoint{})
+
+	upstream.status.Store(http.StatusBadGateway)
+	for i := 0; i < 4; i++ {
+		if code := serve(filter).Code; code != http.StatusBadGateway {
+			t.Fatalf("expected status %v, but got %v", http.StatusBadGateway, code)
+		}
+	}
+
+	w := serve(filter)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected the open circuit to fail fast, but got %v with Retry-After %v", w.Code, w.Header().Get("Retry-After"))
+	}
+	if calls := upstream.calls.Load(); calls != 4 {
+		t.Fatalf("expected the upstream not to be called, but got %v calls", calls)
+	}
+
+	//a failed probe opens the circuit again
+	time.Sleep(options.OpenDuration)
+	if code := serve(filter).Code; code != http.StatusBadGateway {
+		t.Fatalf("expected the probe to reach the upstream, but got %v", code)
+	}
+	if code := serve(filter).Code; code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the circuit to open again, but got %v", code)
+	}
+
+	time.Sleep(options.OpenDuration)
+	upstream.status.Store(http.StatusOK)
+	for i := 0; i < options.HalfOpenRequests+5; i++ {
+		if code := serve(filter).Code; code != http.StatusOK {
+			t.Fatalf("expected the circuit to close, but got %v", code)
+		}
+	}
+}
+
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	slowOptions := options
+	slowOptions.SlowCallDuration = 10 * time.Millisecond
+	slowOptions.SlowCallRatio = 0.5
+	filter, upstream := newTestFilter(slowOptions, abstraction.Endpoint{})
+
+	upstream.delay.Store(int64(20 * time.Millisecond))
+	for i := 0; i < 4; i++ {
+		serve(filter)
+	}
+	if code := serve(filter).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("expected slow calls to open the circuit, but got %v", code)
+	}
+}
+
+func TestCircuitBreakerEndpointOptions(t *testing.T) {
+	endpoint := abstraction.Endpoint{Filters: map[string]interface{}{
+		CircuitBreakerFilterCode: map[string]interface{}{"enabled": false},
+	}}
+	filter, upstream := newTestFilter(options, endpoint)
+
+	upstream.status.Store(http.StatusInternalServerError)
+	for i := 0; i < 10; i++ {
+		if code := serve(filter).Code; code != http.StatusInternalServerError {
+			t.Fatalf("expected the filter to be disabled, but got %v", code)
+		}
+	}
+
+	endpoint.Filters[CircuitBreakerFilterCode] = map[string]interface{}{"minimum_requests": 2, "open_duration": "1m"}
+	filter, upstream = newTestFilter(options, endpoint)
+	upstream.status.Store(http.StatusInternalServerError)
+	serve(filter)
+	serve(filter)
+	w := serve(filter)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected the endpoint options to open the circuit for 1m, but got %v with Retry-After %v", w.Code, w.Header().Get("Retry-After"))
+	}
+}
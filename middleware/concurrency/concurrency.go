@@ -0,0 +1,225 @@
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/httputils"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"go.uber.org/zap"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//ConcurrencyFilterCode is the code used to register this middleware
+const ConcurrencyFilterCode = "concurrency"
+
+//Options are the options configured for all endpoints, each endpoint can override them
+type Options struct {
+	Enabled bool `mapstructure:"enabled"`
+	//MaxConcurrency is the number of requests handled at once by an endpoint
+	MaxConcurrency int `mapstructure:"max_concurrency"`
+	//QueueSize is the number of requests waiting for a free slot, the other ones are rejected
+	QueueSize int `mapstructure:"queue_size"`
+	//QueueTimeout is how long a request waits for a free slot
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+	//Adaptive lowers the limit when the latency of the endpoint grows, and raises it back up to MaxConcurrency
+	//while the latency stays low (additive increase, multiplicative decrease)
+	Adaptive bool `mapstructure:"adaptive"`
+	//MinConcurrency is the lowest adaptive limit
+	MinConcurrency int `mapstructure:"min_concurrency"`
+	//LatencyTolerance decreases the adaptive limit when the recent latency is this many times the usual latency
+	LatencyTolerance float64 `mapstructure:"latency_tolerance"`
+	//BackoffRatio multiplies the adaptive limit when it decreases
+	BackoffRatio float64 `mapstructure:"backoff_ratio"`
+}
+
+var defaultOptions = Options{
+	MaxConcurrency:   100,
+	QueueTimeout:     time.Second,
+	MinConcurrency:   1,
+	LatencyTolerance: 2,
+	BackoffRatio:     0.9,
+}
+
+const (
+	//recentWeight is the weight of a sample in the recent latency
+	recentWeight = 0.2
+	//usualWeight is the weight of a sample in the usual latency
+	usualWeight = 0.01
+)
+
+//ConcurrencyFilter is a middleware that limits the number of requests handled at once by an endpoint.
+//The excess requests wait in a bounded queue, then they are shed with StatusServiceUnavailable
+func ConcurrencyFilter(options Options) middleware.Func {
+	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		cfg := options
+		if fl, ok := endpoint.Filters[ConcurrencyFilterCode]; ok {
+			err := middleware.DecodeEndpointOptions(fl, &cfg)
+			if err != nil {
+				loggerFactory(nil).Error("ConcurrencyFilter: Cannot decode the endpoint options for concurrency filter", zap.Error(err))
+			}
+		}
+
+		//the limiter is shared by all the requests of the endpoint
+		var endpointLimiter *limiter
+		if cfg.Enabled {
+			endpointLimiter = newLimiter(withDefaults(cfg))
+		}
+
+		return func(next http.Handler) http.Handler {
+			if !cfg.Enabled {
+				return next
+			}
+
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				if !endpointLimiter.acquire(request.Context()) {
+					loggerFactory(request.Context()).Debug("ConcurrencyFilter: too many requests in flight, request shed",
+						zap.String("upstream_url", endpoint.UpstreamURL), zap.Int("limit", endpointLimiter.currentLimit()))
+					http.Error(writer, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+					return
+				}
+
+				start := time.Now()
+				sw := httputils.NewStatusRecorder(writer)
+				completed := false
+				defer func() {
+					//a panic is a failure as well
+					endpointLimiter.release(time.Since(start), !completed || sw.Status >= 500)
+				}()
+
+				next.ServeHTTP(sw, request)
+				completed = true
+			})
+		}
+	}
+}
+
+func withDefaults(options Options) Options {
+	if options.MaxConcurrency <= 0 {
+		options.MaxConcurrency = defaultOptions.MaxConcurrency
+	}
+	if options.QueueTimeout <= 0 {
+		options.QueueTimeout = defaultOptions.QueueTimeout
+	}
+	if options.MinConcurrency <= 0 {
+		options.MinConcurrency = defaultOptions.MinConcurrency
+	}
+	if options.MinConcurrency > options.MaxConcurrency {
+		options.MinConcurrency = options.MaxConcurrency
+	}
+	if options.LatencyTolerance <= 1 {
+		options.LatencyTolerance = defaultOptions.LatencyTolerance
+	}
+	if options.BackoffRatio <= 0 || options.BackoffRatio >= 1 {
+		options.BackoffRatio = defaultOptions.BackoffRatio
+	}
+	return options
+}
+
+//limiter counts the requests in flight of an endpoint and queues the ones over the limit
+type limiter struct {
+	options  Options
+	mutex    sync.Mutex
+	limit    float64
+	inFlight int
+	waiting  *list.List
+	//recent and usual are moving averages of the latency, over the last requests and over a long period
+	recent       float64
+	usual        float64
+	lastDecrease time.Time
+}
+
+func newLimiter(options Options) *limiter {
+	return &limiter{options: options, limit: float64(options.MaxConcurrency), waiting: list.New()}
+}
+
+//acquire takes a slot for a request, waiting in the queue if needed.
+//It returns false when the queue is full, or when the wait timed out or was canceled
+func (l *limiter) acquire(ctx context.Context) bool {
+	l.mutex.Lock()
+	if l.inFlight < l.currentLimitLocked() && l.waiting.Len() == 0 {
+		l.inFlight++
+		l.mutex.Unlock()
+		return true
+	}
+	if l.waiting.Len() >= l.options.QueueSize {
+		l.mutex.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	element := l.waiting.PushBack(ready)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(l.options.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-ready:
+		//the slot was given meanwhile
+		return true
+	default:
+		l.waiting.Remove(element)
+		return false
+	}
+}
+
+//release frees the slot of a request and adapts the limit to its outcome
+func (l *limiter) release(latency time.Duration, failed bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.options.Adaptive {
+		l.adapt(latency, failed)
+	}
+	l.inFlight--
+	for l.waiting.Len() > 0 && l.inFlight < l.currentLimitLocked() {
+		l.inFlight++
+		close(l.waiting.Remove(l.waiting.Front()).(chan struct{}))
+	}
+}
+
+//adapt decreases the limit when a request failed or the latency grows, at most once per recent latency,
+//otherwise it increases the limit by one every limit requests while the endpoint is busy
+func (l *limiter) adapt(latency time.Duration, failed bool) {
+	sample := float64(latency)
+	if l.usual == 0 {
+		l.recent, l.usual = sample, sample
+	}
+	l.recent += recentWeight * (sample - l.recent)
+	l.usual += usualWeight * (sample - l.usual)
+
+	now := time.Now()
+	if failed || l.recent > l.usual*l.options.LatencyTolerance {
+		if now.Sub(l.lastDecrease) >= time.Duration(l.recent) {
+			l.limit = math.Max(float64(l.options.MinConcurrency), l.limit*l.options.BackoffRatio)
+			l.lastDecrease = now
+		}
+		return
+	}
+	if float64(l.inFlight) >= l.limit/2 {
+		l.limit = math.Min(float64(l.options.MaxConcurrency), l.limit+1/l.limit)
+	}
+}
+
+func (l *limiter) currentLimit() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.currentLimitLocked()
+}
+
+func (l *limiter) currentLimitLocked() int {
+	return int(l.limit)
+}
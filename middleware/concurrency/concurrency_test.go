@@ -0,0 +1,154 @@
+package concurrency
+
+import (
+	"context"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//blockingUpstream holds the requests until it is released
+type blockingUpstream struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (u *blockingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.started <- struct{}{}
+	<-u.release
+}
+
+func newTestFilter(options Options, endpoint abstraction.Endpoint) (http.Handler, *blockingUpstream) {
+	upstream := &blockingUpstream{started: make(chan struct{}, 10), release: make(chan struct{})}
+	return ConcurrencyFilter(options)(endpoint, log.ZapLoggerFactory(zap.NewNop()))(upstream), upstream
+}
+
+//serveAsync serves a request in the background and returns its status
+func serveAsync(handler http.Handler) <-chan int {
+	code := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/offers", nil))
+		code <- w.Code
+	}()
+	return code
+}
+
+func TestConcurrencyFilter(t *testing.T) {
+	filter, upstream := newTestFilter(Options{Enabled: true, MaxConcurrency: 2}, abstraction.Endpoint{})
+
+	first, second := serveAsync(filter), serveAsync(filter)
+	<-upstream.started
+	<-upstream.started
+
+	if code := <-serveAsync(filter); code != http.StatusServiceUnavailable {
+		t.Errorf("expected the request over the limit to be shed, but got %v", code)
+	}
+
+	close(upstream.release)
+	if <-first != http.StatusOK || <-second != http.StatusOK {
+		t.Error("expected the requests in flight to succeed")
+	}
+}
+
+func TestConcurrencyFilterQueue(t *testing.T) {
+	filter, upstream := newTestFilter(Options{Enabled: true, MaxConcurrency: 1, QueueSize: 1, QueueTimeout: time.Second}, abstraction.Endpoint{})
+
+	first := serveAsync(filter)
+	<-upstream.started
+	queued := serveAsync(filter)
+	time.Sleep(20 * time.Millisecond)
+
+	if code := <-serveAsync(filter); code != http.StatusServiceUnavailable {
+		t.Errorf("expected the request to be shed when the queue is full, but got %v", code)
+	}
+
+	upstream.release <- struct{}{}
+	<-upstream.started
+	upstream.release <- struct{}{}
+	if <-first != http.StatusOK || <-queued != http.StatusOK {
+		t.Error("expected the queued request to be served when a slot is freed")
+	}
+}
+
+func TestConcurrencyFilterQueueTimeout(t *testing.T) {
+	filter, upstream := newTestFilter(Options{Enabled: true, MaxConcurrency: 1, QueueSize: 1, QueueTimeout: 20 * time.Millisecond}, abstraction.Endpoint{})
+
+	first := serveAsync(filter)
+	<-upstream.started
+
+	start := time.Now()
+	if code := <-serveAsync(filter); code != http.StatusServiceUnavailable || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("expected the request to be shed after the queue timeout, but got %v after %v", code, time.Since(start))
+	}
+
+	close(upstream.release)
+	<-first
+}
+
+func TestConcurrencyFilterDisabledForEndpoint(t *testing.T) {
+	endpoint := abstraction.Endpoint{Filters: map[string]interface{}{
+		ConcurrencyFilterCode: map[string]interface{}{"enabled": false},
+	}}
+	filter, upstream := newTestFilter(Options{Enabled: true, MaxConcurrency: 1}, endpoint)
+
+	first, second := serveAsync(filter), serveAsync(filter)
+	<-upstream.started
+	<-upstream.started
+	close(upstream.release)
+	if <-first != http.StatusOK || <-second != http.StatusOK {
+		t.Error("expected the filter to be disabled for the endpoint")
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	l := newLimiter(withDefaults(Options{Adaptive: true, MaxConcurrency: 10, MinConcurrency: 2}))
+	run := func(n int, latency time.Duration, failed bool) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			if !l.acquire(context.Background()) {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.release(latency, failed)
+			}()
+		}
+		wg.Wait()
+	}
+
+	run(50, time.Millisecond, false)
+	if limit := l.currentLimit(); limit != 10 {
+		t.Fatalf("expected the limit to stay at the maximum, but got %v", limit)
+	}
+
+	for i := 0; i < 20; i++ {
+		run(1, 50*time.Millisecond, false)
+		time.Sleep(time.Millisecond)
+	}
+	if limit := l.currentLimit(); limit >= 10 {
+		t.Fatalf("expected the limit to decrease when the latency grows, but got %v", limit)
+	}
+
+	//the limit decreases at most once per recent latency
+	for i := 0; i < 100; i++ {
+		run(1, time.Millisecond, true)
+		time.Sleep(2 * time.Millisecond)
+	}
+	if limit := l.currentLimit(); limit != 2 {
+		t.Fatalf("expected the limit to decrease down to the minimum, but got %v", limit)
+	}
+
+	for i := 0; i < 200; i++ {
+		run(2, time.Millisecond, false)
+	}
+	if limit := l.currentLimit(); limit <= 2 {
+		t.Errorf("expected the limit to increase while the endpoint is busy and fast, but got %v", limit)
+	}
+}
@@ -0,0 +1,93 @@
+package correlation
+
+import (
+	"context"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/httputils"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+//DefaultHeader is the header of the correlation id by default
+const DefaultHeader = "X-Correlation-ID"
+
+//maxLength is the length of the longest correlation id accepted from the clients
+const maxLength = 128
+
+//Options are the options of the correlation id
+type Options struct {
+	Enabled bool `mapstructure:"enabled"`
+	//Header is the request and response header of the correlation id
+	Header string `mapstructure:"header"`
+}
+
+//Handler reads the correlation id from the request header, or creates one.
+//It wraps the router, so that the id is in the fields of the router logs and of the access log.
+//The id is put in the request context, forwarded to the upstream services and echoed in the response
+func Handler(options Options) func(inner http.Handler) http.Handler {
+	header := options.Header
+	if header == "" {
+		header = DefaultHeader
+	}
+
+	return func(inner http.Handler) http.Handler {
+		if !options.Enabled {
+			return inner
+		}
+
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			id := request.Header.Get(header)
+			if id == "" || len(id) > maxLength {
+				id = uuid.Must(uuid.NewV4()).String()
+				request.Header.Set(header, id)
+			}
+
+			ctx := context.WithValue(request.Context(), abstraction.ContextCorrelationIdKey, id)
+			writer.Header().Set(header, id)
+			inner.ServeHTTP(&responseWriter{StatusRecorder: httputils.NewStatusRecorder(writer), header: header, id: id}, request.WithContext(ctx))
+		})
+	}
+}
+
+//FromContext returns the correlation id of the request, if any
+func FromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	id, ok := ctx.Value(abstraction.ContextCorrelationIdKey).(string)
+	return id, ok
+}
+
+//LoggerFactory adds the correlation id of the request to the log fields
+func LoggerFactory(inner log.Factory) log.Factory {
+	return func(ctx context.Context) log.Logger {
+		logger := inner(ctx)
+		if id, ok := FromContext(ctx); ok {
+			return logger.With(zap.String("correlation_id", id))
+		}
+		return logger
+	}
+}
+
+//responseWriter echoes the correlation id in the response, replacing the one set by the upstream service if any
+type responseWriter struct {
+	*httputils.StatusRecorder
+	header string
+	id     string
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.WroteHeader {
+		w.Header().Set(w.header, w.id)
+	}
+	w.StatusRecorder.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.WroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.StatusRecorder.Write(b)
+}
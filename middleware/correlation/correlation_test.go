@@ -0,0 +1,88 @@
+package correlation
+
+import (
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	var forwarded, inContext string
+	h := Handler(Options{Enabled: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(DefaultHeader)
+		inContext, _ = FromContext(r.Context())
+		w.Header().Set(DefaultHeader, "set-by-upstream")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	req := httptest.NewRequest("GET", "/offers", nil)
+	req.Header.Set(DefaultHeader, "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if forwarded != "abc-123" || inContext != "abc-123" {
+		t.Errorf("expected the correlation id to be reused, but got %q forwarded and %q in context", forwarded, inContext)
+	}
+	if w.Header().Get(DefaultHeader) != "abc-123" {
+		t.Errorf("expected the correlation id to be echoed, but got %v", w.Header().Values(DefaultHeader))
+	}
+
+	req = httptest.NewRequest("GET", "/offers", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if _, err := uuid.FromString(forwarded); err != nil || inContext != forwarded || w.Header().Get(DefaultHeader) != forwarded {
+		t.Errorf("expected a new correlation id to be created, but got %q", forwarded)
+	}
+}
+
+func TestHandlerHeader(t *testing.T) {
+	var forwarded string
+	h := Handler(Options{Enabled: true, Header: "X-Request-ID"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Request-ID")
+	}))
+
+	req := httptest.NewRequest("GET", "/offers", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if forwarded != "abc-123" || w.Header().Get("X-Request-ID") != "abc-123" {
+		t.Errorf("expected the configured header to be used, but got %q", forwarded)
+	}
+}
+
+func TestHandlerDisabled(t *testing.T) {
+	h := Handler(Options{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := FromContext(r.Context()); ok {
+			t.Error("expected no correlation id when disabled")
+		}
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/offers", nil))
+	if w.Header().Get(DefaultHeader) != "" {
+		t.Error("expected no correlation id when disabled")
+	}
+}
+
+func TestLoggerFactory(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	loggerFactory := LoggerFactory(log.ZapLoggerFactory(zap.New(core)))
+	h := Handler(Options{Enabled: true})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			loggerFactory(r.Context()).Info("forwarding")
+		}))
+
+	req := httptest.NewRequest("GET", "/offers", nil)
+	req.Header.Set(DefaultHeader, "abc-123")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := logs.FilterField(zap.String("correlation_id", "abc-123")).All()
+	if len(entries) != 1 {
+		t.Errorf("expected the correlation id in the log fields, but got %v", logs.All())
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"github.com/mitchellh/mapstructure"
 	"github.com/osstotalsoft/bifrost/abstraction"
 	"github.com/osstotalsoft/bifrost/log"
 	"net/http"
@@ -18,3 +19,18 @@ func Compose(funcs ...func(f Func) Func) func(f Func) Func {
 		return m
 	}
 }
+
+//DecodeEndpointOptions overrides the options of a filter with the ones set on an endpoint.
+//The durations can be written as strings, ex: "10s". The maps and slices are replaced,
+//so that the options shared with the other endpoints are not changed
+func DecodeEndpointOptions(input interface{}, output interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		ZeroFields: true,
+		Result:     output,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
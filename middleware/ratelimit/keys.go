@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	//IPKey limits the requests by client IP
+	IPKey = "ip"
+	//ClaimKeyPrefix limits the requests by the value of a token claim, ex: claim:client_id
+	ClaimKeyPrefix = "claim:"
+	//HeaderKeyPrefix limits the requests by the value of a header, ex: header:X-Api-Key
+	HeaderKeyPrefix = "header:"
+)
+
+//keyFunc returns the key a request is limited by, and the value matched against the overrides
+type keyFunc func(r *http.Request) (key string, value string)
+
+//newKeyFunc creates the keyFunc for a key option.
+//When the claim or the header is missing from a request, the request is limited by client IP
+func newKeyFunc(key string, trustedProxies []string) (keyFunc, error) {
+	trusted, err := parseNetworks(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	byIP := func(r *http.Request) (string, string) {
+		ip := clientIP(r, trusted)
+		return IPKey + ":" + ip, ip
+	}
+
+	switch {
+	case key == "":
+		return func(r *http.Request) (string, string) {
+			return "", ""
+		}, nil
+	case key == IPKey:
+		return byIP, nil
+	case strings.HasPrefix(key, ClaimKeyPrefix):
+		claim := strings.TrimPrefix(key, ClaimKeyPrefix)
+		return func(r *http.Request) (string, string) {
+			if value := claimValue(r, claim); value != "" {
+				return key + ":" + value, value
+			}
+			return byIP(r)
+		}, nil
+	case strings.HasPrefix(key, HeaderKeyPrefix):
+		header := strings.TrimPrefix(key, HeaderKeyPrefix)
+		return func(r *http.Request) (string, string) {
+			if value := r.Header.Get(header); value != "" {
+				return key + ":" + value, value
+			}
+			return byIP(r)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown rate limiting key %q", key)
+}
+
+//clientIP returns the address of the client. The X-Forwarded-For hops are read from right to left
+//while they are added by trusted proxies, the first untrusted one is the client
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+//parseNetworks parses CIDRs or single addresses
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func claimValue(r *http.Request, claim string) string {
+	var claims map[string]interface{}
+	switch c := r.Context().Value(abstraction.ContextClaimsKey).(type) {
+	case jwt.MapClaims:
+		claims = c
+	case map[string]interface{}:
+		claims = c
+	}
+
+	if value, ok := claims[claim]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
@@ -5,27 +5,111 @@ import (
 	"github.com/osstotalsoft/bifrost/abstraction"
 	"github.com/osstotalsoft/bifrost/log"
 	"github.com/osstotalsoft/bifrost/middleware"
-	"golang.org/x/time/rate"
+	"go.uber.org/zap"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const RateLimitingFilterCode = "ratelimit"
+//RateLimitingFilterCode is the code used to register this middleware
+const RateLimitingFilterCode = "rate_limit"
 
 //DefaultGlobalRequestLimit defines max nr of request / route / second
 const DefaultGlobalRequestLimit = 5000
-const MaxRequestLimit = 10000
+
+//Options are the options configured for all endpoints, each endpoint can override them
+type Options struct {
+	Enabled bool `mapstructure:"enabled"`
+	//Limit is the number of requests allowed per second
+	Limit int `mapstructure:"limit"`
+	//Burst is the number of requests allowed at once, the limit by default
+	Burst int `mapstructure:"burst"`
+	//Key is what the requests are limited by: ip, claim:<name> or header:<name>.
+	//By default all the requests of an endpoint share the same limit
+	Key string `mapstructure:"key"`
+	//TrustedProxies are the addresses or CIDRs of the proxies whose X-Forwarded-For hops are trusted
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	//MaxKeys is the number of keys kept in memory for each endpoint
+	MaxKeys int `mapstructure:"max_keys"`
+	//Overrides are the limits of some key values, ex: the client_id of a partner.
+	//The values are matched case insensitively
+	Overrides map[string]LimitOptions `mapstructure:"overrides"`
+	//Store is where the limits are kept: memory, for each gateway replica, or redis, shared by all of them.
+	//It is configured for all endpoints
+	Store string       `mapstructure:"store"`
+	Redis RedisOptions `mapstructure:"redis"`
+}
+
+//LimitOptions are the limits of a key value
+type LimitOptions struct {
+	Limit int `mapstructure:"limit"`
+	Burst int `mapstructure:"burst"`
+}
+
+const (
+	//MemoryStoreType keeps the limits in the memory of each gateway replica
+	MemoryStoreType = "memory"
+	//RedisStoreType keeps the limits in Redis
+	RedisStoreType = "redis"
+)
 
 //RateLimiting is a middleware which can limit the number of request / route / second
-//and then return StatusTooManyRequests response if the limit is reached
-func RateLimiting(limit int) middleware.Func {
+//and then return StatusTooManyRequests response if the limit is reached.
+//The limits are kept in the store, or in memory for each endpoint if the store is nil
+func RateLimiting(options Options, store Store) middleware.Func {
 	return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
-		limiter := rate.NewLimiter(rate.Limit(limit), limit)
+		cfg := options
+		if fl, ok := endpoint.Filters[RateLimitingFilterCode]; ok {
+			err := middleware.DecodeEndpointOptions(fl, &cfg)
+			if err != nil {
+				loggerFactory(nil).Error("RateLimitingFilter: Cannot decode the endpoint options for rate limiting filter", zap.Error(err))
+			}
+		}
+		defaultLimits := withDefaults(LimitOptions{Limit: cfg.Limit, Burst: cfg.Burst}, DefaultGlobalRequestLimit)
+		overrides := map[string]LimitOptions{}
+		for value, limits := range cfg.Overrides {
+			overrides[strings.ToLower(value)] = withDefaults(limits, defaultLimits.Limit)
+		}
+
+		//the limits of the endpoint are kept across the requests
+		enabled := cfg.Enabled
+		keyOf, err := newKeyFunc(cfg.Key, cfg.TrustedProxies)
+		if enabled && err != nil {
+			loggerFactory(nil).Error("RateLimitingFilter: invalid options, the rate limiting filter is disabled", zap.Error(err))
+			enabled = false
+		}
+		endpointStore := store
+		if enabled && endpointStore == nil {
+			endpointStore = NewMemoryStore(cfg.MaxKeys)
+		}
+		prefix := endpointKey(endpoint)
 
 		return func(next http.Handler) http.Handler {
+			if !enabled {
+				return next
+			}
+
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				setResponseHeaders(limiter.Limit(), w, r)
+				key, value := keyOf(r)
+				limits, ok := overrides[strings.ToLower(value)]
+				if !ok || value == "" {
+					limits = defaultLimits
+				}
 
-				if limiter.Allow() == false {
+				res, err := endpointStore.Allow(r.Context(), prefix+key, limits, time.Now())
+				if err != nil {
+					loggerFactory(r.Context()).Error("RateLimitingFilter: cannot apply the rate limit, the request is allowed", zap.Error(err))
+					next.ServeHTTP(w, r)
+					return
+				}
+				setResponseHeaders(res, limits, w)
+
+				if !res.Allowed {
+					loggerFactory(r.Context()).Debug("RateLimitingFilter: rate limit exceeded",
+						zap.String("upstream_url", endpoint.UpstreamURL), zap.String("key", key))
+					w.Header().Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
 					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 					return
 				}
@@ -36,9 +120,42 @@ func RateLimiting(limit int) middleware.Func {
 	}
 }
 
-func setResponseHeaders(lmt rate.Limit, w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("X-Rate-Limit-Limit", fmt.Sprintf("%.2f", lmt))
-	w.Header().Add("X-Rate-Limit-Duration", "1")
-	w.Header().Add("X-Rate-Limit-Request-Forwarded-For", r.Header.Get("X-Forwarded-For"))
-	w.Header().Add("X-Rate-Limit-Request-Remote-Addr", r.RemoteAddr)
+//endpointKey identifies the endpoint in a store shared by several endpoints
+func endpointKey(endpoint abstraction.Endpoint) string {
+	return strings.Join(endpoint.Methods, ",") + " " + strings.Join(endpoint.Hosts, ",") + " " +
+		endpoint.DownstreamPathPrefix + endpoint.DownstreamPath + "|"
+}
+
+//NewStore creates the store configured in the options, or nil to keep the limits in memory for each endpoint
+func NewStore(options Options) (Store, error) {
+	switch options.Store {
+	case "", MemoryStoreType:
+		return nil, nil
+	case RedisStoreType:
+		return NewRedisStore(NewRedisClient(options.Redis), options.Redis.Prefix), nil
+	}
+	return nil, fmt.Errorf("unknown rate limiting store %q", options.Store)
+}
+
+func withDefaults(limits LimitOptions, defaultLimit int) LimitOptions {
+	if limits.Limit <= 0 {
+		limits.Limit = defaultLimit
+	}
+	if limits.Burst <= 0 {
+		limits.Burst = limits.Limit
+	}
+	return limits
+}
+
+//setResponseHeaders sets the RateLimit headers of the IETF draft "RateLimit header fields for HTTP"
+func setResponseHeaders(res Result, limits LimitOptions, w http.ResponseWriter) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+	w.Header().Set("RateLimit-Policy", strconv.Itoa(limits.Limit)+";w=1;burst="+strconv.Itoa(limits.Burst))
+}
+
+//seconds rounds up a duration to seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
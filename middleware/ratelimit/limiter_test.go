@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestFilter(options Options, endpoint abstraction.Endpoint) http.Handler {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	return RateLimiting(options, nil)(endpoint, log.ZapLoggerFactory(zap.NewNop()))(upstream)
+}
+
+func serve(handler http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/offers", nil))
+	return w
+}
+
+func TestRateLimiting(t *testing.T) {
+	filter := newTestFilter(Options{Enabled: true, Limit: 1, Burst: 3}, abstraction.Endpoint{})
+
+	for i := 0; i < 3; i++ {
+		w := serve(filter)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected the burst to be allowed, but got %v", w.Code)
+		}
+		if remaining := w.Header().Get("RateLimit-Remaining"); remaining != strconv.Itoa(2-i) {
+			t.Errorf("expected %v remaining requests, but got %v", 2-i, remaining)
+		}
+	}
+
+	w := serve(filter)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %v, but got %v", http.StatusTooManyRequests, w.Code)
+	}
+	expected := map[string]string{
+		"Retry-After":         "1",
+		"RateLimit-Limit":     "3",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "3",
+		"RateLimit-Policy":    "1;w=1;burst=3",
+	}
+	for header, value := range expected {
+		if w.Header().Get(header) != value {
+			t.Errorf("expected header %v to be %v, but got %v", header, value, w.Header().Get(header))
+		}
+	}
+}
+
+func TestRateLimitingEndpointOptions(t *testing.T) {
+	endpoint := abstraction.Endpoint{Filters: map[string]interface{}{
+		RateLimitingFilterCode: map[string]interface{}{"limit": 1},
+	}}
+	filter := newTestFilter(Options{Enabled: true, Limit: 100}, endpoint)
+
+	serve(filter)
+	if w := serve(filter); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the endpoint limit to be used, but got %v", w.Code)
+	}
+
+	endpoint.Filters[RateLimitingFilterCode] = map[string]interface{}{"enabled": false, "limit": 1}
+	filter = newTestFilter(Options{Enabled: true}, endpoint)
+	for i := 0; i < 5; i++ {
+		if w := serve(filter); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("expected the filter to be disabled for the endpoint, but got %v", w.Code)
+		}
+	}
+}
+
+func TestRateLimitingDisabled(t *testing.T) {
+	endpoint := abstraction.Endpoint{Filters: map[string]interface{}{
+		RateLimitingFilterCode: map[string]interface{}{"limit": 1},
+	}}
+	filter := newTestFilter(Options{Limit: 1}, endpoint)
+	for i := 0; i < 5; i++ {
+		if w := serve(filter); w.Code != http.StatusOK {
+			t.Fatalf("expected the filter to be disabled, but got %v", w.Code)
+		}
+	}
+}
+
+func serveFrom(handler http.Handler, remoteAddr string, setup func(r *http.Request)) int {
+	r := httptest.NewRequest("GET", "/offers", nil)
+	r.RemoteAddr = remoteAddr
+	if setup != nil {
+		setup(r)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRateLimitingByIP(t *testing.T) {
+	filter := newTestFilter(Options{Enabled: true, Limit: 1, Key: IPKey, TrustedProxies: []string{"10.0.0.0/8"}}, abstraction.Endpoint{})
+
+	serveFrom(filter, "192.168.0.1:5000", nil)
+	if code := serveFrom(filter, "192.168.0.1:5001", nil); code != http.StatusTooManyRequests {
+		t.Errorf("expected the client to be limited, but got %v", code)
+	}
+	if code := serveFrom(filter, "192.168.0.2:5000", nil); code != http.StatusOK {
+		t.Errorf("expected another client not to be limited, but got %v", code)
+	}
+
+	forwardedFor := func(xff string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+	}
+	if code := serveFrom(filter, "10.0.0.1:5000", forwardedFor("192.168.0.3, 10.0.0.2")); code != http.StatusOK {
+		t.Errorf("expected the forwarded client not to be limited, but got %v", code)
+	}
+	if code := serveFrom(filter, "10.0.0.5:5000", forwardedFor("192.168.0.3")); code != http.StatusTooManyRequests {
+		t.Errorf("expected the forwarded client to be limited, but got %v", code)
+	}
+	if code := serveFrom(filter, "192.168.0.4:5000", forwardedFor("192.168.0.5")); code != http.StatusOK {
+		t.Errorf("expected an untrusted X-Forwarded-For to be ignored, but got %v", code)
+	}
+	if code := serveFrom(filter, "192.168.0.4:5000", forwardedFor("192.168.0.6")); code != http.StatusTooManyRequests {
+		t.Errorf("expected an untrusted X-Forwarded-For to be ignored, but got %v", code)
+	}
+}
+
+func TestRateLimitingByClaim(t *testing.T) {
+	options := Options{
+		Enabled:   true,
+		Limit:     1,
+		Key:       "claim:client_id",
+		Overrides: map[string]LimitOptions{"partner": {Limit: 3}},
+	}
+	filter := newTestFilter(options, abstraction.Endpoint{})
+	client := func(id string) func(r *http.Request) {
+		return func(r *http.Request) {
+			claims := jwt.MapClaims{"client_id": id}
+			*r = *r.WithContext(context.WithValue(r.Context(), abstraction.ContextClaimsKey, claims))
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := serveFrom(filter, "192.168.0.1:5000", client("Partner")); code != http.StatusOK {
+			t.Fatalf("expected the override to allow 3 requests, but got %v", code)
+		}
+	}
+	if code := serveFrom(filter, "192.168.0.1:5000", client("Partner")); code != http.StatusTooManyRequests {
+		t.Errorf("expected the partner to be limited, but got %v", code)
+	}
+
+	serveFrom(filter, "192.168.0.1:5000", client("anonymous"))
+	if code := serveFrom(filter, "192.168.0.1:5000", client("anonymous")); code != http.StatusTooManyRequests {
+		t.Errorf("expected the default limit, but got %v", code)
+	}
+
+	//without claims, the requests are limited by IP
+	if code := serveFrom(filter, "192.168.0.1:5000", nil); code != http.StatusOK {
+		t.Errorf("expected the client IP not to be limited, but got %v", code)
+	}
+	if code := serveFrom(filter, "192.168.0.1:5000", nil); code != http.StatusTooManyRequests {
+		t.Errorf("expected the client IP to be limited, but got %v", code)
+	}
+}
+
+func TestRateLimitingByHeader(t *testing.T) {
+	filter := newTestFilter(Options{Enabled: true, Limit: 1, Key: "header:X-Api-Key"}, abstraction.Endpoint{})
+	apiKey := func(key string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set("X-Api-Key", key)
+		}
+	}
+
+	serveFrom(filter, "192.168.0.1:5000", apiKey("a"))
+	if code := serveFrom(filter, "192.168.0.2:5000", apiKey("a")); code != http.StatusTooManyRequests {
+		t.Errorf("expected the key to be limited, but got %v", code)
+	}
+	if code := serveFrom(filter, "192.168.0.1:5000", apiKey("b")); code != http.StatusOK {
+		t.Errorf("expected another key not to be limited, but got %v", code)
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryStore(2)
+	allow := func(key string) bool {
+		res, _ := store.Allow(context.Background(), key, LimitOptions{Limit: 1, Burst: 1}, time.Now())
+		return res.Allowed
+	}
+
+	allow("a")
+	allow("b")
+	allow("a")
+	allow("c")
+
+	if store.len() != 2 {
+		t.Fatalf("expected 2 keys, but got %v", store.len())
+	}
+	if allow("a") {
+		t.Error("expected the recently used key to be kept")
+	}
+	if !allow("b") {
+		t.Error("expected the least recently used key to be evicted")
+	}
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+//DefaultRedisPrefix is the prefix of the keys written to Redis by default
+const DefaultRedisPrefix = "bifrost:ratelimit:"
+
+//RedisOptions are the options of the Redis store
+type RedisOptions struct {
+	Address  string `mapstructure:"address"`
+	Password string `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
+	//Prefix is prepended to all the keys, so that several gateways can share the same Redis
+	Prefix string `mapstructure:"prefix"`
+}
+
+//gcraScript implements the generic cell rate algorithm. It stores for each key the theoretical arrival time,
+//the time when the bucket would be full again, in microseconds.
+//ARGV: the emission interval, the burst and the current time. It returns allowed, remaining, reset and retry after,
+//the durations are rounded up to milliseconds
+var gcraScript = redis.NewScript(`
+local emission = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if tat == nil or tat < now then
+	tat = now
+end
+
+local newTat = tat + emission
+local diff = now - (newTat - emission * burst)
+if diff < 0 then
+	return {0, 0, math.ceil((tat - now) / 1000), math.ceil(-diff / 1000)}
+end
+
+local ttl = math.ceil((newTat - now) / 1000)
+redis.call("SET", KEYS[1], string.format("%d", newTat), "PX", ttl)
+return {1, math.floor(diff / emission), ttl, 0}
+`)
+
+//RedisStore keeps the limits in Redis, so that they are shared by all the gateway replicas
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+//NewRedisStore creates a store which keeps the limits in Redis
+func NewRedisStore(client redis.UniversalClient, prefix string) *RedisStore {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+//NewRedisClient creates a Redis client for the options
+func NewRedisClient(options RedisOptions) redis.UniversalClient {
+	return redis.NewClient(&redis.Options{
+		Addr:     options.Address,
+		Password: options.Password,
+		DB:       options.DB,
+	})
+}
+
+//Allow takes a token for a request of the key.
+//The current time is sent by the gateway, so the clocks of the replicas should be synchronized
+func (s *RedisStore) Allow(ctx context.Context, key string, limits LimitOptions, now time.Time) (Result, error) {
+	emission := time.Second.Microseconds() / int64(limits.Limit)
+	if emission < 1 {
+		emission = 1
+	}
+
+	values, err := gcraScript.Run(ctx, s.client, []string{s.prefix + key}, emission, limits.Burst, now.UnixMicro()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    values[0] == 1,
+		Limit:      limits.Burst,
+		Remaining:  int(values[1]),
+		Reset:      time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
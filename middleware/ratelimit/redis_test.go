@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewRedisStore(client, ""), server
+}
+
+func TestRedisStore(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	limits := LimitOptions{Limit: 1, Burst: 3}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		res, err := store.Allow(context.Background(), "client", limits, now)
+		if err != nil || !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("expected the burst to be allowed with %v remaining, but got %+v, %v", 2-i, res, err)
+		}
+	}
+
+	res, _ := store.Allow(context.Background(), "client", limits, now)
+	expected := Result{Allowed: false, Limit: 3, Remaining: 0, Reset: 3 * time.Second, RetryAfter: time.Second}
+	if res != expected {
+		t.Errorf("expected %+v, but got %+v", expected, res)
+	}
+	if !server.Exists(DefaultRedisPrefix + "client") {
+		t.Errorf("expected the key to be prefixed")
+	}
+
+	res, _ = store.Allow(context.Background(), "client", limits, now.Add(time.Second))
+	if !res.Allowed || res.Remaining != 0 {
+		t.Errorf("expected a token to be refilled after a second, but got %+v", res)
+	}
+	res, _ = store.Allow(context.Background(), "client", limits, now.Add(10*time.Second))
+	if !res.Allowed || res.Remaining != 2 {
+		t.Errorf("expected the bucket to be full again, but got %+v", res)
+	}
+}
+
+func TestRedisStoreIsSharedByReplicas(t *testing.T) {
+	store, _ := newTestRedisStore(t)
+	endpoint := abstraction.Endpoint{DownstreamPath: "/offers"}
+	options := Options{Enabled: true, Limit: 1, Burst: 2}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	replica1 := RateLimiting(options, store)(endpoint, log.ZapLoggerFactory(zap.NewNop()))(upstream)
+	replica2 := RateLimiting(options, store)(endpoint, log.ZapLoggerFactory(zap.NewNop()))(upstream)
+	other := RateLimiting(options, store)(abstraction.Endpoint{DownstreamPath: "/users"}, log.ZapLoggerFactory(zap.NewNop()))(upstream)
+
+	serve(replica1)
+	serve(replica2)
+	if w := serve(replica1); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the limit to be shared by the replicas, but got %v", w.Code)
+	}
+	if w := serve(other); w.Code != http.StatusOK {
+		t.Errorf("expected another endpoint not to be limited, but got %v", w.Code)
+	}
+}
+
+func TestRedisStoreUnavailable(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	server.Close()
+
+	filter := RateLimiting(Options{Enabled: true, Limit: 1}, store)(abstraction.Endpoint{}, log.ZapLoggerFactory(zap.NewNop()))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		if w := serve(filter); w.Code != http.StatusOK {
+			t.Fatalf("expected the requests to be allowed when the store is unavailable, but got %v", w.Code)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"golang.org/x/time/rate"
+	"math"
+	"sync"
+	"time"
+)
+
+//DefaultMaxKeys is the number of keys kept in memory by default
+const DefaultMaxKeys = 10000
+
+//Store keeps the state of the limits, it can be shared by several endpoints or gateway replicas
+type Store interface {
+	//Allow takes a token for a request of the key
+	Allow(ctx context.Context, key string, limits LimitOptions, now time.Time) (Result, error)
+}
+
+//Result is the outcome of taking a token for a request
+type Result struct {
+	Allowed bool
+	//Limit is the number of requests allowed at once
+	Limit int
+	//Remaining is the number of requests still allowed at once
+	Remaining int
+	//Reset is the time needed to allow the limit again
+	Reset time.Duration
+	//RetryAfter is the time needed to allow the next request, when not allowed
+	RetryAfter time.Duration
+}
+
+//MemoryStore keeps a token bucket for each key. The least recently used keys are evicted
+//when there are too many; an evicted key starts again with a full bucket
+type MemoryStore struct {
+	mutex   sync.Mutex
+	maxKeys int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+//NewMemoryStore creates a store which keeps the limits of each gateway replica in memory
+func NewMemoryStore(maxKeys int) *MemoryStore {
+	if maxKeys <= 0 {
+		maxKeys = DefaultMaxKeys
+	}
+	return &MemoryStore{
+		maxKeys: maxKeys,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+//Allow takes a token for a request of the key
+func (s *MemoryStore) Allow(_ context.Context, key string, limits LimitOptions, now time.Time) (Result, error) {
+	limiter := s.limiter(key, limits.Limit, limits.Burst)
+
+	allowed := limiter.AllowN(now, 1)
+	tokens := limiter.TokensAt(now)
+	r := Result{
+		Allowed:   allowed,
+		Limit:     limits.Burst,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     duration(tokens, float64(limits.Burst), limits.Limit),
+	}
+	if !allowed {
+		r.RetryAfter = duration(tokens, 1, limits.Limit)
+	}
+	return r, nil
+}
+
+func (s *MemoryStore) limiter(key string, limit int, burst int) *rate.Limiter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if element, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(element)
+		return element.Value.(*memoryEntry).limiter
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(limit), burst)
+	s.entries[key] = s.lru.PushFront(&memoryEntry{key: key, limiter: limiter})
+	for s.lru.Len() > s.maxKeys {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return limiter
+}
+
+func (s *MemoryStore) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lru.Len()
+}
+
+//duration returns the time needed to refill the bucket up to the needed tokens
+func duration(tokens float64, needed float64, limit int) time.Duration {
+	if tokens >= needed {
+		return 0
+	}
+	return time.Duration((needed - tokens) / float64(limit) * float64(time.Second))
+}
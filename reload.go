@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/osstotalsoft/bifrost/gateway"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//watchConfig reloads the gateway whenever config.json changes.
+//The endpoints, the traffic splits, the filters and the log level are reloaded, the other settings need a restart.
+//It returns the settings in effect, with the secrets masked
+func watchConfig(logger *zap.Logger, level zap.AtomicLevel, reload gateway.ReloadFunc, useFilters func(useMiddleware func(key string, mwf middleware.Func))) func() map[string]interface{} {
+	var mutex sync.Mutex
+	settings := viper.AllSettings()
+
+	viper.OnConfigChange(func(event fsnotify.Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		cfg, err := reloadConfig(reload, useFilters)
+		if err != nil {
+			logger.Error("configuration rejected, the current one is kept", zap.String("file", event.Name), zap.Error(err))
+			//viper holds the rejected configuration, the one in effect is put back
+			if err := restoreSettings(settings); err != nil {
+				logger.Error("cannot restore the configuration in effect", zap.Error(err))
+			}
+			return
+		}
+		changeLogLevel(level, cfg.LogLevel)
+
+		newSettings := viper.AllSettings()
+		logger.Info("configuration reloaded", zap.String("file", event.Name), zap.Strings("diff", settingsDiff(settings, newSettings)))
+		settings = newSettings
+	})
+	viper.WatchConfig()
+
+	return func() map[string]interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return maskSettings(settings).(map[string]interface{})
+	}
+}
+
+//reloadConfig reads the configuration file again and reloads the gateway with it
+func reloadConfig(reload gateway.ReloadFunc, useFilters func(useMiddleware func(key string, mwf middleware.Func))) (cfg *gateway.Config, err error) {
+	defer func() {
+		//the configuration helpers panic when a section cannot be decoded
+		if r := recover(); r != nil {
+			cfg, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+
+	//viper keeps the previous configuration when the file cannot be parsed, so it is read again to know it
+	err = viper.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg = new(gateway.Config)
+	err = viper.Unmarshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = reload(cfg, useFilters)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+//restoreSettings replaces the configuration held by viper with the given settings
+func restoreSettings(settings map[string]interface{}) error {
+	content, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return viper.ReadConfig(bytes.NewReader(content))
+}
+
+//settingsDiff lists the settings changed between two configurations, ex: endpoints.1.filters.rate_limit.limit: 500 -> 100.
+//The values of the secrets are masked
+func settingsDiff(oldSettings, newSettings map[string]interface{}) []string {
+	oldValues, newValues := map[string]interface{}{}, map[string]interface{}{}
+	flattenSettings("", oldSettings, oldValues)
+	flattenSettings("", newSettings, newValues)
+
+	var keys []string
+	for key := range oldValues {
+		keys = append(keys, key)
+	}
+	for key := range newValues {
+		if _, ok := oldValues[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	diff := []string{}
+	for _, key := range keys {
+		oldValue, oldOk := oldValues[key]
+		newValue, newOk := newValues[key]
+		if secret(key) {
+			oldValue, newValue = "***", "***"
+		}
+		switch {
+		case !oldOk:
+			diff = append(diff, fmt.Sprintf("%s: added %v", key, newValue))
+		case !newOk:
+			diff = append(diff, fmt.Sprintf("%s: removed %v", key, oldValue))
+		case !reflect.DeepEqual(oldValues[key], newValues[key]):
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", key, oldValue, newValue))
+		}
+	}
+	return diff
+}
+
+func flattenSettings(prefix string, value interface{}, result map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			flattenSettings(joinKey(prefix, key), item, result)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenSettings(joinKey(prefix, strconv.Itoa(i)), item, result)
+		}
+	default:
+		result[prefix] = value
+	}
+}
+
+//maskSettings returns a copy of the settings where the values of the secrets are masked
+func maskSettings(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if secret(key) {
+				result[key] = "***"
+			} else {
+				result[key] = maskSettings(item)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = maskSettings(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func secret(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "password") || strings.Contains(key, "secret") || strings.Contains(key, "token")
+}
@@ -4,34 +4,43 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/httputils"
 	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/strutils"
 	"github.com/satori/go.uuid"
 	"go.uber.org/zap"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 type dynamicRouter struct {
-	routes       *sync.Map
-	routeMatcher RouteMatcherFunc
-	logger       log.Logger
+	table         atomic.Pointer[routeTable]
+	mutex         sync.Mutex
+	routeMatcher  RouteMatcherFunc
+	logger        log.Logger
+	loggerFactory log.Factory
 }
 
 //NewDynamicRouter creates a new dynamic router
 //Its dynamic because it can add/remove routes at runtime
-//this router does not do any route matching, it relies on third parties for that
+//paths are matched using a compiled route tree, the routeMatcher is used for the routes the tree cannot index
 func NewDynamicRouter(routeMatcher RouteMatcherFunc, loggerFactory log.Factory) *dynamicRouter {
-	return &dynamicRouter{
-		new(sync.Map),
-		routeMatcher,
-		loggerFactory(nil),
+	router := &dynamicRouter{
+		routeMatcher:  routeMatcher,
+		logger:        loggerFactory(nil),
+		loggerFactory: loggerFactory,
 	}
+	router.table.Store(newRouteTable(nil))
+	return router
 }
 
 //GetHandler returns the router http.Handler
 func GetHandler(router *dynamicRouter) http.Handler {
+	matchRoute := MatchRoute(router)
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		route, routeMatch := MatchRoute(router.routes, request)
+		route, routeMatch := matchRoute(request)
 		if !routeMatch.Matched {
 			http.NotFound(writer, request)
 			return
@@ -44,59 +53,141 @@ func GetHandler(router *dynamicRouter) http.Handler {
 			routeMatch.Vars,
 		})
 
-		route.handler.ServeHTTP(writer, request.WithContext(ctx))
+		if route.Timeout <= 0 {
+			route.handler.ServeHTTP(writer, request.WithContext(ctx))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, route.Timeout)
+		defer cancel()
+
+		//records whether a response has been started, so that a timeout does not write a second one
+		recorder := httputils.NewStatusRecorder(writer)
+		route.handler.ServeHTTP(recorder, request.WithContext(ctx))
+
+		//the handler gave up because of the deadline without answering
+		if ctx.Err() == context.DeadlineExceeded && !recorder.WroteHeader {
+			router.loggerFactory(request.Context()).Warn("DynamicRouter: request timed out", zap.String("route_id", route.UID), zap.Duration("timeout", route.Timeout))
+			httputils.GatewayTimeout(writer)
+		}
 	})
 }
 
-//AddRoute adds a new route
-func AddRoute(router *dynamicRouter) func(path, pathPrefix string, methods []string, handler http.Handler) (string, error) {
-	return func(path, pathPrefix string, methods []string, handler http.Handler) (string, error) {
-		route := Route{
-			Path:       path,
-			PathPrefix: pathPrefix,
-			Methods:    methods,
-			handler:    handler,
-			UID:        uuid.Must(uuid.NewV4()).String(),
-		}
+//AddRoute adds a new route for an endpoint
+func AddRoute(router *dynamicRouter) func(endpoint abstraction.Endpoint, handler http.Handler) (string, error) {
+	return func(endpoint abstraction.Endpoint, handler http.Handler) (string, error) {
+		route := newRoute(router, endpoint, handler)
 
-		route.matcher = router.routeMatcher(route)
-		err := validateRoute(router, route)
+		router.mutex.Lock()
+		table := router.table.Load()
+		err := validateRoute(table, route)
 		if err != nil {
+			router.mutex.Unlock()
 			router.logger.Error("invalid route", zap.Error(err))
 			return "", err
 		}
+		router.table.Store(table.with(route))
+		router.mutex.Unlock()
 
-		router.routes.Store(route.UID, route)
 		router.logger.Info(fmt.Sprintf("DynamicRouter: Added new route: id: %s; pathPrefix: %s; path %s", route.UID, route.PathPrefix, route.Path))
 		return route.UID, nil
 	}
 }
 
-func validateRoute(router *dynamicRouter, route Route) error {
-	err := error(nil)
+func newRoute(router *dynamicRouter, endpoint abstraction.Endpoint, handler http.Handler) Route {
+	route := Route{
+		Path:       endpoint.DownstreamPath,
+		PathPrefix: endpoint.DownstreamPathPrefix,
+		Methods:    endpoint.Methods,
+		Hosts:      endpoint.Hosts,
+		Headers:    endpoint.Headers,
+		Queries:    endpoint.Queries,
+		Timeout:    endpoint.Timeout,
+		handler:    handler,
+		UID:        uuid.Must(uuid.NewV4()).String(),
+	}
+	route.matcher = router.routeMatcher(route)
+	return route
+}
 
-	//check for multiple registrations
-	router.routes.Range(func(key, value interface{}) bool {
-		r := value.(Route)
-		if r.String() == route.String() {
-			err = errors.New("DynamicRouter: multiple registrations for : " + route.String())
-			return false
+func validateRoute(table *routeTable, route Route) error {
+	//check for multiple registrations, the same path can be registered
+	//for different hosts, headers or queries and for disjoint sets of methods
+	conditions := route.conditions()
+	for _, r := range table.routes {
+		if r.String() == route.String() && r.conditions() == conditions && methodsOverlap(r.Methods, route.Methods) {
+			return errors.New("DynamicRouter: multiple registrations for : " + route.String() + " " + conditions)
 		}
-		return true
-	})
+	}
 
-	return err
+	return nil
+}
+
+func methodsOverlap(m1, m2 []string) bool {
+	if len(m1) == 0 || len(m2) == 0 {
+		return len(m1) == len(m2)
+	}
+	return len(strutils.Intersection(m1, m2)) > 0
 }
 
 //RemoveRoute removes a route
 func RemoveRoute(router *dynamicRouter) func(routeId string) {
 	return func(routeId string) {
-		route, ok := router.routes.Load(routeId)
+		router.mutex.Lock()
+		table, route, ok := router.table.Load().without(routeId)
 		if !ok {
+			router.mutex.Unlock()
 			router.logger.Error("DynamicRouter: Route does not exist " + routeId)
+			return
+		}
+		router.table.Store(table)
+		router.mutex.Unlock()
+
+		router.logger.Info(fmt.Sprintf("DynamicRouter: Deleted route id: %s; pathPrefix: %s; path %s", route.UID, route.PathPrefix, route.Path))
+	}
+}
+
+//Transaction applies at once the routes added and removed by f, so that no request sees only a part of the changes.
+//The requests are routed with the previous routes until f returns. When f returns an error none of the changes are applied.
+//AddRoute and RemoveRoute wait for the end of the transaction, so that the routes applied are the ones validated by f
+//and the ids returned by f are the ids of the routes applied, f must not call them
+func Transaction(router *dynamicRouter) func(f func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error) error {
+	return func(f func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error) error {
+		router.mutex.Lock()
+		defer router.mutex.Unlock()
+
+		//the changes are staged on a copy of the current table, which is stored when f returns
+		staged := router.table.Load()
+		added, removed := 0, 0
+
+		addRouteFunc := func(endpoint abstraction.Endpoint, handler http.Handler) (string, error) {
+			route := newRoute(router, endpoint, handler)
+			err := validateRoute(staged, route)
+			if err != nil {
+				router.logger.Error("invalid route", zap.Error(err))
+				return "", err
+			}
+			staged = staged.with(route)
+			added++
+			return route.UID, nil
+		}
+		removeRouteFunc := func(routeId string) {
+			table, _, ok := staged.without(routeId)
+			if !ok {
+				router.logger.Error("DynamicRouter: Route does not exist " + routeId)
+				return
+			}
+			staged = table
+			removed++
+		}
+
+		if err := f(addRouteFunc, removeRouteFunc); err != nil {
+			router.logger.Info(fmt.Sprintf("DynamicRouter: Aborted transaction: %s", err))
+			return err
 		}
 
-		router.routes.Delete(routeId)
-		router.logger.Info(fmt.Sprintf("DynamicRouter: Deleted route id: %s; pathPrefix: %s; path %s", route.(Route).UID, route.(Route).PathPrefix, route.(Route).Path))
+		router.table.Store(staged)
+		router.logger.Info(fmt.Sprintf("DynamicRouter: Applied transaction: added %d routes; deleted %d routes", added, removed))
+		return nil
 	}
 }
@@ -3,12 +3,44 @@ package router
 import (
 	"github.com/gorilla/mux"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+//hostWildcardVarPrefix names the vars used to translate host wildcards into gorilla mux templates
+const hostWildcardVarPrefix = "host_wildcard_"
+
 //GorillaMuxRouteMatcher is used for route matching
 func GorillaMuxRouteMatcher(route Route) func(request *http.Request) RouteMatch {
+	hosts := route.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+
+	//gorilla mux accepts a single host per route, so there is one route for each host
+	var rrs []*mux.Route
+	for _, host := range hosts {
+		rrs = append(rrs, newMuxRoute(route, host))
+	}
+
+	return func(request *http.Request) RouteMatch {
+		for _, rr := range rrs {
+			var match mux.RouteMatch
+			if rr.Match(request, &match) {
+				return RouteMatch{true, removeHostWildcards(match.Vars)}
+			}
+		}
+		return RouteMatch{false, nil}
+	}
+}
+
+func newMuxRoute(route Route, host string) *mux.Route {
 	rr := new(mux.Route)
 
+	if host != "" {
+		rr = rr.Host(hostTemplate(host))
+	}
 	if route.PathPrefix != "" {
 		rr = rr.PathPrefix(route.PathPrefix)
 	}
@@ -18,10 +50,48 @@ func GorillaMuxRouteMatcher(route Route) func(request *http.Request) RouteMatch
 	if route.Methods != nil && len(route.Methods) > 0 {
 		rr = rr.Methods(route.Methods...)
 	}
+	if len(route.Headers) > 0 {
+		rr = rr.Headers(pairs(route.Headers)...)
+	}
+	if len(route.Queries) > 0 {
+		rr = rr.Queries(pairs(route.Queries)...)
+	}
 
-	return func(request *http.Request) RouteMatch {
-		var match mux.RouteMatch
-		b := rr.Match(request, &match)
-		return RouteMatch{b, match.Vars}
+	return rr
+}
+
+//hostTemplate turns each * label of a host pattern into a var matching a single label
+//ex: *.example.com matches api.example.com but not example.com
+func hostTemplate(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if label == "*" {
+			labels[i] = "{" + hostWildcardVarPrefix + strconv.Itoa(i) + ":[^.]+}"
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func removeHostWildcards(vars map[string]string) map[string]string {
+	for key := range vars {
+		if strings.HasPrefix(key, hostWildcardVarPrefix) {
+			delete(vars, key)
+		}
+	}
+	return vars
+}
+
+//pairs flattens a map into key/value pairs, ordered by key
+func pairs(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make([]string, 0, 2*len(m))
+	for _, k := range keys {
+		result = append(result, k, m[k])
 	}
+	return result
 }
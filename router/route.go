@@ -2,7 +2,8 @@ package router
 
 import (
 	"net/http"
-	"sync"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -15,6 +16,9 @@ type Route struct {
 	Path       string
 	PathPrefix string
 	Methods    []string
+	Hosts      []string
+	Headers    map[string]string
+	Queries    map[string]string
 	Timeout    time.Duration
 	matcher    func(request *http.Request) RouteMatch
 	handler    http.Handler
@@ -30,22 +34,49 @@ func (r Route) String() string {
 	return r.PathPrefix + r.Path
 }
 
-//MatchRoute checks all the route if they match the incoming request
-func MatchRoute(routes *sync.Map, request *http.Request) (Route, RouteMatch) {
+//conditions returns a canonical description of the host, header and query requirements of the route
+func (r Route) conditions() string {
+	hosts := append([]string(nil), r.Hosts...)
+	for i, h := range hosts {
+		hosts[i] = strings.ToLower(h)
+	}
+	sort.Strings(hosts)
 
-	var resRM RouteMatch
-	var resR Route
+	var headers []string
+	for k, v := range r.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(k)+"="+v)
+	}
+	sort.Strings(headers)
 
-	routes.Range(func(key, value interface{}) bool {
-		r := value.(Route)
-		rm := r.matcher(request)
-		if rm.Matched {
-			resRM = RouteMatch{rm.Matched, rm.Vars}
-			resR = r
-			return false
-		}
-		return true
-	})
+	var queries []string
+	for k, v := range r.Queries {
+		queries = append(queries, k+"="+v)
+	}
+	sort.Strings(queries)
 
-	return resR, resRM
+	return strings.Join(hosts, ",") + ";" + strings.Join(headers, ",") + ";" + strings.Join(queries, ",")
+}
+
+//conditionCount is the number of host, header and query requirements of the route
+func (r Route) conditionCount() int {
+	count := len(r.Headers) + len(r.Queries)
+	if len(r.Hosts) > 0 {
+		count++
+	}
+	return count
+}
+
+//MatchRoute returns the most specific route that matches the incoming request
+func MatchRoute(router *dynamicRouter) func(request *http.Request) (Route, RouteMatch) {
+	return func(request *http.Request) (Route, RouteMatch) {
+		return router.table.Load().match(request)
+	}
+}
+
+//Routes returns the routes of the router, the most specific first
+func Routes(router *dynamicRouter) func() []Route {
+	return func() []Route {
+		routes := router.table.Load().routes
+		return append([]Route(nil), routes...)
+	}
 }
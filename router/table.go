@@ -0,0 +1,120 @@
+package router
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//routeKind classifies routes by how precisely they describe a path
+type routeKind int
+
+const (
+	//exactRoute matches a single literal path
+	exactRoute routeKind = iota
+	//templateRoute matches a path containing {var} segments
+	templateRoute
+	//prefixRoute matches every path starting with its prefix
+	prefixRoute
+)
+
+//routeTable is an immutable list of routes ordered by specificity, the most specific first.
+//It is replaced as a whole (copy-on-write) whenever a route is added or removed
+type routeTable struct {
+	routes []Route
+	index  *routeTree
+}
+
+func newRouteTable(routes []Route) *routeTable {
+	return &routeTable{routes, newRouteTree(routes)}
+}
+
+//with returns a new table containing all the routes of t plus route
+func (t *routeTable) with(route Route) *routeTable {
+	routes := make([]Route, len(t.routes), len(t.routes)+1)
+	copy(routes, t.routes)
+	routes = append(routes, route)
+
+	//stable sort keeps the registration order between routes that are equally specific
+	sort.SliceStable(routes, func(i, j int) bool {
+		return moreSpecific(routes[i], routes[j])
+	})
+	return newRouteTable(routes)
+}
+
+//without returns a new table containing all the routes of t except the one with the given id
+func (t *routeTable) without(routeId string) (*routeTable, Route, bool) {
+	for i, r := range t.routes {
+		if r.UID == routeId {
+			routes := make([]Route, 0, len(t.routes)-1)
+			routes = append(routes, t.routes[:i]...)
+			routes = append(routes, t.routes[i+1:]...)
+			return newRouteTable(routes), r, true
+		}
+	}
+	return t, Route{}, false
+}
+
+//match returns the most specific route that matches the request
+func (t *routeTable) match(request *http.Request) (Route, RouteMatch) {
+	return t.index.lookup(request)
+}
+
+//moreSpecific ranks exact paths over templates over prefixes, then longer literal paths first,
+//then routes with more host, header and query conditions
+//and then routes restricted to some methods over routes accepting any method
+func moreSpecific(a, b Route) bool {
+	if ka, kb := a.kind(), b.kind(); ka != kb {
+		return ka < kb
+	}
+	ta, tb := a.template(), b.template()
+	if la, lb := literalLength(ta), literalLength(tb); la != lb {
+		return la > lb
+	}
+	if len(ta) != len(tb) {
+		return len(ta) > len(tb)
+	}
+	if ca, cb := a.conditionCount(), b.conditionCount(); ca != cb {
+		return ca > cb
+	}
+	return len(a.Methods) > 0 && len(b.Methods) == 0
+}
+
+func (r Route) kind() routeKind {
+	switch {
+	case r.Path == "":
+		return prefixRoute
+	case strings.Contains(r.template(), "{"):
+		return templateRoute
+	default:
+		return exactRoute
+	}
+}
+
+//template returns the full path template of the route, the same way gorilla mux joins a prefix and a path
+func (r Route) template() string {
+	if r.Path == "" {
+		return r.PathPrefix
+	}
+	return strings.TrimRight(r.PathPrefix, "/") + r.Path
+}
+
+//literalLength counts the characters of a path template that are outside {var} declarations
+func literalLength(template string) int {
+	length, depth := 0, 0
+	for i := 0; i < len(template); i++ {
+		switch template[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		default:
+			if depth == 0 {
+				length++
+			}
+		}
+	}
+	return length
+}
@@ -0,0 +1,252 @@
+package router
+
+import (
+	"errors"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testRoute struct {
+	name       string
+	path       string
+	pathPrefix string
+	methods    []string
+	hosts      []string
+	headers    map[string]string
+	queries    map[string]string
+}
+
+type routeTest struct {
+	title         string
+	method        string
+	requestUrl    string
+	expectedRoute string
+}
+
+var (
+	overlappingRoutes = []testRoute{
+		{name: "api", pathPrefix: "/api"},
+		{name: "apiOffers", pathPrefix: "/api/offers"},
+		{name: "apiOffersGet", pathPrefix: "/api/offers", methods: []string{"GET"}},
+		{name: "offers2", pathPrefix: "/offers2"},
+		{name: "offers2AddOffer", pathPrefix: "/offers2", path: "/add_offer/{v1}", methods: []string{"GET"}},
+		{name: "offers2AddOfferMine", pathPrefix: "/offers2", path: "/add_offer/mine"},
+		{name: "users", pathPrefix: "/users"},
+		{name: "usersById", pathPrefix: "/users", path: "/{id}"},
+		{name: "usersByIdDetails", pathPrefix: "/users", path: "/{id}/details"},
+		{name: "root", pathPrefix: "/"},
+	}
+
+	routeTestCases = []routeTest{
+		{"longerPrefixWins", "POST", "/api/offers/5", "apiOffers"},
+		{"shorterPrefixFallback", "POST", "/api/users/5", "api"},
+		{"methodRestrictedWins", "GET", "/api/offers/5", "apiOffersGet"},
+		{"templateOverPrefix", "GET", "/offers2/add_offer/555", "offers2AddOffer"},
+		{"templateMethodMismatch", "POST", "/offers2/add_offer/555", "offers2"},
+		{"exactOverTemplate", "GET", "/offers2/add_offer/mine", "offers2AddOfferMine"},
+		{"longerTemplateWins", "GET", "/users/7/details", "usersByIdDetails"},
+		{"shorterTemplate", "GET", "/users/7", "usersById"},
+		{"prefixWhenNoTemplate", "GET", "/users/7/orders", "users"},
+		{"catchAll", "GET", "/dealers", "root"},
+	}
+)
+
+func TestMatchRouteIsDeterministic(t *testing.T) {
+	forward := newTestRouter(t, overlappingRoutes)
+	reversed := make([]testRoute, len(overlappingRoutes))
+	for i, r := range overlappingRoutes {
+		reversed[len(overlappingRoutes)-1-i] = r
+	}
+	backward := newTestRouter(t, reversed)
+
+	t.Run("group", func(t *testing.T) {
+		for _, tc := range routeTestCases {
+			tc := tc
+			t.Run(tc.title, func(t *testing.T) {
+				t.Parallel()
+
+				for _, handler := range []http.Handler{GetHandler(forward), GetHandler(backward)} {
+					//the same request must always hit the same route
+					for i := 0; i < 10; i++ {
+						w := httptest.NewRecorder()
+						handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.requestUrl, nil))
+
+						if body := w.Body.String(); body != tc.expectedRoute {
+							t.Fatalf("test %s failed : expected %v, but got %v", tc.title, tc.expectedRoute, body)
+						}
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestAddRouteRejectsConflicts(t *testing.T) {
+	router := newTestRouter(t, overlappingRoutes)
+	addRoute := AddRoute(router)
+
+	if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: "/api"}, http.NotFoundHandler()); err == nil {
+		t.Error("expected a conflict for an already registered prefix")
+	}
+	if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: "/api/offers", Methods: []string{"GET", "PUT"}}, http.NotFoundHandler()); err == nil {
+		t.Error("expected a conflict for overlapping methods")
+	}
+	if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: "/api/offers", Methods: []string{"DELETE"}}, http.NotFoundHandler()); err != nil {
+		t.Errorf("expected disjoint methods to be accepted, but got %v", err)
+	}
+	if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: "/api", Hosts: []string{"tenant1.example.com"}}, http.NotFoundHandler()); err != nil {
+		t.Errorf("expected a different host to be accepted, but got %v", err)
+	}
+	if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: "/api", Hosts: []string{"TENANT1.example.com"}}, http.NotFoundHandler()); err == nil {
+		t.Error("expected a conflict for the same host")
+	}
+	if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: "/api", Headers: map[string]string{"X-Api-Version": "2"}}, http.NotFoundHandler()); err != nil {
+		t.Errorf("expected a different header to be accepted, but got %v", err)
+	}
+	if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: "/api", Headers: map[string]string{"x-api-version": "2"}}, http.NotFoundHandler()); err == nil {
+		t.Error("expected a conflict for the same header")
+	}
+}
+
+func TestRemoveRoute(t *testing.T) {
+	router := NewDynamicRouter(GorillaMuxRouteMatcher, log.ZapLoggerFactory(zap.NewNop()))
+	broad, _ := AddRoute(router)(abstraction.Endpoint{DownstreamPathPrefix: "/api"}, namedHandler("api"))
+	narrow, _ := AddRoute(router)(abstraction.Endpoint{DownstreamPathPrefix: "/api/offers"}, namedHandler("apiOffers"))
+	handler := GetHandler(router)
+
+	RemoveRoute(router)(narrow)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/offers", nil))
+	if body := w.Body.String(); body != "api" {
+		t.Fatalf("expected api, but got %v", body)
+	}
+
+	RemoveRoute(router)(broad)
+	RemoveRoute(router)(broad)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/offers", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %v, but got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	router := NewDynamicRouter(GorillaMuxRouteMatcher, log.ZapLoggerFactory(zap.NewNop()))
+	old, _ := AddRoute(router)(abstraction.Endpoint{DownstreamPathPrefix: "/api"}, namedHandler("old"))
+	handler := GetHandler(router)
+	serve := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/offers", nil))
+		return w.Body.String()
+	}
+
+	_ = Transaction(router)(func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error {
+		removeRouteFunc(old)
+		if _, err := addRouteFunc(abstraction.Endpoint{DownstreamPathPrefix: "/api"}, namedHandler("new")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := addRouteFunc(abstraction.Endpoint{DownstreamPathPrefix: "/api"}, namedHandler("conflict")); err == nil {
+			t.Error("expected a conflict with the staged route")
+		}
+		if body := serve(); body != "old" {
+			t.Errorf("expected the old route until the transaction ends, but got %v", body)
+		}
+		return nil
+	})
+
+	if body := serve(); body != "new" {
+		t.Errorf("expected the new route, but got %v", body)
+	}
+
+	err := Transaction(router)(func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error {
+		if _, err := addRouteFunc(abstraction.Endpoint{DownstreamPathPrefix: "/aborted"}, namedHandler("aborted")); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Error("expected the error of the aborted transaction")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/aborted", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the routes of an aborted transaction not to be applied, but got %v", w.Code)
+	}
+}
+
+func TestTransactionWithConcurrentChanges(t *testing.T) {
+	router := NewDynamicRouter(GorillaMuxRouteMatcher, log.ZapLoggerFactory(zap.NewNop()))
+	concurrent := make(chan error)
+
+	var routeId string
+	_ = Transaction(router)(func(addRouteFunc func(endpoint abstraction.Endpoint, handler http.Handler) (string, error), removeRouteFunc func(routeId string)) error {
+		routeId, _ = addRouteFunc(abstraction.Endpoint{DownstreamPathPrefix: "/api"}, namedHandler("transaction"))
+		go func() {
+			_, err := AddRoute(router)(abstraction.Endpoint{DownstreamPathPrefix: "/api"}, namedHandler("concurrent"))
+			concurrent <- err
+		}()
+		//gives the concurrent route a chance to be added before the end of the transaction
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	if err := <-concurrent; err == nil {
+		t.Error("expected the concurrent route to conflict with the route of the transaction")
+	}
+	if routes := Routes(router)(); len(routes) != 1 || routes[0].UID != routeId {
+		t.Errorf("expected the route returned by the transaction to be applied, but got %+v", routes)
+	}
+}
+
+func TestRouteTimeout(t *testing.T) {
+	router := NewDynamicRouter(GorillaMuxRouteMatcher, log.ZapLoggerFactory(zap.NewNop()))
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	fast := namedHandler("fast")
+	_, _ = AddRoute(router)(abstraction.Endpoint{DownstreamPathPrefix: "/slow", Timeout: 10 * time.Millisecond}, slow)
+	_, _ = AddRoute(router)(abstraction.Endpoint{DownstreamPathPrefix: "/fast", Timeout: time.Second}, fast)
+	handler := GetHandler(router)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status %v, but got %v", http.StatusGatewayTimeout, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "fast" {
+		t.Fatalf("expected status %v, but got %v", http.StatusOK, w.Code)
+	}
+}
+
+func newTestRouter(t *testing.T, routes []testRoute) *dynamicRouter {
+	router := NewDynamicRouter(GorillaMuxRouteMatcher, log.ZapLoggerFactory(zap.NewNop()))
+	for _, r := range routes {
+		endpoint := abstraction.Endpoint{
+			DownstreamPath:       r.path,
+			DownstreamPathPrefix: r.pathPrefix,
+			Methods:              r.methods,
+			Hosts:                r.hosts,
+			Headers:              r.headers,
+			Queries:              r.queries,
+		}
+		if _, err := AddRoute(router)(endpoint, namedHandler(r.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return router
+}
+
+func namedHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name)
+	})
+}
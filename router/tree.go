@@ -0,0 +1,265 @@
+package router
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//routeTree is a radix tree compiled from the path templates of a route table.
+//Literal parts of the templates are stored on compressed edges, {var} segments on parameter nodes
+//and the routes themselves in per method buckets on the node where their template ends.
+//Templates the tree cannot represent (vars with custom patterns or vars sharing a segment with literals)
+//are kept aside and checked with the route matcher, which also confirms the routes having host, header or query conditions.
+type routeTree struct {
+	root     *treeNode
+	fallback []indexedRoute
+}
+
+//indexedRoute is a route stored in the tree together with its rank in the route table
+type indexedRoute struct {
+	rank        int
+	route       *Route
+	varNames    []string
+	conditional bool
+}
+
+type treeNode struct {
+	label        string
+	children     []*treeNode
+	param        *treeNode
+	exactRoutes  methodBuckets
+	prefixRoutes methodBuckets
+}
+
+//methodBuckets groups the routes ending on a node by the http methods they accept
+type methodBuckets struct {
+	byMethod  map[string][]indexedRoute
+	anyMethod []indexedRoute
+}
+
+//candidate is a route whose path template matched the request path
+type candidate struct {
+	indexedRoute
+	values []string
+}
+
+//newRouteTree compiles the routes, which must be ordered by specificity, into a tree
+func newRouteTree(routes []Route) *routeTree {
+	tree := &routeTree{root: new(treeNode)}
+	for i := range routes {
+		tree.insert(i, &routes[i])
+	}
+	return tree
+}
+
+func (tree *routeTree) insert(rank int, route *Route) {
+	tokens, ok := tokenize(route.template())
+	if !ok {
+		tree.fallback = append(tree.fallback, indexedRoute{rank: rank, route: route})
+		return
+	}
+
+	node := tree.root
+	var varNames []string
+	for _, token := range tokens {
+		if token.isVar {
+			if node.param == nil {
+				node.param = new(treeNode)
+			}
+			node = node.param
+			varNames = append(varNames, token.value)
+			continue
+		}
+		node = node.insertLiteral(token.value)
+	}
+
+	ir := indexedRoute{rank: rank, route: route, varNames: varNames, conditional: route.conditionCount() > 0}
+	if route.kind() == prefixRoute {
+		node.prefixRoutes.add(ir)
+	} else {
+		node.exactRoutes.add(ir)
+	}
+}
+
+//lookup returns the most specific route that matches the request
+func (tree *routeTree) lookup(request *http.Request) (Route, RouteMatch) {
+	var buffer [8]candidate
+	candidates := buffer[:0]
+	tree.root.collect(request.URL.Path, request.Method, nil, &candidates)
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].rank < candidates[j].rank
+	})
+
+	fallback := tree.fallback
+	for _, c := range candidates {
+		for len(fallback) > 0 && fallback[0].rank < c.rank {
+			if rm := fallback[0].route.matcher(request); rm.Matched {
+				return *fallback[0].route, rm
+			}
+			fallback = fallback[1:]
+		}
+		if c.conditional {
+			if rm := c.route.matcher(request); rm.Matched {
+				return *c.route, rm
+			}
+			continue
+		}
+		return *c.route, RouteMatch{true, c.vars()}
+	}
+	for _, f := range fallback {
+		if rm := f.route.matcher(request); rm.Matched {
+			return *f.route, rm
+		}
+	}
+
+	return Route{}, RouteMatch{}
+}
+
+//collect walks the remaining path from node n and gathers all the routes whose templates match it
+func (n *treeNode) collect(path, method string, values []string, result *[]candidate) {
+	n.prefixRoutes.collect(method, values, result)
+	if path == "" {
+		n.exactRoutes.collect(method, values, result)
+		return
+	}
+
+	for _, child := range n.children {
+		if strings.HasPrefix(path, child.label) {
+			child.collect(path[len(child.label):], method, values, result)
+			break
+		}
+	}
+
+	if n.param != nil {
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
+		}
+		if end > 0 {
+			n.param.collect(path[end:], method, append(values, path[:end]), result)
+		}
+	}
+}
+
+//insertLiteral adds the literal s below node n, splitting edges where needed, and returns the node where s ends
+func (n *treeNode) insertLiteral(s string) *treeNode {
+	for s != "" {
+		i := n.childIndex(s[0])
+		if i < 0 {
+			child := &treeNode{label: s}
+			n.children = append(n.children, child)
+			return child
+		}
+
+		child := n.children[i]
+		common := commonPrefixLength(child.label, s)
+		if common < len(child.label) {
+			split := &treeNode{label: child.label[:common], children: []*treeNode{child}}
+			child.label = child.label[common:]
+			n.children[i] = split
+			child = split
+		}
+		n = child
+		s = s[common:]
+	}
+	return n
+}
+
+func (n *treeNode) childIndex(b byte) int {
+	for i, child := range n.children {
+		if child.label[0] == b {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *methodBuckets) add(ir indexedRoute) {
+	if len(ir.route.Methods) == 0 {
+		b.anyMethod = append(b.anyMethod, ir)
+		return
+	}
+	if b.byMethod == nil {
+		b.byMethod = map[string][]indexedRoute{}
+	}
+	for _, m := range ir.route.Methods {
+		m = strings.ToUpper(m)
+		b.byMethod[m] = append(b.byMethod[m], ir)
+	}
+}
+
+func (b *methodBuckets) collect(method string, values []string, result *[]candidate) {
+	for _, ir := range b.byMethod[method] {
+		*result = append(*result, candidate{ir, append([]string(nil), values...)})
+	}
+	for _, ir := range b.anyMethod {
+		*result = append(*result, candidate{ir, append([]string(nil), values...)})
+	}
+}
+
+func (c candidate) vars() map[string]string {
+	vars := make(map[string]string, len(c.varNames))
+	for i, name := range c.varNames {
+		vars[name] = c.values[i]
+	}
+	return vars
+}
+
+type templateToken struct {
+	value string
+	isVar bool
+}
+
+//tokenize splits a path template into literals and vars.
+//It reports false if the template uses features the tree does not index
+func tokenize(template string) ([]templateToken, bool) {
+	var tokens []templateToken
+	for template != "" {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			tokens = append(tokens, templateToken{value: template})
+			break
+		}
+		end := closingBrace(template, start)
+		if end < 0 {
+			return nil, false
+		}
+
+		name := template[start+1 : end]
+		//vars must have the default pattern and fill a whole segment
+		if strings.Contains(name, ":") || name == "" ||
+			start == 0 || template[start-1] != '/' ||
+			(end+1 < len(template) && template[end+1] != '/') {
+			return nil, false
+		}
+
+		tokens = append(tokens, templateToken{value: template[:start]}, templateToken{value: name, isVar: true})
+		template = template[end+1:]
+	}
+	return tokens, true
+}
+
+func closingBrace(template string, start int) int {
+	level := 0
+	for i := start; i < len(template); i++ {
+		switch template[i] {
+		case '{':
+			level++
+		case '}':
+			level--
+			if level == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,150 @@
+package router
+
+import (
+	"fmt"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+var (
+	treeRoutes = append([]testRoute{
+		{name: "itemsNumeric", pathPrefix: "/items", path: "/{id:[0-9]+}"},
+		{name: "itemsAny", pathPrefix: "/items", path: "/{id}"},
+		{name: "filesJson", pathPrefix: "/files", path: "/{name}.json"},
+		{name: "tenantApi", pathPrefix: "/{tenant}/api"},
+		{name: "tenantApiOrders", pathPrefix: "/{tenant}/api", path: "/orders/{orderId}", methods: []string{"PUT", "DELETE"}},
+		{name: "apiPrefixNoSlash", pathPrefix: "/apix"},
+		{name: "apiTenant1", pathPrefix: "/api", hosts: []string{"tenant1.example.com", "*.tenant1.example.com"}},
+		{name: "apiOffersV2", pathPrefix: "/api/offers", headers: map[string]string{"X-Api-Version": "2"}},
+		{name: "apiOffersDraft", pathPrefix: "/api/offers", queries: map[string]string{"draft": "{draft}"}},
+	}, overlappingRoutes...)
+
+	treeRequests = []struct {
+		method  string
+		url     string
+		host    string
+		headers map[string]string
+	}{
+		{method: "GET", url: "/api"},
+		{method: "GET", url: "/apixyz"},
+		{method: "GET", url: "/api/offers"},
+		{method: "DELETE", url: "/api/offers/1"},
+		{method: "GET", url: "/offers2/add_offer/1"},
+		{method: "GET", url: "/offers2/add_offer/mine"},
+		{method: "GET", url: "/offers2/add_offer/"},
+		{method: "GET", url: "/users/1/details"},
+		{method: "GET", url: "/users/1/details/2"},
+		{method: "GET", url: "/items/123"},
+		{method: "GET", url: "/items/abc"},
+		{method: "GET", url: "/files/report.json"},
+		{method: "GET", url: "/files/report.xml"},
+		{method: "GET", url: "/acme/api/orders/12"},
+		{method: "PUT", url: "/acme/api/orders/12"},
+		{method: "PUT", url: "/acme/api/orders/12/lines"},
+		{method: "GET", url: "//api"},
+		{method: "GET", url: "/dealers2/singWebApp%2F2137%2F6026a931-7c35"},
+		{method: "GET", url: "/api/users", host: "tenant1.example.com"},
+		{method: "GET", url: "/api/users", host: "eu.tenant1.example.com:8000"},
+		{method: "GET", url: "/api/users", host: "tenant2.example.com"},
+		{method: "GET", url: "/api/offers/1", host: "tenant1.example.com", headers: map[string]string{"X-Api-Version": "2"}},
+		{method: "GET", url: "/api/offers/1", headers: map[string]string{"x-api-version": "2"}},
+		{method: "GET", url: "/api/offers/1?draft=true"},
+	}
+)
+
+func TestRouteTreeMatchesLinearScan(t *testing.T) {
+	router := newTestRouter(t, treeRoutes)
+	table := router.table.Load()
+
+	for _, tc := range treeRequests {
+		request := httptest.NewRequest(tc.method, tc.url, nil)
+		if tc.host != "" {
+			request.Host = tc.host
+		}
+		for k, v := range tc.headers {
+			request.Header.Set(k, v)
+		}
+
+		expectedRoute, expectedMatch := linearScan(table.routes, request)
+		route, match := table.match(request)
+
+		if route.UID != expectedRoute.UID {
+			t.Errorf("%s %s: expected route %v, but got %v", tc.method, tc.url, expectedRoute.String(), route.String())
+			continue
+		}
+		if match.Matched != expectedMatch.Matched {
+			t.Errorf("%s %s: expected matched %v, but got %v", tc.method, tc.url, expectedMatch.Matched, match.Matched)
+			continue
+		}
+		if match.Matched && !reflect.DeepEqual(match.Vars, expectedMatch.Vars) {
+			t.Errorf("%s %s: expected vars %v, but got %v", tc.method, tc.url, expectedMatch.Vars, match.Vars)
+		}
+	}
+}
+
+func BenchmarkRouteTree(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		table := benchmarkTable(b, n)
+		request := httptest.NewRequest("GET", fmt.Sprintf("/service%d/orders/42", n-1), nil)
+
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, rm := table.match(request); !rm.Matched {
+					b.Fatal("route not matched")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGorillaMuxRouteMatcher(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		table := benchmarkTable(b, n)
+		request := httptest.NewRequest("GET", fmt.Sprintf("/service%d/orders/42", n-1), nil)
+
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, rm := linearScan(table.routes, request); !rm.Matched {
+					b.Fatal("route not matched")
+				}
+			}
+		})
+	}
+}
+
+//benchmarkTable registers n services, each one with a prefix route and a template route
+func benchmarkTable(b *testing.B, n int) *routeTable {
+	router := NewDynamicRouter(GorillaMuxRouteMatcher, log.ZapLoggerFactory(zap.NewNop()))
+	addRoute := AddRoute(router)
+	for i := 0; i < n/2; i++ {
+		prefix := fmt.Sprintf("/service%d", i)
+		if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: prefix}, http.NotFoundHandler()); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := addRoute(abstraction.Endpoint{DownstreamPathPrefix: prefix, DownstreamPath: "/orders/{id}", Methods: []string{"GET"}}, http.NotFoundHandler()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	last := abstraction.Endpoint{DownstreamPathPrefix: fmt.Sprintf("/service%d", n-1), DownstreamPath: "/orders/{id}", Methods: []string{"GET"}}
+	if _, err := addRoute(last, http.NotFoundHandler()); err != nil {
+		b.Fatal(err)
+	}
+	return router.table.Load()
+}
+
+//linearScan runs the matcher of every route, in the order of the table, until one matches
+func linearScan(routes []Route, request *http.Request) (Route, RouteMatch) {
+	for _, r := range routes {
+		if rm := r.matcher(request); rm.Matched {
+			return r, rm
+		}
+	}
+	return Route{}, RouteMatch{}
+}
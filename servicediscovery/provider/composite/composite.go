@@ -0,0 +1,164 @@
+package composite
+
+import (
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+//CompositeServiceProvider is a service discovery provider merging the services of several providers.
+//When a resource is found by more than one provider, only the services of the first provider in the list are published,
+//the ones of the other providers are published again if the first one loses the resource.
+//The UIDs of the services published are prefixed with the name of their provider, ex: file/lsng/offers
+type CompositeServiceProvider struct {
+	servicediscovery.Subscribers
+	providers []NamedProvider
+	logger    log.Logger
+	mutex     sync.Mutex
+	//found are the services found by each provider, by UID
+	found []map[string]servicediscovery.Service
+	//published are the services published to the subscribers
+	published map[serviceKey]servicediscovery.Service
+}
+
+//NamedProvider is a provider of the composite with the name prefixing the UIDs of its services
+type NamedProvider struct {
+	Name string
+	servicediscovery.Provider
+}
+
+//serviceKey identifies a service found by a provider, the UIDs of different providers may collide
+type serviceKey struct {
+	provider int
+	uid      string
+}
+
+//NewCompositeServiceProvider creates a provider merging the services of providers, in the order of precedence
+func NewCompositeServiceProvider(loggerFactory log.Factory, providers ...NamedProvider) *CompositeServiceProvider {
+	logger := loggerFactory(nil)
+	logger = logger.With(zap.String("component", "composite_service_provider"))
+
+	p := &CompositeServiceProvider{
+		providers: providers,
+		logger:    logger,
+		published: map[serviceKey]servicediscovery.Service{},
+	}
+
+	for i, provider := range providers {
+		i := i
+		p.found = append(p.found, map[string]servicediscovery.Service{})
+		provider.SubscribeOnAddService(func(service servicediscovery.Service) {
+			change(p, i, nil, &service)
+		})
+		provider.SubscribeOnRemoveService(func(service servicediscovery.Service) {
+			change(p, i, &service, nil)
+		})
+		provider.SubscribeOnUpdateService(func(old servicediscovery.Service, new servicediscovery.Service) {
+			change(p, i, &old, &new)
+		})
+	}
+
+	return p
+}
+
+//change records a service added, removed or updated by a provider and publishes the resulting changes
+func change(p *CompositeServiceProvider, provider int, old *servicediscovery.Service, new *servicediscovery.Service) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var resources []string
+	if old != nil {
+		delete(p.found[provider], old.UID)
+		resources = append(resources, old.Resource)
+	}
+	if new != nil {
+		p.found[provider][new.UID] = *new
+		if old == nil || old.Resource != new.Resource {
+			resources = append(resources, new.Resource)
+		}
+	}
+
+	for _, resource := range resources {
+		reconcile(p, resource)
+	}
+}
+
+//owner returns the first provider which found the resource, or -1
+func owner(p *CompositeServiceProvider, resource string) int {
+	for i, found := range p.found {
+		for _, service := range found {
+			if service.Resource == resource {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+//reconcile publishes the services of the resource found by its owner, in place of the ones published before
+func reconcile(p *CompositeServiceProvider, resource string) {
+	o := owner(p, resource)
+	desired := map[serviceKey]servicediscovery.Service{}
+	if o >= 0 {
+		for uid, service := range p.found[o] {
+			if service.Resource == resource {
+				service.UID = p.providers[o].Name + "/" + uid
+				desired[serviceKey{o, uid}] = service
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(p.published) {
+		service := p.published[key]
+		if _, ok := desired[key]; ok || service.Resource != resource {
+			continue
+		}
+		delete(p.published, key)
+		if key.provider > o && o >= 0 {
+			p.logger.Info("CompositeProvider: service shadowed by a provider with a higher precedence", zap.Any("service", service))
+		}
+		p.PublishRemove(service)
+	}
+
+	for _, key := range sortedKeys(desired) {
+		service := desired[key]
+		old, ok := p.published[key]
+		p.published[key] = service
+		if !ok {
+			p.PublishAdd(service)
+		} else if !reflect.DeepEqual(old, service) {
+			p.PublishUpdate(old, service)
+		}
+	}
+}
+
+func sortedKeys(services map[serviceKey]servicediscovery.Service) []serviceKey {
+	keys := make([]serviceKey, 0, len(services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].provider != keys[j].provider {
+			return keys[i].provider < keys[j].provider
+		}
+		return keys[i].uid < keys[j].uid
+	})
+	return keys
+}
+
+//Start starts the providers, in the order of precedence
+func (p *CompositeServiceProvider) Start() {
+	for _, provider := range p.providers {
+		provider.Start()
+	}
+}
+
+//Stop stops the providers
+func (p *CompositeServiceProvider) Stop() {
+	for _, provider := range p.providers {
+		provider.Stop()
+	}
+}
@@ -0,0 +1,96 @@
+package composite
+
+import (
+	"fmt"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	"reflect"
+	"testing"
+)
+
+type fakeProvider struct {
+	onAdd    servicediscovery.ServiceFunc
+	onRemove servicediscovery.ServiceFunc
+	onUpdate func(old servicediscovery.Service, new servicediscovery.Service)
+	started  bool
+}
+
+func (f *fakeProvider) SubscribeOnAddService(fn servicediscovery.ServiceFunc)    { f.onAdd = fn }
+func (f *fakeProvider) SubscribeOnRemoveService(fn servicediscovery.ServiceFunc) { f.onRemove = fn }
+func (f *fakeProvider) SubscribeOnUpdateService(fn func(old servicediscovery.Service, new servicediscovery.Service)) {
+	f.onUpdate = fn
+}
+func (f *fakeProvider) Start() { f.started = true }
+func (f *fakeProvider) Stop()  { f.started = false }
+
+func TestCompositeServiceProvider(t *testing.T) {
+	file, kube := &fakeProvider{}, &fakeProvider{}
+	provider := NewCompositeServiceProvider(log.ZapLoggerFactory(zap.NewNop()), NamedProvider{"file", file}, NamedProvider{"kubernetes", kube})
+
+	var events []string
+	provider.SubscribeOnAddService(func(service servicediscovery.Service) {
+		events = append(events, "add "+service.UID)
+	})
+	provider.SubscribeOnRemoveService(func(service servicediscovery.Service) {
+		events = append(events, "remove "+service.UID)
+	})
+	provider.SubscribeOnUpdateService(func(old servicediscovery.Service, new servicediscovery.Service) {
+		events = append(events, fmt.Sprintf("update %s %s", new.UID, new.Address))
+	})
+	provider.Start()
+	if !file.started || !kube.started {
+		t.Fatal("expected the providers to be started")
+	}
+
+	offersKube := servicediscovery.Service{UID: "k1", Resource: "offers", Address: "http://offers.lsng"}
+	offersFile := servicediscovery.Service{UID: "f1", Resource: "offers", Address: "http://localhost:5000"}
+	partners := servicediscovery.Service{UID: "k2", Resource: "partners", Address: "http://partners.lsng"}
+	movedPartners := servicediscovery.Service{UID: "k2", Resource: "dealers", Address: "http://partners.lsng"}
+
+	kube.onAdd(offersKube)
+	kube.onAdd(partners)
+	file.onAdd(offersFile)
+	kube.onUpdate(offersKube, servicediscovery.Service{UID: "k1", Resource: "offers", Address: "http://10.0.0.1"})
+	file.onUpdate(offersFile, servicediscovery.Service{UID: "f1", Resource: "offers", Address: "http://localhost:5001"})
+	file.onRemove(offersFile)
+	kube.onUpdate(partners, movedPartners)
+
+	expected := []string{
+		"add kubernetes/k1",
+		"add kubernetes/k2",
+		"remove kubernetes/k1",
+		"add file/f1",
+		"update file/f1 http://localhost:5001",
+		"remove file/f1",
+		"add kubernetes/k1",
+		"remove kubernetes/k2",
+		"add kubernetes/k2",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected the events %v, but got %v", expected, events)
+	}
+
+	provider.Stop()
+	if file.started || kube.started {
+		t.Error("expected the providers to be stopped")
+	}
+}
+
+func TestCompositeServiceProviderSameUID(t *testing.T) {
+	file, consul := &fakeProvider{}, &fakeProvider{}
+	provider := NewCompositeServiceProvider(log.ZapLoggerFactory(zap.NewNop()), NamedProvider{"file", file}, NamedProvider{"consul", consul})
+
+	var added []string
+	provider.SubscribeOnAddService(func(service servicediscovery.Service) {
+		added = append(added, service.UID)
+	})
+
+	file.onAdd(servicediscovery.Service{UID: "offers", Resource: "offers"})
+	consul.onAdd(servicediscovery.Service{UID: "offers", Resource: "dealers"})
+
+	expected := []string{"file/offers", "consul/offers"}
+	if !reflect.DeepEqual(added, expected) {
+		t.Errorf("expected the services of both providers with the UIDs %v, but got %v", expected, added)
+	}
+}
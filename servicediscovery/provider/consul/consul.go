@@ -0,0 +1,343 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//the values are given as tags named like the Kubernetes labels, ex: api-gateway/resource=offers,
+//or as service meta, whose keys cannot contain slashes or dots, ex: api-gateway-resource
+const (
+	resourceLabelName = "api-gateway/resource"
+	audienceLabelName = "api-gateway/oidc.audience"
+	securedLabelName  = "api-gateway/secured"
+	versionLabelName  = "api-gateway/version"
+	//schemeLabelName is the scheme of the instance addresses, http by default
+	schemeLabelName = "api-gateway/scheme"
+)
+
+var metaKeyReplacer = strings.NewReplacer("/", "-", ".", "-")
+
+const (
+	//DefaultAddress is the address of the local Consul agent
+	DefaultAddress = "http://127.0.0.1:8500"
+	//DefaultWaitTime is the time a blocking query waits for a change
+	DefaultWaitTime = 5 * time.Minute
+	//DefaultRetryInterval is the time waited before querying Consul again after an error
+	DefaultRetryInterval = 5 * time.Second
+)
+
+//Options are the Consul connection options, loaded from config.json
+type Options struct {
+	Address    string `mapstructure:"address"`
+	Datacenter string `mapstructure:"datacenter"`
+	Token      string `mapstructure:"token"`
+	//WaitTime is the time a blocking query waits for a change
+	WaitTime      time.Duration `mapstructure:"wait_time"`
+	RetryInterval time.Duration `mapstructure:"retry_interval"`
+}
+
+//ConsulServiceProvider is a service discovery provider implementation, using the Consul catalog.
+//Each service is published with the addresses of its instances passing their health checks
+type ConsulServiceProvider struct {
+	servicediscovery.Subscribers
+	ctx      context.Context
+	stop     context.CancelFunc
+	client   *http.Client
+	options  Options
+	logger   log.Logger
+	mutex    sync.Mutex
+	services map[string]servicediscovery.Service
+	watches  map[string]*healthWatch
+}
+
+//healthWatch is the blocking query on the health of the instances of a Consul service
+type healthWatch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+//healthEntry is an instance returned by the health endpoint
+type healthEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID        string            `json:"ID"`
+		Service   string            `json:"Service"`
+		Tags      []string          `json:"Tags"`
+		Address   string            `json:"Address"`
+		Port      int               `json:"Port"`
+		Meta      map[string]string `json:"Meta"`
+		Namespace string            `json:"Namespace"`
+	} `json:"Service"`
+}
+
+//NewConsulServiceProvider creates a new Consul provider
+func NewConsulServiceProvider(options Options, loggerFactory log.Factory) *ConsulServiceProvider {
+	logger := loggerFactory(nil)
+	logger = logger.With(zap.String("component", "consul_service_provider"))
+
+	if options.Address == "" {
+		options.Address = DefaultAddress
+	}
+	if options.WaitTime <= 0 {
+		options.WaitTime = DefaultWaitTime
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = DefaultRetryInterval
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	return &ConsulServiceProvider{
+		ctx:      ctx,
+		stop:     stop,
+		client:   &http.Client{Timeout: clientTimeout(options.WaitTime)},
+		options:  options,
+		logger:   logger,
+		services: map[string]servicediscovery.Service{},
+		watches:  map[string]*healthWatch{},
+	}
+}
+
+//clientTimeout bounds the blocking queries, Consul answers them after the wait time plus a random jitter of up to a sixteenth of it
+func clientTimeout(waitTime time.Duration) time.Duration {
+	return waitTime + waitTime/16 + 10*time.Second
+}
+
+//Start starts the discovery process
+func Start(provider *ConsulServiceProvider) *ConsulServiceProvider {
+	go watchCatalog(provider)
+	return provider
+}
+
+//watchCatalog follows the services of the catalog and watches the health of each one
+func watchCatalog(provider *ConsulServiceProvider) {
+	var index uint64
+	for {
+		var catalog map[string][]string
+		newIndex, err := query(provider, provider.ctx, "/v1/catalog/services", index, &catalog)
+		if provider.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			provider.logger.Error("ConsulProvider: cannot query the catalog", zap.Error(err))
+			wait(provider.ctx, provider.options.RetryInterval)
+			continue
+		}
+		index = nextIndex(index, newIndex)
+
+		provider.mutex.Lock()
+		for name := range catalog {
+			if _, ok := provider.watches[name]; !ok {
+				ctx, cancel := context.WithCancel(provider.ctx)
+				watch := &healthWatch{ctx, cancel}
+				provider.watches[name] = watch
+				go watchHealth(provider, name, watch)
+			}
+		}
+		for name, watch := range provider.watches {
+			if _, ok := catalog[name]; !ok {
+				watch.cancel()
+				delete(provider.watches, name)
+				removeService(provider, name)
+			}
+		}
+		provider.mutex.Unlock()
+	}
+}
+
+//watchHealth follows the instances of a service passing their health checks
+func watchHealth(provider *ConsulServiceProvider, name string, watch *healthWatch) {
+	var index uint64
+	for {
+		var entries []healthEntry
+		newIndex, err := query(provider, watch.ctx, "/v1/health/service/"+url.PathEscape(name)+"?passing=true", index, &entries)
+		if watch.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			provider.logger.Error("ConsulProvider: cannot query the health of a service", zap.String("service", name), zap.Error(err))
+			wait(watch.ctx, provider.options.RetryInterval)
+			continue
+		}
+		index = nextIndex(index, newIndex)
+
+		provider.mutex.Lock()
+		//the service may have been removed from the catalog during the query
+		if watch.ctx.Err() == nil {
+			setService(provider, name, entries)
+		}
+		provider.mutex.Unlock()
+	}
+}
+
+//setService publishes the changes of a service, which is removed when none of its instances is healthy
+func setService(provider *ConsulServiceProvider, name string, entries []healthEntry) {
+	service, ok := mapToService(name, entries)
+	if !ok {
+		removeService(provider, name)
+		return
+	}
+
+	old, known := provider.services[name]
+	provider.services[name] = service
+	switch {
+	case !known:
+		provider.logger.Info("ConsulProvider: service added", zap.Any("service", service))
+		provider.PublishAdd(service)
+	case !reflect.DeepEqual(old, service):
+		provider.logger.Info("ConsulProvider: service updated", zap.Any("old_service", old), zap.Any("new_service", service))
+		provider.PublishUpdate(old, service)
+	}
+}
+
+func removeService(provider *ConsulServiceProvider, name string) {
+	service, known := provider.services[name]
+	if !known {
+		return
+	}
+	delete(provider.services, name)
+	provider.logger.Info("ConsulProvider: service deleted", zap.Any("service", service))
+	provider.PublishRemove(service)
+}
+
+//mapToService maps the healthy instances of a Consul service, it returns false for the services without a resource or without instances
+func mapToService(name string, entries []healthEntry) (servicediscovery.Service, bool) {
+	if len(entries) == 0 {
+		return servicediscovery.Service{}, false
+	}
+	first := entries[0].Service
+	resource := serviceValue(first.Meta, first.Tags, resourceLabelName)
+	if resource == "" {
+		return servicediscovery.Service{}, false
+	}
+
+	var addresses []string
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		scheme := serviceValue(entry.Service.Meta, entry.Service.Tags, schemeLabelName)
+		if scheme == "" {
+			scheme = "http"
+		}
+		addresses = append(addresses, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	sort.Strings(addresses)
+
+	secured, _ := strconv.ParseBool(serviceValue(first.Meta, first.Tags, securedLabelName))
+	return servicediscovery.Service{
+		UID:          name,
+		Name:         name,
+		Address:      addresses[0],
+		Addresses:    addresses,
+		Resource:     resource,
+		Secured:      secured,
+		OidcAudience: serviceValue(first.Meta, first.Tags, audienceLabelName),
+		Version:      serviceValue(first.Meta, first.Tags, versionLabelName),
+		Namespace:    first.Namespace,
+	}, true
+}
+
+//serviceValue returns the value of a label found in the service meta or tags
+func serviceValue(meta map[string]string, tags []string, label string) string {
+	if value, ok := meta[metaKeyReplacer.Replace(label)]; ok {
+		return value
+	}
+	prefix := label + "="
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix)
+		}
+	}
+	return ""
+}
+
+//query runs a blocking query, which returns when the index of the result changes or when the wait time is over
+func query(provider *ConsulServiceProvider, ctx context.Context, path string, index uint64, result interface{}) (uint64, error) {
+	u, err := url.Parse(strings.TrimRight(provider.options.Address, "/") + path)
+	if err != nil {
+		return 0, err
+	}
+	values := u.Query()
+	values.Set("index", strconv.FormatUint(index, 10))
+	values.Set("wait", strconv.FormatInt(provider.options.WaitTime.Milliseconds(), 10)+"ms")
+	if provider.options.Datacenter != "" {
+		values.Set("dc", provider.options.Datacenter)
+	}
+	u.RawQuery = values.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if provider.options.Token != "" {
+		req.Header.Set("X-Consul-Token", provider.options.Token)
+	}
+
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("consul answered %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+}
+
+//nextIndex sanity checks the index of a blocking query, as recommended by Consul
+func nextIndex(old uint64, new uint64) uint64 {
+	if new < old {
+		return 0
+	}
+	if new == 0 {
+		return 1
+	}
+	return new
+}
+
+func wait(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+//Stop stops the discovery process
+func Stop(provider *ConsulServiceProvider) *ConsulServiceProvider {
+	provider.stop()
+	return provider
+}
+
+//Start implements servicediscovery.Provider
+func (provider *ConsulServiceProvider) Start() {
+	Start(provider)
+}
+
+//Stop implements servicediscovery.Provider
+func (provider *ConsulServiceProvider) Stop() {
+	Stop(provider)
+}
@@ -0,0 +1,179 @@
+package consul
+
+import (
+	"encoding/json"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeConsul is a stand-in for the catalog and health endpoints of the Consul HTTP API, with blocking queries
+type fakeConsul struct {
+	mutex     sync.Mutex
+	index     uint64
+	changed   chan struct{}
+	instances map[string][]fakeInstance
+}
+
+type fakeInstance struct {
+	address string
+	port    int
+	passing bool
+	meta    map[string]string
+	tags    []string
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, changed: make(chan struct{}), instances: map[string][]fakeInstance{}}
+}
+
+func (c *fakeConsul) set(name string, instances ...fakeInstance) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if instances == nil {
+		delete(c.instances, name)
+	} else {
+		c.instances[name] = instances
+	}
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	c.mutex.Lock()
+	if index >= c.index {
+		changed := c.changed
+		c.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+			return
+		}
+		c.mutex.Lock()
+	}
+	defer c.mutex.Unlock()
+
+	var result interface{}
+	switch {
+	case r.URL.Path == "/v1/catalog/services":
+		catalog := map[string][]string{}
+		for name, instances := range c.instances {
+			catalog[name] = instances[0].tags
+		}
+		result = catalog
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		entries := []healthEntry{}
+		for _, instance := range c.instances[name] {
+			if !instance.passing && r.URL.Query().Get("passing") == "true" {
+				continue
+			}
+			var entry healthEntry
+			entry.Node.Address = "10.0.0.100"
+			entry.Service.Service = name
+			entry.Service.Address = instance.address
+			entry.Service.Port = instance.port
+			entry.Service.Meta = instance.meta
+			entry.Service.Tags = instance.tags
+			entries = append(entries, entry)
+		}
+		result = entries
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func TestConsulServiceProvider(t *testing.T) {
+	consul := newFakeConsul()
+	meta := map[string]string{"api-gateway-resource": "offers", "api-gateway-secured": "true", "api-gateway-oidc-audience": "LSNG.Api"}
+	consul.set("offers",
+		fakeInstance{address: "10.0.0.1", port: 8080, passing: true, meta: meta},
+		fakeInstance{address: "10.0.0.2", port: 8080, passing: false, meta: meta},
+	)
+	consul.set("consul", fakeInstance{address: "10.0.0.9", port: 8300, passing: true})
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	added := make(chan servicediscovery.Service, 10)
+	updated := make(chan servicediscovery.Service, 10)
+	removed := make(chan servicediscovery.Service, 10)
+	provider := NewConsulServiceProvider(Options{Address: server.URL, WaitTime: time.Second, RetryInterval: 10 * time.Millisecond}, log.ZapLoggerFactory(zap.NewNop()))
+	if timeout := provider.client.Timeout; timeout <= time.Second+time.Second/16 {
+		t.Errorf("expected the client timeout to exceed the wait time and its jitter, but got %v", timeout)
+	}
+	servicediscovery.Compose(
+		servicediscovery.SubscribeOnAddService(func(service servicediscovery.Service) { added <- service }),
+		servicediscovery.SubscribeOnUpdateService(func(old servicediscovery.Service, new servicediscovery.Service) { updated <- new }),
+		servicediscovery.SubscribeOnRemoveService(func(service servicediscovery.Service) { removed <- service }),
+		servicediscovery.Start,
+	)(provider)
+	defer Stop(provider)
+
+	offers := receive(t, added)
+	expected := servicediscovery.Service{
+		UID:          "offers",
+		Name:         "offers",
+		Address:      "http://10.0.0.1:8080",
+		Addresses:    []string{"http://10.0.0.1:8080"},
+		Resource:     "offers",
+		Secured:      true,
+		OidcAudience: "LSNG.Api",
+	}
+	if !reflect.DeepEqual(offers, expected) {
+		t.Errorf("expected the healthy instances of the service %+v, but got %+v", expected, offers)
+	}
+
+	//the second instance passes its health checks, the tags work as well as the meta
+	tags := []string{"api-gateway/resource=offers", "api-gateway/secured=true", "api-gateway/oidc.audience=LSNG.Api"}
+	consul.set("offers",
+		fakeInstance{address: "10.0.0.1", port: 8080, passing: true, tags: tags},
+		fakeInstance{address: "", port: 8080, passing: true, tags: tags},
+	)
+	if service := receive(t, updated); !reflect.DeepEqual(service.Addresses, []string{"http://10.0.0.100:8080", "http://10.0.0.1:8080"}) {
+		t.Errorf("expected the addresses of the 2 instances, but got %v", service.Addresses)
+	}
+
+	//no healthy instance left
+	consul.set("offers", fakeInstance{address: "10.0.0.1", port: 8080, passing: false, tags: tags})
+	if service := receive(t, removed); service.UID != "offers" {
+		t.Errorf("expected the offers service to be removed, but got %+v", service)
+	}
+
+	consul.set("offers", fakeInstance{address: "10.0.0.1", port: 8080, passing: true, tags: tags})
+	receive(t, added)
+	consul.set("offers")
+	if service := receive(t, removed); service.UID != "offers" {
+		t.Errorf("expected the service removed from the catalog to be removed, but got %+v", service)
+	}
+
+	select {
+	case service := <-added:
+		t.Errorf("expected the services without resource to be ignored, but got %+v", service)
+	default:
+	}
+}
+
+func receive(t *testing.T, services chan servicediscovery.Service) servicediscovery.Service {
+	select {
+	case service := <-services:
+		return service
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a service event")
+	}
+	return servicediscovery.Service{}
+}
@@ -0,0 +1,239 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FileServiceProvider is a service discovery provider implementation, using a YAML or JSON file.
+//The file is watched and the changes are published as added, updated and removed services
+type FileServiceProvider struct {
+	servicediscovery.Subscribers
+	stop     chan struct{}
+	stopOnce sync.Once
+	path     string
+	logger   log.Logger
+	mutex    sync.Mutex
+	services map[string]servicediscovery.Service
+}
+
+//servicesFile is the content of the services file
+type servicesFile struct {
+	Services []serviceConfig `yaml:"services"`
+}
+
+//serviceConfig is a service declared in the services file
+type serviceConfig struct {
+	//UID identifies the service between two versions of the file, namespace/name by default
+	UID       string   `yaml:"uid"`
+	Name      string   `yaml:"name"`
+	Resource  string   `yaml:"resource"`
+	Address   string   `yaml:"address"`
+	Addresses []string `yaml:"addresses"`
+	Secured   bool     `yaml:"secured"`
+	Audience  string   `yaml:"audience"`
+	Version   string   `yaml:"version"`
+	Namespace string   `yaml:"namespace"`
+}
+
+//debounceDelay is the time waited after the last change of the file before reading it, so that a file being written is not read
+const debounceDelay = 100 * time.Millisecond
+
+//NewFileServiceProvider creates a new file provider reading the services from path
+func NewFileServiceProvider(path string, loggerFactory log.Factory) *FileServiceProvider {
+	logger := loggerFactory(nil)
+	logger = logger.With(zap.String("component", "file_service_provider"))
+
+	return &FileServiceProvider{
+		stop:     make(chan struct{}),
+		path:     path,
+		logger:   logger,
+		services: map[string]servicediscovery.Service{},
+	}
+}
+
+//Start publishes the services of the file and starts watching it
+func Start(provider *FileServiceProvider) *FileServiceProvider {
+	reload(provider)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		provider.logger.Error("FileProvider: cannot watch the services file", zap.String("path", provider.path), zap.Error(err))
+		return provider
+	}
+	//the directory is watched, so that the file can be replaced by editors or by a Kubernetes ConfigMap update
+	err = watcher.Add(filepath.Dir(provider.path))
+	if err != nil {
+		provider.logger.Error("FileProvider: cannot watch the services file", zap.String("path", provider.path), zap.Error(err))
+		_ = watcher.Close()
+		return provider
+	}
+
+	go func() {
+		defer watcher.Close()
+		debounce := time.NewTimer(time.Hour)
+		debounce.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					debounce.Reset(debounceDelay)
+				}
+			case <-debounce.C:
+				reload(provider)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				provider.logger.Error("FileProvider: watch error", zap.Error(err))
+			case <-provider.stop:
+				return
+			}
+		}
+	}()
+
+	return provider
+}
+
+//reload reads the services file and publishes the differences with the known services.
+//An invalid file is ignored and the known services are kept
+func reload(provider *FileServiceProvider) {
+	services, err := readServices(provider.path)
+	if err != nil {
+		provider.logger.Error("FileProvider: invalid services file, the current services are kept", zap.String("path", provider.path), zap.Error(err))
+		return
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	for _, uid := range sortedKeys(provider.services) {
+		if _, ok := services[uid]; !ok {
+			service := provider.services[uid]
+			delete(provider.services, uid)
+			provider.logger.Info("FileProvider: service deleted", zap.Any("service", service))
+			provider.PublishRemove(service)
+		}
+	}
+	for _, uid := range sortedKeys(services) {
+		service := services[uid]
+		old, ok := provider.services[uid]
+		provider.services[uid] = service
+		switch {
+		case !ok:
+			provider.logger.Info("FileProvider: service added", zap.Any("service", service))
+			provider.PublishAdd(service)
+		case !reflect.DeepEqual(old, service):
+			provider.logger.Info("FileProvider: service updated", zap.Any("old_service", old), zap.Any("new_service", service))
+			provider.PublishUpdate(old, service)
+		}
+	}
+}
+
+func readServices(path string) (map[string]servicediscovery.Service, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(string(content)) == "" {
+		return nil, errors.New("empty services file")
+	}
+
+	//JSON is a subset of YAML, so both formats are parsed the same way
+	var file servicesFile
+	err = yaml.Unmarshal(content, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	services := map[string]servicediscovery.Service{}
+	for i, cfg := range file.Services {
+		if cfg.Resource == "" {
+			return nil, fmt.Errorf("service %d: missing resource", i)
+		}
+		if cfg.Address == "" && len(cfg.Addresses) == 0 {
+			return nil, fmt.Errorf("service %d: missing address", i)
+		}
+
+		service := mapToService(cfg)
+		if _, ok := services[service.UID]; ok {
+			return nil, errors.New("duplicate service " + service.UID)
+		}
+		services[service.UID] = service
+	}
+	return services, nil
+}
+
+func mapToService(cfg serviceConfig) servicediscovery.Service {
+	name := cfg.Name
+	if name == "" {
+		name = cfg.Resource
+	}
+	uid := cfg.UID
+	if uid == "" {
+		uid = cfg.Namespace + "/" + name
+	}
+	address := cfg.Address
+	if address == "" {
+		address = cfg.Addresses[0]
+	}
+	addresses := cfg.Addresses
+	if len(addresses) == 0 {
+		addresses = nil
+	}
+
+	return servicediscovery.Service{
+		UID:          uid,
+		Name:         name,
+		Address:      address,
+		Addresses:    addresses,
+		Resource:     cfg.Resource,
+		Secured:      cfg.Secured,
+		OidcAudience: cfg.Audience,
+		Version:      cfg.Version,
+		Namespace:    cfg.Namespace,
+	}
+}
+
+func sortedKeys(services map[string]servicediscovery.Service) []string {
+	keys := make([]string, 0, len(services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//Stop stops watching the services file, it can be called more than once
+func Stop(provider *FileServiceProvider) *FileServiceProvider {
+	provider.stopOnce.Do(func() {
+		close(provider.stop)
+	})
+	return provider
+}
+
+//Start implements servicediscovery.Provider
+func (provider *FileServiceProvider) Start() {
+	Start(provider)
+}
+
+//Stop implements servicediscovery.Provider
+func (provider *FileServiceProvider) Stop() {
+	Stop(provider)
+}
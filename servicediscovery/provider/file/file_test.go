@@ -0,0 +1,102 @@
+package file
+
+import (
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileServiceProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	writeFile(t, path, `
+services:
+  - name: offers
+    resource: offers
+    namespace: lsng
+    address: http://offers.lsng
+    secured: true
+    audience: LSNG.Api
+  - name: partners
+    resource: partners
+    namespace: lsng
+    address: http://partners.lsng
+`)
+
+	added := make(chan servicediscovery.Service, 10)
+	updated := make(chan servicediscovery.Service, 10)
+	removed := make(chan servicediscovery.Service, 10)
+	provider := NewFileServiceProvider(path, log.ZapLoggerFactory(zap.NewNop()))
+	servicediscovery.Compose(
+		servicediscovery.SubscribeOnAddService(func(service servicediscovery.Service) { added <- service }),
+		servicediscovery.SubscribeOnUpdateService(func(old servicediscovery.Service, new servicediscovery.Service) { updated <- new }),
+		servicediscovery.SubscribeOnRemoveService(func(service servicediscovery.Service) { removed <- service }),
+		servicediscovery.Start,
+	)(provider)
+	defer Stop(provider)
+
+	offers := receive(t, added)
+	if offers.UID != "lsng/offers" || offers.Address != "http://offers.lsng" || !offers.Secured || offers.OidcAudience != "LSNG.Api" {
+		t.Errorf("unexpected service %+v", offers)
+	}
+	if partners := receive(t, added); partners.Resource != "partners" {
+		t.Errorf("expected the partners service, but got %+v", partners)
+	}
+
+	//invalid files are ignored
+	writeFile(t, path, `services: [{"name": "offers"}]`)
+	time.Sleep(2 * debounceDelay)
+
+	writeFile(t, path, `{"services": [
+		{"name": "offers", "resource": "offers", "namespace": "lsng", "addresses": ["http://10.0.0.1", "http://10.0.0.2"], "secured": true, "audience": "LSNG.Api"},
+		{"name": "dealers", "resource": "dealers", "namespace": "lsng", "address": "http://dealers.lsng"}
+	]}`)
+
+	if service := receive(t, removed); service.Resource != "partners" {
+		t.Errorf("expected the partners service to be removed, but got %+v", service)
+	}
+	if service := receive(t, updated); len(service.Addresses) != 2 || service.Address != "http://10.0.0.1" {
+		t.Errorf("expected the offers addresses to be updated, but got %+v", service)
+	}
+	if service := receive(t, added); service.Resource != "dealers" {
+		t.Errorf("expected the dealers service to be added, but got %+v", service)
+	}
+
+	//the deferred Stop must not panic
+	Stop(provider)
+}
+
+func TestInvalidServicesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	invalid := []string{
+		``,
+		`services: [`,
+		`services: [{"resource": "offers"}]`,
+		`services: [{"resource": "offers", "address": "http://a"}, {"resource": "offers", "address": "http://b"}]`,
+	}
+	for _, content := range invalid {
+		writeFile(t, path, content)
+		if _, err := readServices(path); err == nil {
+			t.Errorf("expected %v to be rejected", content)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, services chan servicediscovery.Service) servicediscovery.Service {
+	select {
+	case service := <-services:
+		return service
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a service event")
+	}
+	return servicediscovery.Service{}
+}
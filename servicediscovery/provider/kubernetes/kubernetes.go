@@ -6,6 +6,7 @@ import (
 	"github.com/osstotalsoft/bifrost/servicediscovery"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
@@ -13,28 +14,44 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 //KubeServiceProvider is a service discovery provider implementation, using Kubernetes
 type KubeServiceProvider struct {
-	onAddServiceHandlers    []servicediscovery.ServiceFunc
-	onRemoveServiceHandlers []servicediscovery.ServiceFunc
-	onUpdateServiceHandlers []func(old servicediscovery.Service, new servicediscovery.Service)
-	stop                    chan struct{}
-	clientset               *kubernetes.Clientset
-	overrideServiceAddress  string
-	logger                  log.Logger
-	filterFunc              func(name string, namespace string) bool
+	servicediscovery.Subscribers
+	stop                   chan struct{}
+	clientset              kubernetes.Interface
+	overrideServiceAddress string
+	logger                 log.Logger
+	filterFunc             func(name string, namespace string) bool
+	endpointSlices         bool
+	mutex                  sync.Mutex
+	services               map[string]*corev1.Service
+	slices                 map[string]map[string]*discoveryv1.EndpointSlice
+	//events are published to the subscribers in order, outside of the mutex
+	events      []serviceEvent
+	dispatching bool
+}
+
+//serviceEvent is a service added (old is nil), removed (new is nil) or updated
+type serviceEvent struct {
+	old *servicediscovery.Service
+	new *servicediscovery.Service
 }
 
 const resourceLabelName = "api-gateway/resource"
 const audienceLabelName = "api-gateway/oidc.audience"
 const securedLabelName = "api-gateway/secured"
+const versionLabelName = "api-gateway/version"
 
 //NewKubernetesServiceDiscoveryProvider creates a new kube provider
 func NewKubernetesServiceDiscoveryProvider(inCluster bool, overrideServiceAddress string,
@@ -65,14 +82,23 @@ func NewKubernetesServiceDiscoveryProvider(inCluster bool, overrideServiceAddres
 		logger.Panic("KubernetesProvider: cannot connect to discovery provider", zap.Error(err))
 	}
 
+	return NewKubeServiceProvider(clientset, overrideServiceAddress, filterServiceNamespaceByPrefix, loggerFactory)
+}
+
+//NewKubeServiceProvider creates a new kube provider using the given clientset
+func NewKubeServiceProvider(clientset kubernetes.Interface, overrideServiceAddress string,
+	filterServiceNamespaceByPrefix string, loggerFactory log.Factory) *KubeServiceProvider {
+
+	logger := loggerFactory(nil)
+	logger = logger.With(zap.String("component", "kubernetes_service_provider"))
+
 	p := &KubeServiceProvider{
-		onAddServiceHandlers:    []servicediscovery.ServiceFunc{},
-		onRemoveServiceHandlers: []servicediscovery.ServiceFunc{},
-		onUpdateServiceHandlers: []func(old servicediscovery.Service, new servicediscovery.Service){},
-		clientset:               clientset,
-		stop:                    make(chan struct{}),
-		overrideServiceAddress:  overrideServiceAddress,
-		logger:                  logger,
+		clientset:              clientset,
+		stop:                   make(chan struct{}),
+		overrideServiceAddress: overrideServiceAddress,
+		logger:                 logger,
+		services:               map[string]*corev1.Service{},
+		slices:                 map[string]map[string]*discoveryv1.EndpointSlice{},
 	}
 
 	if filterServiceNamespaceByPrefix != "" {
@@ -91,61 +117,269 @@ func outOfClusterConfig() (*rest.Config, error) {
 	return clientcmd.BuildConfigFromFlags("", kubeconfig)
 }
 
-func (provider *KubeServiceProvider) allowService(name string, namespace string) bool {
+func (provider *KubeServiceProvider) allowService(srv *corev1.Service) bool {
+	if _, ok := srv.Labels[resourceLabelName]; !ok {
+		return false
+	}
 	if provider.filterFunc != nil {
-		return provider.filterFunc(name, namespace)
+		return provider.filterFunc(srv.Name, srv.Namespace)
 	}
 	return true
 }
 
-//Start starts the discovery process
+//UseEndpointSlices makes the provider watch the EndpointSlices of the services
+//and publish the addresses of the ready pods, so that the gateway balances the requests itself
+func UseEndpointSlices(provider *KubeServiceProvider) *KubeServiceProvider {
+	provider.endpointSlices = true
+	return provider
+}
+
+//Start starts the discovery process.
+//The EndpointSlices are synced before the services are watched, so that the services are published with their ready pods
 func Start(provider *KubeServiceProvider) *KubeServiceProvider {
-	watchlist := newServicesListWatch(provider.clientset.CoreV1().RESTClient())
+	watchlist := newServicesListWatch(provider.clientset)
 	_, controller := cache.NewInformer(watchlist, &corev1.Service{}, time.Second*0, cache.ResourceEventHandlerFuncs{
 		AddFunc:    addFunc(provider),
 		DeleteFunc: deleteFunc(provider),
 		UpdateFunc: updateFunc(provider),
 	})
 
-	go controller.Run(provider.stop)
+	if provider.endpointSlices && provider.overrideServiceAddress != "" {
+		provider.logger.Warn("KubernetesProvider: the EndpointSlices are ignored when the service address is overridden")
+	}
+	if !provider.useEndpointSlices() {
+		go controller.Run(provider.stop)
+		return provider
+	}
+
+	sliceWatchlist := newEndpointSlicesListWatch(provider.clientset)
+	_, sliceController := cache.NewInformer(sliceWatchlist, &discoveryv1.EndpointSlice{}, time.Second*0, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			setEndpointSlice(provider, obj.(*discoveryv1.EndpointSlice))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			setEndpointSlice(provider, newObj.(*discoveryv1.EndpointSlice))
+		},
+		DeleteFunc: func(obj interface{}) {
+			deleteEndpointSlice(provider, tombstoneObject(obj).(*discoveryv1.EndpointSlice))
+		},
+	})
+	go sliceController.Run(provider.stop)
+	go func() {
+		if cache.WaitForCacheSync(provider.stop, sliceController.HasSynced) {
+			controller.Run(provider.stop)
+		}
+	}()
+
 	return provider
 }
 
+//useEndpointSlices tells if the pod addresses are published, they cannot be reached when the service address is overridden
+func (provider *KubeServiceProvider) useEndpointSlices() bool {
+	return provider.endpointSlices && provider.overrideServiceAddress == ""
+}
+
 func updateFunc(provider *KubeServiceProvider) func(oldObj, newObj interface{}) {
 	return func(oldObj, newObj interface{}) {
 		oldSrv := oldObj.(*corev1.Service)
 		newSrv := newObj.(*corev1.Service)
 
-		if !provider.allowService(newSrv.Name, newSrv.Namespace) {
+		if !provider.allowService(newSrv) {
 			return
 		}
+
+		provider.mutex.Lock()
+		provider.services[serviceKey(newSrv.Namespace, newSrv.Name)] = newSrv
 		provider.logger.Info("KubernetesProvider: service updated", zap.Any("old_service", oldSrv), zap.Any("new_service", newSrv))
-		callUpdateSubscribers(provider.onUpdateServiceHandlers,
-			mapToService(oldSrv, provider.overrideServiceAddress),
-			mapToService(newSrv, provider.overrideServiceAddress))
+		oldService, newService := provider.mapToService(oldSrv), provider.mapToService(newSrv)
+		provider.events = append(provider.events, serviceEvent{&oldService, &newService})
+		provider.mutex.Unlock()
+
+		dispatch(provider)
 	}
 }
 
 func deleteFunc(provider *KubeServiceProvider) func(obj interface{}) {
 	return func(obj interface{}) {
-		srv := obj.(*corev1.Service)
-		if !provider.allowService(srv.Name, srv.Namespace) {
+		srv := tombstoneObject(obj).(*corev1.Service)
+		if !provider.allowService(srv) {
 			return
 		}
+
+		provider.mutex.Lock()
+		service := provider.mapToService(srv)
+		delete(provider.services, serviceKey(srv.Namespace, srv.Name))
 		provider.logger.Info("KubernetesProvider: service deleted", zap.Any("service", srv))
-		callSubscribers(provider.onRemoveServiceHandlers, mapToService(srv, provider.overrideServiceAddress))
+		provider.events = append(provider.events, serviceEvent{&service, nil})
+		provider.mutex.Unlock()
+
+		dispatch(provider)
 	}
 }
 
 func addFunc(provider *KubeServiceProvider) func(obj interface{}) {
 	return func(obj interface{}) {
 		srv := obj.(*corev1.Service)
-		if !provider.allowService(srv.Name, srv.Namespace) {
+		if !provider.allowService(srv) {
 			return
 		}
+
+		provider.mutex.Lock()
+		provider.services[serviceKey(srv.Namespace, srv.Name)] = srv
 		provider.logger.Info("KubernetesProvider: service added", zap.Any("service", srv))
-		callSubscribers(provider.onAddServiceHandlers, mapToService(srv, provider.overrideServiceAddress))
+		service := provider.mapToService(srv)
+		provider.events = append(provider.events, serviceEvent{nil, &service})
+		provider.mutex.Unlock()
+
+		dispatch(provider)
+	}
+}
+
+//dispatch publishes the queued events to the subscribers, without holding the mutex.
+//Only one goroutine publishes at a time, so that the subscribers see the events in order
+func dispatch(provider *KubeServiceProvider) {
+	provider.mutex.Lock()
+	if provider.dispatching {
+		provider.mutex.Unlock()
+		return
+	}
+	provider.dispatching = true
+	for len(provider.events) > 0 {
+		event := provider.events[0]
+		provider.events = provider.events[1:]
+		provider.mutex.Unlock()
+
+		switch {
+		case event.old == nil:
+			provider.PublishAdd(*event.new)
+		case event.new == nil:
+			provider.PublishRemove(*event.old)
+		default:
+			provider.PublishUpdate(*event.old, *event.new)
+		}
+
+		provider.mutex.Lock()
 	}
+	provider.dispatching = false
+	provider.mutex.Unlock()
+}
+
+//setEndpointSlice stores an EndpointSlice and publishes the new addresses of its service
+func setEndpointSlice(provider *KubeServiceProvider, slice *discoveryv1.EndpointSlice) {
+	changeEndpointSlices(provider, slice, func(slices map[string]*discoveryv1.EndpointSlice) {
+		slices[slice.Name] = slice
+	})
+}
+
+//deleteEndpointSlice forgets an EndpointSlice and publishes the new addresses of its service
+func deleteEndpointSlice(provider *KubeServiceProvider, slice *discoveryv1.EndpointSlice) {
+	changeEndpointSlices(provider, slice, func(slices map[string]*discoveryv1.EndpointSlice) {
+		delete(slices, slice.Name)
+	})
+}
+
+func changeEndpointSlices(provider *KubeServiceProvider, slice *discoveryv1.EndpointSlice, change func(slices map[string]*discoveryv1.EndpointSlice)) {
+	key := serviceKey(slice.Namespace, slice.Labels[discoveryv1.LabelServiceName])
+
+	provider.mutex.Lock()
+	slices, ok := provider.slices[key]
+	if !ok {
+		slices = map[string]*discoveryv1.EndpointSlice{}
+		provider.slices[key] = slices
+	}
+
+	srv, known := provider.services[key]
+	var oldService servicediscovery.Service
+	if known {
+		oldService = provider.mapToService(srv)
+	}
+
+	change(slices)
+	if len(slices) == 0 {
+		delete(provider.slices, key)
+	}
+
+	if !known {
+		provider.mutex.Unlock()
+		return
+	}
+	newService := provider.mapToService(srv)
+	if reflect.DeepEqual(oldService.Addresses, newService.Addresses) {
+		provider.mutex.Unlock()
+		return
+	}
+
+	provider.logger.Info("KubernetesProvider: service addresses changed", zap.String("service", key), zap.Strings("addresses", newService.Addresses))
+	provider.events = append(provider.events, serviceEvent{&oldService, &newService})
+	provider.mutex.Unlock()
+
+	dispatch(provider)
+}
+
+//serviceAddresses returns the addresses of the ready pods of a service, found in its EndpointSlices, or nil if they are not known.
+//The port is the target of the service port used by the gateway, the port 80 or else the first one
+func (provider *KubeServiceProvider) serviceAddresses(srv *corev1.Service) []string {
+	if !provider.useEndpointSlices() || len(srv.Spec.Ports) == 0 {
+		return nil
+	}
+	slices := provider.slices[serviceKey(srv.Namespace, srv.Name)]
+	//the services without selector, ex: ExternalName, have no pods unless their EndpointSlices are managed by hand
+	if len(srv.Spec.Selector) == 0 && len(slices) == 0 {
+		return nil
+	}
+
+	servicePort := srv.Spec.Ports[0]
+	for _, p := range srv.Spec.Ports {
+		if p.Port == 80 {
+			servicePort = p
+			break
+		}
+	}
+
+	addresses := []string{}
+	for _, slice := range slices {
+		port, ok := endpointSlicePort(slice, servicePort.Name)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				addresses = append(addresses, "http://"+net.JoinHostPort(address, strconv.Itoa(int(port))))
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func endpointSlicePort(slice *discoveryv1.EndpointSlice, name string) (int32, bool) {
+	for _, p := range slice.Ports {
+		if p.Port != nil && (p.Name == nil && name == "" || p.Name != nil && *p.Name == name) {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+func (provider *KubeServiceProvider) mapToService(srv *corev1.Service) servicediscovery.Service {
+	service := mapToService(srv, provider.overrideServiceAddress)
+	service.Addresses = provider.serviceAddresses(srv)
+	return service
+}
+
+func serviceKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+//tombstoneObject returns the last known state of an object deleted while the watch was disconnected
+func tombstoneObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
 }
 
 func mapToService(srv *corev1.Service, overrideServiceAddress string) servicediscovery.Service {
@@ -155,9 +389,13 @@ func mapToService(srv *corev1.Service, overrideServiceAddress string) servicedis
 	if overrideServiceAddress != "" {
 		address = overrideServiceAddress
 	}
+	version := srv.Labels[versionLabelName]
+	if version == "" {
+		version = srv.ResourceVersion
+	}
 	return servicediscovery.Service{
 		Address:      address,
-		Version:      srv.ResourceVersion,
+		Version:      version,
 		UID:          string(srv.UID),
 		Name:         srv.Name,
 		Resource:     srv.Labels[resourceLabelName],
@@ -167,40 +405,30 @@ func mapToService(srv *corev1.Service, overrideServiceAddress string) servicedis
 	}
 }
 
-// to apply modification to ListOptions with a field selector, a label selector, or any other desired options.
-func newServicesListWatch(c cache.Getter) *cache.ListWatch {
-	resource := "services"
+func newServicesListWatch(clientset kubernetes.Interface) *cache.ListWatch {
 	listFunc := func(options metav1.ListOptions) (runtime.Object, error) {
 		options.LabelSelector = resourceLabelName
-		return c.Get().
-			//Namespace(namespace).
-			Resource(resource).
-			VersionedParams(&options, metav1.ParameterCodec).
-			Do(context.TODO()).
-			Get()
+		return clientset.CoreV1().Services(metav1.NamespaceAll).List(context.TODO(), options)
 	}
 	watchFunc := func(options metav1.ListOptions) (watch.Interface, error) {
 		options.Watch = true
 		options.LabelSelector = resourceLabelName
-		return c.Get().
-			//Namespace(namespace).
-			Resource(resource).
-			VersionedParams(&options, metav1.ParameterCodec).
-			Watch(context.TODO())
+		return clientset.CoreV1().Services(metav1.NamespaceAll).Watch(context.TODO(), options)
 	}
 	return &cache.ListWatch{ListFunc: listFunc, WatchFunc: watchFunc}
 }
 
-func callSubscribers(handlers []servicediscovery.ServiceFunc, service servicediscovery.Service) {
-	for _, fn := range handlers {
-		fn(service)
+func newEndpointSlicesListWatch(clientset kubernetes.Interface) *cache.ListWatch {
+	listFunc := func(options metav1.ListOptions) (runtime.Object, error) {
+		options.LabelSelector = discoveryv1.LabelServiceName
+		return clientset.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(context.TODO(), options)
 	}
-}
-
-func callUpdateSubscribers(handlers []func(old servicediscovery.Service, new servicediscovery.Service), old servicediscovery.Service, new servicediscovery.Service) {
-	for _, fn := range handlers {
-		fn(old, new)
+	watchFunc := func(options metav1.ListOptions) (watch.Interface, error) {
+		options.Watch = true
+		options.LabelSelector = discoveryv1.LabelServiceName
+		return clientset.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).Watch(context.TODO(), options)
 	}
+	return &cache.ListWatch{ListFunc: listFunc, WatchFunc: watchFunc}
 }
 
 //Stop stops the discovery process
@@ -209,36 +437,12 @@ func Stop(provider *KubeServiceProvider) *KubeServiceProvider {
 	return provider
 }
 
-//SubscribeOnAddService registers some handlers to be called when a new service is found
-func SubscribeOnAddService(f servicediscovery.ServiceFunc) func(provider *KubeServiceProvider) *KubeServiceProvider {
-	return func(provider *KubeServiceProvider) *KubeServiceProvider {
-		provider.onAddServiceHandlers = append(provider.onAddServiceHandlers, f)
-		return provider
-	}
-}
-
-//SubscribeOnRemoveService registers some handlers to be called when a service is removed
-func SubscribeOnRemoveService(f servicediscovery.ServiceFunc) func(provider *KubeServiceProvider) *KubeServiceProvider {
-	return func(provider *KubeServiceProvider) *KubeServiceProvider {
-		provider.onRemoveServiceHandlers = append(provider.onRemoveServiceHandlers, f)
-		return provider
-	}
+//Start implements servicediscovery.Provider
+func (provider *KubeServiceProvider) Start() {
+	Start(provider)
 }
 
-//SubscribeOnUpdateService registers some handlers to be called when a service gets updated
-func SubscribeOnUpdateService(f func(old servicediscovery.Service, new servicediscovery.Service)) func(provider *KubeServiceProvider) *KubeServiceProvider {
-	return func(provider *KubeServiceProvider) *KubeServiceProvider {
-		provider.onUpdateServiceHandlers = append(provider.onUpdateServiceHandlers, f)
-		return provider
-	}
-}
-
-//Compose composes provider functions
-func Compose(funcs ...func(p *KubeServiceProvider) *KubeServiceProvider) func(p *KubeServiceProvider) *KubeServiceProvider {
-	return func(p *KubeServiceProvider) *KubeServiceProvider {
-		for _, f := range funcs {
-			p = f(p)
-		}
-		return p
-	}
+//Stop implements servicediscovery.Provider
+func (provider *KubeServiceProvider) Stop() {
+	Stop(provider)
 }
@@ -0,0 +1,186 @@
+package kubernetes
+
+import (
+	"context"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEndpointSlices(t *testing.T) {
+	offers := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "offers", Namespace: "lsng", UID: "1", Labels: map[string]string{resourceLabelName: "offers"}},
+		Spec: corev1.ServiceSpec{Selector: map[string]string{"app": "offers"}, Ports: []corev1.ServicePort{
+			{Name: "grpc", Port: 5000},
+			{Name: "http", Port: 80},
+		}},
+	}
+	unlabelled := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "partners", Namespace: "lsng", UID: "2"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	slice := endpointSlice("offers-abc", "offers",
+		discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(true)}},
+		discoveryv1.Endpoint{Addresses: []string{"10.0.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(false)}},
+	)
+
+	clientset := fake.NewSimpleClientset(offers, unlabelled, slice)
+	watching := watchStarted(clientset)
+
+	added := make(chan servicediscovery.Service, 10)
+	updated := make(chan servicediscovery.Service, 10)
+	removed := make(chan servicediscovery.Service, 10)
+	provider := UseEndpointSlices(NewKubeServiceProvider(clientset, "", "", log.ZapLoggerFactory(zap.NewNop())))
+	servicediscovery.Compose(
+		servicediscovery.SubscribeOnAddService(func(service servicediscovery.Service) { added <- service }),
+		servicediscovery.SubscribeOnUpdateService(func(old servicediscovery.Service, new servicediscovery.Service) { updated <- new }),
+		servicediscovery.SubscribeOnRemoveService(func(service servicediscovery.Service) { removed <- service }),
+		servicediscovery.Start,
+	)(provider)
+	defer Stop(provider)
+
+	for i := 0; i < 2; i++ {
+		<-watching
+	}
+
+	service := receive(t, added)
+	if service.UID != "1" || service.Address != "http://offers.lsng" {
+		t.Fatalf("expected the labelled service to be added, but got %v", service)
+	}
+	expectAddresses(t, service, "http://10.0.0.1:8080")
+
+	slice.Endpoints[1].Conditions.Ready = boolPtr(true)
+	_, _ = clientset.DiscoveryV1().EndpointSlices("lsng").Update(context.TODO(), slice, metav1.UpdateOptions{})
+	expectAddresses(t, receive(t, updated), "http://10.0.0.1:8080", "http://10.0.0.2:8080")
+
+	other := endpointSlice("offers-def", "offers", discoveryv1.Endpoint{Addresses: []string{"10.0.0.3"}})
+	_, _ = clientset.DiscoveryV1().EndpointSlices("lsng").Create(context.TODO(), other, metav1.CreateOptions{})
+	expectAddresses(t, receive(t, updated), "http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080")
+
+	_ = clientset.DiscoveryV1().EndpointSlices("lsng").Delete(context.TODO(), "offers-abc", metav1.DeleteOptions{})
+	expectAddresses(t, receive(t, updated), "http://10.0.0.3:8080")
+
+	_ = clientset.CoreV1().Services("lsng").Delete(context.TODO(), "offers", metav1.DeleteOptions{})
+	if service := receive(t, removed); service.UID != "1" {
+		t.Errorf("expected the service to be removed, but got %v", service)
+	}
+
+	select {
+	case service := <-added:
+		t.Errorf("expected the unlabelled service to be ignored, but got %v", service)
+	default:
+	}
+}
+
+func TestServiceWithoutReadyPods(t *testing.T) {
+	offers := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "offers", Namespace: "lsng", UID: "1", Labels: map[string]string{resourceLabelName: "offers"}},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "offers"}, Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	external := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "partners", Namespace: "lsng", UID: "2", Labels: map[string]string{resourceLabelName: "partners"}},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: "partners.example.com", Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	slice := endpointSlice("offers-abc", "offers",
+		discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: boolPtr(false)}},
+	)
+
+	clientset := fake.NewSimpleClientset(offers, external, slice)
+	added := make(chan servicediscovery.Service, 10)
+	provider := UseEndpointSlices(NewKubeServiceProvider(clientset, "", "", log.ZapLoggerFactory(zap.NewNop())))
+	servicediscovery.Compose(
+		servicediscovery.SubscribeOnAddService(func(service servicediscovery.Service) { added <- service }),
+		servicediscovery.Start,
+	)(provider)
+	defer Stop(provider)
+
+	services := map[string]servicediscovery.Service{}
+	for i := 0; i < 2; i++ {
+		service := receive(t, added)
+		services[service.Name] = service
+	}
+	if addresses := services["offers"].Addresses; addresses == nil || len(addresses) != 0 {
+		t.Errorf("expected no address for a service without ready pods, but got %#v", addresses)
+	}
+	if addresses := services["partners"].Addresses; addresses != nil {
+		t.Errorf("expected the addresses of a service without selector to be unknown, but got %#v", addresses)
+	}
+}
+
+func TestOverriddenServiceAddress(t *testing.T) {
+	offers := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "offers", Namespace: "lsng", UID: "1", Labels: map[string]string{resourceLabelName: "offers"}},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "offers"}, Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+	slice := endpointSlice("offers-abc", "offers", discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}})
+
+	clientset := fake.NewSimpleClientset(offers, slice)
+	added := make(chan servicediscovery.Service, 10)
+	provider := UseEndpointSlices(NewKubeServiceProvider(clientset, "http://localhost:5000", "", log.ZapLoggerFactory(zap.NewNop())))
+	servicediscovery.Compose(
+		servicediscovery.SubscribeOnAddService(func(service servicediscovery.Service) { added <- service }),
+		servicediscovery.Start,
+	)(provider)
+	defer Stop(provider)
+
+	service := receive(t, added)
+	if service.Address != "http://localhost:5000" || service.Addresses != nil {
+		t.Errorf("expected the overridden address to be used instead of the pod addresses, but got %+v", service)
+	}
+}
+
+//watchStarted signals when the informers start watching, so that the changes made after are not missed
+func watchStarted(clientset *fake.Clientset) chan struct{} {
+	watching := make(chan struct{}, 2)
+	clientset.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := clientset.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		watching <- struct{}{}
+		return true, w, err
+	})
+	return watching
+}
+
+func endpointSlice(name string, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	portName, port := "http", int32(8080)
+	grpcPortName, grpcPort := "grpc", int32(5000)
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta:  metav1.ObjectMeta{Name: name, Namespace: "lsng", Labels: map[string]string{discoveryv1.LabelServiceName: service}},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports: []discoveryv1.EndpointPort{
+			{Name: &grpcPortName, Port: &grpcPort},
+			{Name: &portName, Port: &port},
+		},
+	}
+}
+
+func receive(t *testing.T, events chan servicediscovery.Service) servicediscovery.Service {
+	t.Helper()
+	select {
+	case service := <-events:
+		return service
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a service event")
+	}
+	return servicediscovery.Service{}
+}
+
+func expectAddresses(t *testing.T, service servicediscovery.Service, addresses ...string) {
+	t.Helper()
+	if !reflect.DeepEqual(service.Addresses, addresses) {
+		t.Errorf("expected addresses %v, but got %v", addresses, service.Addresses)
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
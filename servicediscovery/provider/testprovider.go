@@ -9,6 +9,7 @@ import (
 type TestProvider struct {
 	onRegisterHandlers   []servicediscovery.ServiceFunc
 	onUnRegisterHandlers []servicediscovery.ServiceFunc
+	onUpdateHandlers     []func(old servicediscovery.Service, new servicediscovery.Service)
 }
 
 //NewTestProvider create a test provider
@@ -17,6 +18,7 @@ func NewTestProvider() *TestProvider {
 	return &TestProvider{
 		onRegisterHandlers:   []servicediscovery.ServiceFunc{},
 		onUnRegisterHandlers: []servicediscovery.ServiceFunc{},
+		onUpdateHandlers:     []func(old servicediscovery.Service, new servicediscovery.Service){},
 	}
 }
 
@@ -67,6 +69,30 @@ func Start(provider *TestProvider) *TestProvider {
 	return provider
 }
 
+//SubscribeOnAddService implements servicediscovery.Provider
+func (provider *TestProvider) SubscribeOnAddService(f servicediscovery.ServiceFunc) {
+	provider.onRegisterHandlers = append(provider.onRegisterHandlers, f)
+}
+
+//SubscribeOnRemoveService implements servicediscovery.Provider, the test services are never removed
+func (provider *TestProvider) SubscribeOnRemoveService(f servicediscovery.ServiceFunc) {
+	provider.onUnRegisterHandlers = append(provider.onUnRegisterHandlers, f)
+}
+
+//SubscribeOnUpdateService implements servicediscovery.Provider, the test services are never updated
+func (provider *TestProvider) SubscribeOnUpdateService(f func(old servicediscovery.Service, new servicediscovery.Service)) {
+	provider.onUpdateHandlers = append(provider.onUpdateHandlers, f)
+}
+
+//Start implements servicediscovery.Provider
+func (provider *TestProvider) Start() {
+	Start(provider)
+}
+
+//Stop implements servicediscovery.Provider
+func (provider *TestProvider) Stop() {
+}
+
 func callAllSubscribers(handlers []servicediscovery.ServiceFunc, service servicediscovery.Service) {
 
 	log.Printf("Added new service: %v", service)
@@ -1,46 +1,95 @@
 package inmemory
 
 import (
-	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry"
+	"sort"
 	"sync"
 )
 
 type inMemoryRegistryData struct {
-	m        sync.RWMutex
-	internal map[string]servicediscovery.Service
+	m           sync.RWMutex
+	internal    map[string]registry.Entry
+	watchers    map[int]func(event registry.Event)
+	nextWatcher int
 }
 
+//NewInMemoryStore creates a registry keeping the entries in memory
 func NewInMemoryStore() *inMemoryRegistryData {
 	return &inMemoryRegistryData{
-		internal: make(map[string]servicediscovery.Service),
+		internal: make(map[string]registry.Entry),
+		watchers: make(map[int]func(event registry.Event)),
 	}
 }
 
-func (rm *inMemoryRegistryData) Load(key string) (value servicediscovery.Service, ok bool) {
+//Load returns the entry of a service
+func (rm *inMemoryRegistryData) Load(uid string) (registry.Entry, bool) {
 	rm.m.RLock()
-	result, ok := rm.internal[key]
+	result, ok := rm.internal[uid]
 	rm.m.RUnlock()
 	return result, ok
 }
 
-func (rm *inMemoryRegistryData) GetAll() []servicediscovery.Service {
+//List returns all the entries, ordered by service UID
+func (rm *inMemoryRegistryData) List() []registry.Entry {
 	rm.m.RLock()
-	var result []servicediscovery.Service
+	result := make([]registry.Entry, 0, len(rm.internal))
 	for _, value := range rm.internal {
 		result = append(result, value)
 	}
 	rm.m.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Service.UID < result[j].Service.UID
+	})
 	return result
 }
 
-func (rm *inMemoryRegistryData) Delete(key string) {
+//Delete removes the entry of a service
+func (rm *inMemoryRegistryData) Delete(uid string) {
 	rm.m.Lock()
-	delete(rm.internal, key)
+	entry, ok := rm.internal[uid]
+	delete(rm.internal, uid)
 	rm.m.Unlock()
+
+	if ok {
+		rm.notify(registry.Event{Type: registry.EntryDeleted, Entry: entry})
+	}
 }
 
-func (rm *inMemoryRegistryData) Store(key string, value servicediscovery.Service) {
+//Store adds or replaces the entry of a service
+func (rm *inMemoryRegistryData) Store(entry registry.Entry) {
 	rm.m.Lock()
-	rm.internal[key] = value
+	rm.internal[entry.Service.UID] = entry
 	rm.m.Unlock()
+
+	rm.notify(registry.Event{Type: registry.EntryStored, Entry: entry})
+}
+
+//Watch registers a handler called after each change of an entry, the returned function unregisters it
+func (rm *inMemoryRegistryData) Watch(f func(event registry.Event)) func() {
+	rm.m.Lock()
+	id := rm.nextWatcher
+	rm.nextWatcher++
+	rm.watchers[id] = f
+	rm.m.Unlock()
+
+	return func() {
+		rm.m.Lock()
+		delete(rm.watchers, id)
+		rm.m.Unlock()
+	}
+}
+
+//notify calls the watchers outside of the lock, so that they can query the registry
+func (rm *inMemoryRegistryData) notify(event registry.Event) {
+	rm.m.RLock()
+	watchers := make([]func(event registry.Event), 0, len(rm.watchers))
+	for _, f := range rm.watchers {
+		watchers = append(watchers, f)
+	}
+	rm.m.RUnlock()
+
+	for _, f := range watchers {
+		f(event)
+	}
 }
@@ -0,0 +1,48 @@
+package inmemory
+
+import (
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+	"github.com/osstotalsoft/bifrost/servicediscovery/registry"
+	"reflect"
+	"testing"
+)
+
+func TestInMemoryStore(t *testing.T) {
+	store := NewInMemoryStore()
+
+	var events []string
+	cancel := store.Watch(func(event registry.Event) {
+		events = append(events, string(event.Type)+" "+event.Entry.Service.UID)
+	})
+
+	store.Store(registry.Entry{Service: servicediscovery.Service{UID: "2", Resource: "partners"}, Routes: []string{"r2"}})
+	store.Store(registry.Entry{Service: servicediscovery.Service{UID: "1", Resource: "offers"}, Routes: []string{"r1"}})
+	store.Store(registry.Entry{Service: servicediscovery.Service{UID: "1", Resource: "offers"}, Routes: []string{"r3"}})
+
+	entry, ok := store.Load("1")
+	if !ok || !reflect.DeepEqual(entry.Routes, []string{"r3"}) {
+		t.Errorf("expected the last entry stored, but got %+v", entry)
+	}
+
+	var uids []string
+	for _, entry := range store.List() {
+		uids = append(uids, entry.Service.UID)
+	}
+	if !reflect.DeepEqual(uids, []string{"1", "2"}) {
+		t.Errorf("expected the entries ordered by UID, but got %v", uids)
+	}
+
+	store.Delete("2")
+	store.Delete("unknown")
+	if _, ok := store.Load("2"); ok {
+		t.Error("expected the entry to be deleted")
+	}
+
+	cancel()
+	store.Delete("1")
+
+	expected := []string{"stored 2", "stored 1", "stored 1", "deleted 2"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected the events %v, but got %v", expected, events)
+	}
+}
@@ -1,4 +1,47 @@
 package registry
 
-//type ServiceRegistryLoader func(serviceName string) (service servicediscovery.Service, ok bool)
-//type ServiceRegistrySaver func(service servicediscovery.Service) error
+import (
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/servicediscovery"
+)
+
+//Entry is a discovered service together with the endpoints and the routes the gateway created for it
+type Entry struct {
+	Service   servicediscovery.Service
+	Endpoints []abstraction.Endpoint
+	//Routes are the ids of the routes of the endpoints, in the same order, empty when a route could not be added.
+	//The routes of a traffic split are shared with the other versions of the service
+	Routes []string
+	//Targets are the upstream addresses of the service, shared by its endpoints
+	Targets *abstraction.UpstreamTargets
+}
+
+//EventType is the kind of change of a registry entry
+type EventType string
+
+const (
+	//EntryStored is raised when an entry is added or replaced
+	EntryStored EventType = "stored"
+	//EntryDeleted is raised when an entry is removed
+	EntryDeleted EventType = "deleted"
+)
+
+//Event is a change of a registry entry
+type Event struct {
+	Type  EventType
+	Entry Entry
+}
+
+//Registry tracks the discovered services, it is the source of truth for the services known by the gateway
+type Registry interface {
+	//Store adds or replaces the entry of a service, by service UID
+	Store(entry Entry)
+	//Delete removes the entry of a service
+	Delete(uid string)
+	//Load returns the entry of a service
+	Load(uid string) (Entry, bool)
+	//List returns all the entries, ordered by service UID
+	List() []Entry
+	//Watch registers a handler called after each change of an entry, the returned function unregisters it
+	Watch(f func(event Event)) (cancel func())
+}
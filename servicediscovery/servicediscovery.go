@@ -2,9 +2,12 @@ package servicediscovery
 
 //Service is the main component of a service discovery
 type Service struct {
-	UID          string
-	Name         string
-	Address      string
+	UID     string
+	Name    string
+	Address string
+	//Addresses are the addresses of the ready instances of the service, nil when they are not known and the Address is used.
+	//An empty list means that no instance is ready
+	Addresses    []string
 	Resource     string
 	Secured      bool
 	OidcAudience string
@@ -14,3 +17,17 @@ type Service struct {
 
 //ServiceFunc is an alias
 type ServiceFunc func(service Service)
+
+//Provider is a source of services which publishes the services it finds, changes or loses to the subscribed handlers
+type Provider interface {
+	//SubscribeOnAddService registers a handler to be called when a new service is found
+	SubscribeOnAddService(f ServiceFunc)
+	//SubscribeOnRemoveService registers a handler to be called when a service is removed
+	SubscribeOnRemoveService(f ServiceFunc)
+	//SubscribeOnUpdateService registers a handler to be called when a service gets updated
+	SubscribeOnUpdateService(f func(old Service, new Service))
+	//Start starts the discovery process
+	Start()
+	//Stop stops the discovery process
+	Stop()
+}
@@ -0,0 +1,85 @@
+package servicediscovery
+
+//Subscribers are the handlers subscribed to the changes of a provider.
+//A provider embeds them to implement the subscriptions of the Provider interface
+type Subscribers struct {
+	onAddServiceHandlers    []ServiceFunc
+	onRemoveServiceHandlers []ServiceFunc
+	onUpdateServiceHandlers []func(old Service, new Service)
+}
+
+//SubscribeOnAddService registers a handler to be called when a new service is found
+func (s *Subscribers) SubscribeOnAddService(f ServiceFunc) {
+	s.onAddServiceHandlers = append(s.onAddServiceHandlers, f)
+}
+
+//SubscribeOnRemoveService registers a handler to be called when a service is removed
+func (s *Subscribers) SubscribeOnRemoveService(f ServiceFunc) {
+	s.onRemoveServiceHandlers = append(s.onRemoveServiceHandlers, f)
+}
+
+//SubscribeOnUpdateService registers a handler to be called when a service gets updated
+func (s *Subscribers) SubscribeOnUpdateService(f func(old Service, new Service)) {
+	s.onUpdateServiceHandlers = append(s.onUpdateServiceHandlers, f)
+}
+
+//PublishAdd calls the handlers subscribed to the new services
+func (s *Subscribers) PublishAdd(service Service) {
+	for _, fn := range s.onAddServiceHandlers {
+		fn(service)
+	}
+}
+
+//PublishRemove calls the handlers subscribed to the removed services
+func (s *Subscribers) PublishRemove(service Service) {
+	for _, fn := range s.onRemoveServiceHandlers {
+		fn(service)
+	}
+}
+
+//PublishUpdate calls the handlers subscribed to the updated services
+func (s *Subscribers) PublishUpdate(old Service, new Service) {
+	for _, fn := range s.onUpdateServiceHandlers {
+		fn(old, new)
+	}
+}
+
+//SubscribeOnAddService registers a handler to be called when a new service is found
+func SubscribeOnAddService(f ServiceFunc) func(provider Provider) Provider {
+	return func(provider Provider) Provider {
+		provider.SubscribeOnAddService(f)
+		return provider
+	}
+}
+
+//SubscribeOnRemoveService registers a handler to be called when a service is removed
+func SubscribeOnRemoveService(f ServiceFunc) func(provider Provider) Provider {
+	return func(provider Provider) Provider {
+		provider.SubscribeOnRemoveService(f)
+		return provider
+	}
+}
+
+//SubscribeOnUpdateService registers a handler to be called when a service gets updated
+func SubscribeOnUpdateService(f func(old Service, new Service)) func(provider Provider) Provider {
+	return func(provider Provider) Provider {
+		provider.SubscribeOnUpdateService(f)
+		return provider
+	}
+}
+
+//Start starts the discovery process of a provider
+func Start(provider Provider) Provider {
+	provider.Start()
+	return provider
+}
+
+//Compose composes provider functions
+func Compose(funcs ...func(p Provider) Provider) func(p Provider) Provider {
+	return func(p Provider) Provider {
+		for _, f := range funcs {
+			p = f(p)
+		}
+		return p
+	}
+}
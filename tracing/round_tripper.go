@@ -1,9 +1,11 @@
 package tracing
 
 import (
-	"github.com/opentracing/opentracing-go"
-	"github.com/opentracing/opentracing-go/ext"
-	"github.com/opentracing/opentracing-go/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 )
 
@@ -11,31 +13,34 @@ type roundTripper struct {
 	http.RoundTripper
 }
 
-//NewRoundTripperWithOpenTrancing creates a new roundTripper with OpenTracing
+//NewRoundTripperWithOpenTrancing creates a new roundTripper with OpenTelemetry
 func NewRoundTripperWithOpenTrancing() *roundTripper {
 	return &roundTripper{RoundTripper: http.DefaultTransport}
 }
 
-//RoundTrip starts a opentracing span and then delegates the request to the actual roundtripper
+//RoundTrip starts a client span, propagates it in the request headers and then delegates the request to the actual roundtripper
 func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	sp, _ := opentracing.StartSpanFromContext(req.Context(), "RoundTrip to "+req.URL.String())
-	defer sp.Finish()
-
-	ext.SpanKindRPCClient.Set(sp)
-	ext.Component.Set(sp, "RoundTripper")
-
-	ext.HTTPMethod.Set(sp, req.Method)
-	ext.HTTPUrl.Set(sp, req.URL.String())
-
-	carrier := opentracing.HTTPHeadersCarrier(req.Header)
-	_ = sp.Tracer().Inject(sp.Context(), opentracing.HTTPHeaders, carrier)
+	ctx, span := tracer().Start(req.Context(), "RoundTrip to "+req.URL.String(),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("component", "RoundTripper"),
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+		))
+	defer span.End()
+
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 
 	resp, err := rt.RoundTripper.RoundTrip(req)
 	if resp != nil {
-		ext.HTTPStatusCode.Set(sp, uint16(resp.StatusCode))
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+		}
 	} else {
-		sp.SetTag("error", true)
-		sp.LogFields(log.Error(err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
 
 	return resp, err
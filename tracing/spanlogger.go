@@ -2,22 +2,27 @@ package tracing
 
 import (
 	"context"
-	"github.com/opentracing/opentracing-go"
-	tag "github.com/opentracing/opentracing-go/ext"
-	otlog "github.com/opentracing/opentracing-go/log"
+	"fmt"
 	"github.com/osstotalsoft/bifrost/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"time"
 )
 
-//SpanLoggerFactory is a wrapper over zap.Logger with OpenTracing
+//SpanLoggerFactory is a wrapper over zap.Logger with OpenTelemetry.
+//The messages are added as events to the current span, and the trace and span IDs are added as fields
 func SpanLoggerFactory(logger *zap.Logger) log.Factory {
 	return func(ctx context.Context) log.Logger {
 		if ctx != nil {
-			if span := opentracing.SpanFromContext(ctx); span != nil {
-				// TODO for Jaeger span extract trace/span IDs as fields
-				return spanLogger{logger, span}
+			if span := trace.SpanFromContext(ctx); span.SpanContext().IsValid() {
+				spanContext := span.SpanContext()
+				return spanLogger{
+					logger: logger.With(zap.String("trace_id", spanContext.TraceID().String()), zap.String("span_id", spanContext.SpanID().String())),
+					span:   span,
+				}
 			}
 		}
 		return log.ZapLoggerFactory(logger)(nil)
@@ -26,113 +31,117 @@ func SpanLoggerFactory(logger *zap.Logger) log.Factory {
 
 type spanLogger struct {
 	logger *zap.Logger
-	span   opentracing.Span
+	span   trace.Span
 }
 
+//Info logs an info msg with fields
 func (sl spanLogger) Info(msg string, fields ...zapcore.Field) {
 	sl.logToSpan("info", msg, fields...)
 	sl.logger.Info(msg, fields...)
 }
 
+//Error logs an error msg with fields
 func (sl spanLogger) Error(msg string, fields ...zapcore.Field) {
 	sl.logToSpan("error", msg, fields...)
-	//tag.Error.Set(sl.span, true)
 	sl.logger.Error(msg, fields...)
 }
 
+//Fatal logs a fatal error msg with fields
 func (sl spanLogger) Fatal(msg string, fields ...zapcore.Field) {
 	sl.logToSpan("fatal", msg, fields...)
-	tag.Error.Set(sl.span, true)
+	sl.span.SetStatus(codes.Error, msg)
 	sl.logger.Fatal(msg, fields...)
 }
 
-// Debug logs a fatal error msg with fields
+//Debug logs a debug msg with fields
 func (sl spanLogger) Debug(msg string, fields ...zapcore.Field) {
 	sl.logToSpan("debug", msg, fields...)
 	sl.logger.Debug(msg, fields...)
 }
 
-// Warn logs a fatal error msg with fields
+//Warn logs a warning msg with fields
 func (sl spanLogger) Warn(msg string, fields ...zapcore.Field) {
 	sl.logToSpan("warn", msg, fields...)
 	sl.logger.Warn(msg, fields...)
 }
 
-// Panic logs a fatal error msg with fields
+//Panic logs a panic msg with fields
 func (sl spanLogger) Panic(msg string, fields ...zapcore.Field) {
 	sl.logToSpan("panic", msg, fields...)
-	tag.Error.Set(sl.span, true)
+	sl.span.SetStatus(codes.Error, msg)
 	sl.logger.Panic(msg, fields...)
 }
 
-// With creates a child logger, and optionally adds some context fields to that logger.
+//With creates a child logger, and optionally adds some context fields to that logger
 func (sl spanLogger) With(fields ...zapcore.Field) log.Logger {
-	return spanLogger{logger: sl.logger.With(fields...)}
+	return spanLogger{logger: sl.logger.With(fields...), span: sl.span}
 }
 
 func (sl spanLogger) logToSpan(level string, msg string, fields ...zapcore.Field) {
 	// TODO rather than always converting the fields, we could wrap them into a lazy logger
-	fa := fieldAdapter(make([]otlog.Field, 0, 2+len(fields)))
-	fa = append(fa, otlog.String("event", msg))
-	fa = append(fa, otlog.String("level", level))
+	if !sl.span.IsRecording() {
+		return
+	}
+	fa := fieldAdapter(make([]attribute.KeyValue, 0, 1+len(fields)))
+	fa = append(fa, attribute.String("level", level))
 	for _, field := range fields {
 		field.AddTo(&fa)
 	}
-	sl.span.LogFields(fa...)
+	sl.span.AddEvent(msg, trace.WithAttributes(fa...))
 }
 
-type fieldAdapter []otlog.Field
+type fieldAdapter []attribute.KeyValue
 
 func (fa *fieldAdapter) AddBool(key string, value bool) {
-	*fa = append(*fa, otlog.Bool(key, value))
+	*fa = append(*fa, attribute.Bool(key, value))
 }
 
 func (fa *fieldAdapter) AddFloat64(key string, value float64) {
-	*fa = append(*fa, otlog.Float64(key, value))
+	*fa = append(*fa, attribute.Float64(key, value))
 }
 
 func (fa *fieldAdapter) AddFloat32(key string, value float32) {
-	*fa = append(*fa, otlog.Float64(key, float64(value)))
+	*fa = append(*fa, attribute.Float64(key, float64(value)))
 }
 
 func (fa *fieldAdapter) AddInt(key string, value int) {
-	*fa = append(*fa, otlog.Int(key, value))
+	*fa = append(*fa, attribute.Int(key, value))
 }
 
 func (fa *fieldAdapter) AddInt64(key string, value int64) {
-	*fa = append(*fa, otlog.Int64(key, value))
+	*fa = append(*fa, attribute.Int64(key, value))
 }
 
 func (fa *fieldAdapter) AddInt32(key string, value int32) {
-	*fa = append(*fa, otlog.Int64(key, int64(value)))
+	*fa = append(*fa, attribute.Int64(key, int64(value)))
 }
 
 func (fa *fieldAdapter) AddInt16(key string, value int16) {
-	*fa = append(*fa, otlog.Int64(key, int64(value)))
+	*fa = append(*fa, attribute.Int64(key, int64(value)))
 }
 
 func (fa *fieldAdapter) AddInt8(key string, value int8) {
-	*fa = append(*fa, otlog.Int64(key, int64(value)))
+	*fa = append(*fa, attribute.Int64(key, int64(value)))
 }
 
 func (fa *fieldAdapter) AddUint(key string, value uint) {
-	*fa = append(*fa, otlog.Uint64(key, uint64(value)))
+	*fa = append(*fa, attribute.Int64(key, int64(value)))
 }
 
 func (fa *fieldAdapter) AddUint64(key string, value uint64) {
-	*fa = append(*fa, otlog.Uint64(key, value))
+	*fa = append(*fa, attribute.String(key, fmt.Sprint(value)))
 }
 
 func (fa *fieldAdapter) AddUint32(key string, value uint32) {
-	*fa = append(*fa, otlog.Uint64(key, uint64(value)))
+	*fa = append(*fa, attribute.Int64(key, int64(value)))
 }
 
 func (fa *fieldAdapter) AddUint16(key string, value uint16) {
-	*fa = append(*fa, otlog.Uint64(key, uint64(value)))
+	*fa = append(*fa, attribute.Int64(key, int64(value)))
 }
 
 func (fa *fieldAdapter) AddUint8(key string, value uint8) {
-	*fa = append(*fa, otlog.Uint64(key, uint64(value)))
+	*fa = append(*fa, attribute.Int64(key, int64(value)))
 }
 
 func (fa *fieldAdapter) AddUintptr(key string, value uintptr)                        {}
@@ -145,24 +154,24 @@ func (fa *fieldAdapter) OpenNamespace(key string)
 
 func (fa *fieldAdapter) AddDuration(key string, value time.Duration) {
 	// TODO inefficient
-	*fa = append(*fa, otlog.String(key, value.String()))
+	*fa = append(*fa, attribute.String(key, value.String()))
 }
 
 func (fa *fieldAdapter) AddTime(key string, value time.Time) {
 	// TODO inefficient
-	*fa = append(*fa, otlog.String(key, value.String()))
+	*fa = append(*fa, attribute.String(key, value.String()))
 }
 
 func (fa *fieldAdapter) AddBinary(key string, value []byte) {
-	*fa = append(*fa, otlog.Object(key, value))
+	*fa = append(*fa, attribute.String(key, string(value)))
 }
 
 func (fa *fieldAdapter) AddByteString(key string, value []byte) {
-	*fa = append(*fa, otlog.Object(key, value))
+	*fa = append(*fa, attribute.String(key, string(value)))
 }
 
 func (fa *fieldAdapter) AddString(key, value string) {
 	if key != "" && value != "" {
-		*fa = append(*fa, otlog.String(key, value))
+		*fa = append(*fa, attribute.String(key, value))
 	}
 }
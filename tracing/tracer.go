@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//instrumentationName is the name of the tracer used by the gateway
+const instrumentationName = "github.com/osstotalsoft/bifrost/tracing"
+
+const (
+	//AlwaysOnSampler samples all the traces
+	AlwaysOnSampler = "always_on"
+	//AlwaysOffSampler samples no trace
+	AlwaysOffSampler = "always_off"
+	//TraceIDRatioSampler samples a ratio of the traces
+	TraceIDRatioSampler = "traceidratio"
+	//ParentBasedAlwaysOnSampler follows the decision of the parent span, or samples the root spans
+	ParentBasedAlwaysOnSampler = "parentbased_always_on"
+	//ParentBasedTraceIDRatioSampler follows the decision of the parent span, or samples a ratio of the root spans
+	ParentBasedTraceIDRatioSampler = "parentbased_traceidratio"
+)
+
+//Config is the tracing configuration, loaded from config.json
+type Config struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	ServiceName string `mapstructure:"service_name"`
+	//Endpoint is the host:port of the OTLP/HTTP collector, ex: otel-collector:4318
+	Endpoint string `mapstructure:"endpoint"`
+	//Insecure sends the spans over HTTP instead of HTTPS
+	Insecure bool `mapstructure:"insecure"`
+	//Sampler is one of always_on, always_off, traceidratio, parentbased_always_on, parentbased_traceidratio
+	Sampler string `mapstructure:"sampler"`
+	//SamplerRatio is the ratio of the traceidratio samplers
+	SamplerRatio float64 `mapstructure:"sampler_ratio"`
+}
+
+//DefaultServiceName is the service name of the spans by default
+const DefaultServiceName = "Bifrost API Gateway"
+
+//NewTracerProvider creates a tracer provider which exports the spans to an OTLP collector
+func NewTracerProvider(config Config) (*sdktrace.TracerProvider, error) {
+	sampler, err := NewSampler(config.Sampler, config.SamplerRatio)
+	if err != nil {
+		return nil, err
+	}
+	if !config.Enabled {
+		sampler = sdktrace.NeverSample()
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	}
+
+	if config.Enabled {
+		exporterOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(context.Background(), exporterOptions...)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(options...), nil
+}
+
+//NewSampler creates a sampler by name, parentbased_always_on by default
+func NewSampler(name string, ratio float64) (sdktrace.Sampler, error) {
+	switch name {
+	case AlwaysOnSampler:
+		return sdktrace.AlwaysSample(), nil
+	case AlwaysOffSampler:
+		return sdktrace.NeverSample(), nil
+	case TraceIDRatioSampler:
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case "", ParentBasedAlwaysOnSampler:
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case ParentBasedTraceIDRatioSampler:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	}
+	return nil, fmt.Errorf("unknown sampler %q", name)
+}
+
+//SetGlobalTracerProvider registers the tracer provider and the W3C traceparent and baggage propagators
+func SetGlobalTracerProvider(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"context"
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func setupTestTracer(t *testing.T, sampler sdktrace.Sampler) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(sampler))
+	SetGlobalTracerProvider(provider)
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	return exporter
+}
+
+func spanNamed(spans tracetest.SpanStubs, name string) *tracetest.SpanStub {
+	for i := range spans {
+		if spans[i].Name == name {
+			return &spans[i]
+		}
+	}
+	return nil
+}
+
+func TestSpanWrapper(t *testing.T) {
+	exporter := setupTestTracer(t, sdktrace.AlwaysSample())
+	loggerFactory := log.ZapLoggerFactory(zap.NewNop())
+
+	passThrough := func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	filter := MiddlewareSpanWrapper("Test Filter")(middleware.Func(passThrough))
+	handler := SpanWrapper(filter(abstraction.Endpoint{}, loggerFactory)(upstream))
+
+	req := httptest.NewRequest("GET", "/offers", nil)
+	req.Header.Set("traceparent", traceparent)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	server := spanNamed(spans, "HTTP GET:/offers")
+	filterSpan := spanNamed(spans, "Test Filter")
+	if server == nil || filterSpan == nil {
+		t.Fatalf("expected the server and filter spans, but got %v", spans)
+	}
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the trace of the traceparent header to be continued, but got %v", server.SpanContext.TraceID())
+	}
+	if filterSpan.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("expected the filter span to be a child of the server span")
+	}
+	if server.SpanKind != trace.SpanKindServer || server.Status.Code != codes.Error {
+		t.Errorf("expected an errored server span, but got %v %v", server.SpanKind, server.Status)
+	}
+}
+
+func TestRoundTripperPropagation(t *testing.T) {
+	exporter := setupTestTracer(t, sdktrace.AlwaysSample())
+
+	var headers http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	member, _ := baggage.NewMember("tenant", "charisma")
+	bag, _ := baggage.New(member)
+	ctx, span := tracer().Start(baggage.ContextWithBaggage(context.Background(), bag), "parent")
+	req, _ := http.NewRequestWithContext(ctx, "GET", upstream.URL, nil)
+	resp, err := NewRoundTripperWithOpenTrancing().RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	span.End()
+
+	client := spanNamed(exporter.GetSpans(), "RoundTrip to "+upstream.URL)
+	if client == nil || client.SpanKind != trace.SpanKindClient {
+		t.Fatalf("expected a client span, but got %v", exporter.GetSpans())
+	}
+	expected := "00-" + client.SpanContext.TraceID().String() + "-" + client.SpanContext.SpanID().String() + "-01"
+	if headers.Get("traceparent") != expected {
+		t.Errorf("expected the traceparent header %v, but got %v", expected, headers.Get("traceparent"))
+	}
+	if headers.Get("baggage") != "tenant=charisma" {
+		t.Errorf("expected the baggage to be propagated, but got %v", headers.Get("baggage"))
+	}
+}
+
+func TestSpanLogger(t *testing.T) {
+	exporter := setupTestTracer(t, sdktrace.AlwaysSample())
+	loggerFactory := SpanLoggerFactory(zap.NewNop())
+
+	ctx, span := tracer().Start(context.Background(), "operation")
+	loggerFactory(ctx).With(zap.String("topic", "offers")).Info("message published", zap.Int("size", 10))
+	span.End()
+
+	events := exporter.GetSpans()[0].Events
+	if len(events) != 1 || events[0].Name != "message published" || len(events[0].Attributes) != 2 {
+		t.Errorf("expected the message to be added to the span, but got %v", events)
+	}
+}
+
+func TestSampler(t *testing.T) {
+	exporter := setupTestTracer(t, mustSampler(t, AlwaysOffSampler, 0))
+	_, span := tracer().Start(context.Background(), "operation")
+	span.End()
+	if len(exporter.GetSpans()) != 0 {
+		t.Error("expected no span to be sampled")
+	}
+
+	exporter = setupTestTracer(t, mustSampler(t, ParentBasedTraceIDRatioSampler, 0))
+	handler := SpanWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest("GET", "/offers", nil)
+	req.Header.Set("traceparent", traceparent)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/offers", nil))
+	if len(exporter.GetSpans()) != 1 {
+		t.Errorf("expected only the sampled parent to be followed, but got %v spans", len(exporter.GetSpans()))
+	}
+
+	if _, err := NewSampler("sometimes", 0); err == nil {
+		t.Error("expected an unknown sampler to fail")
+	}
+}
+
+func mustSampler(t *testing.T, name string, ratio float64) sdktrace.Sampler {
+	sampler, err := NewSampler(name, ratio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sampler
+}
@@ -1,51 +1,70 @@
 package tracing
 
 import (
-	"github.com/opentracing-contrib/go-stdlib/nethttp"
-	"github.com/opentracing/opentracing-go"
 	"github.com/osstotalsoft/bifrost/abstraction"
 	"github.com/osstotalsoft/bifrost/handler"
+	"github.com/osstotalsoft/bifrost/httputils"
 	"github.com/osstotalsoft/bifrost/log"
 	"github.com/osstotalsoft/bifrost/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 )
 
-//SpanWrapper is a http.Handler with opentracing
+//SpanWrapper is a http.Handler with OpenTelemetry.
+//It continues the trace received in the traceparent and baggage headers
 func SpanWrapper(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := tracer().Start(ctx, "HTTP "+request.Method+":"+request.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("http.uri", request.URL.EscapedPath()),
+			))
+		defer span.End()
 
-	tracer := opentracing.GlobalTracer()
+		sw := httputils.NewStatusRecorder(writer)
+		inner.ServeHTTP(sw, request.WithContext(ctx))
 
-	//setup opentracing for main handler
-	return nethttp.Middleware(tracer, inner, nethttp.OperationNameFunc(func(r *http.Request) string {
-		return "HTTP " + r.Method + ":" + r.URL.Path
-	}), nethttp.MWSpanObserver(func(span opentracing.Span, r *http.Request) {
-		span.SetTag("http.uri", r.URL.EscapedPath())
-	}))
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.Status))
+		if sw.Status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.Status))
+		}
+	})
 }
 
-//MiddlewareSpanWrapper is a middleware.Func with opentracing
+//MiddlewareSpanWrapper is a middleware.Func with OpenTelemetry.
+//The inner middleware is built once for the endpoint, so that its state is kept between the requests
 func MiddlewareSpanWrapper(operation string) func(inner middleware.Func) middleware.Func {
 	return func(inner middleware.Func) middleware.Func {
 		return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+			innerMiddleware := inner(endpoint, loggerFactory)
 			return func(next http.Handler) http.Handler {
+				h := innerMiddleware(next)
 				return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-					span, ctx := opentracing.StartSpanFromContext(request.Context(), operation)
-					defer span.Finish()
-					inner(endpoint, loggerFactory)(next).ServeHTTP(writer, request.WithContext(ctx))
+					ctx, span := tracer().Start(request.Context(), operation)
+					defer span.End()
+					h.ServeHTTP(writer, request.WithContext(ctx))
 				})
 			}
 		}
 	}
 }
 
-//HandlerSpanWrapper is a handler.Func with opentracing
+//HandlerSpanWrapper is a handler.Func with OpenTelemetry.
+//The inner handler is built once for the endpoint, so that its state is kept between the requests
 func HandlerSpanWrapper(operation string) func(inner handler.Func) handler.Func {
 	return func(inner handler.Func) handler.Func {
 		return func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+			h := inner(endpoint, loggerFactory)
 			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-				span, ctx := opentracing.StartSpanFromContext(request.Context(), operation)
-				defer span.Finish()
-				inner(endpoint, loggerFactory).ServeHTTP(writer, request.WithContext(ctx))
+				ctx, span := tracer().Start(request.Context(), operation)
+				defer span.End()
+				h.ServeHTTP(writer, request.WithContext(ctx))
 			})
 		}
 	}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"github.com/osstotalsoft/bifrost/abstraction"
+	"github.com/osstotalsoft/bifrost/handler"
+	"github.com/osstotalsoft/bifrost/log"
+	"github.com/osstotalsoft/bifrost/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestWrappersKeepState(t *testing.T) {
+	loggerFactory := log.ZapLoggerFactory(zap.NewNop())
+
+	//the filter and the handler count the requests they see since they were built
+	counting := func(endpoint abstraction.Endpoint, loggerFactory log.Factory) func(http.Handler) http.Handler {
+		count := 0
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				count++
+				w.Header().Set("X-Filter-Count", strconv.Itoa(count))
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	countingHandler := func(endpoint abstraction.Endpoint, loggerFactory log.Factory) http.Handler {
+		count := 0
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count++
+			w.Header().Set("X-Handler-Count", strconv.Itoa(count))
+		})
+	}
+
+	h := HandlerSpanWrapper("Test Handler")(handler.Func(countingHandler))(abstraction.Endpoint{}, loggerFactory)
+	h = MiddlewareSpanWrapper("Test Filter")(middleware.Func(counting))(abstraction.Endpoint{}, loggerFactory)(h)
+
+	var recorder *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		recorder = httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/offers", nil))
+	}
+	if filterCount, handlerCount := recorder.Header().Get("X-Filter-Count"), recorder.Header().Get("X-Handler-Count"); filterCount != "3" || handlerCount != "3" {
+		t.Errorf("expected the filter and the handler to be built once and see 3 requests, but got %s and %s", filterCount, handlerCount)
+	}
+}